@@ -0,0 +1,47 @@
+package main
+
+// Bitfield records which pieces a peer (or we) have, high bit first as in the
+// wire format
+type Bitfield []byte
+
+func newBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+func (bf Bitfield) HasPiece(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+	return bf[byteIndex]>>(7-uint(index%8))&1 != 0
+}
+
+func (bf Bitfield) SetPiece(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - uint(index%8))
+}
+
+// Number of pieces set among the first numPieces
+func (bf Bitfield) Count(numPieces int) int {
+	count := 0
+	for i := 0; i < numPieces; i++ {
+		if bf.HasPiece(i) {
+			count++
+		}
+	}
+	return count
+}
+
+// Whether any bit past the first numPieces is set, which a well-formed
+// bitfield never has
+func (bf Bitfield) spareBitsSet(numPieces int) bool {
+	for i := numPieces; i < len(bf)*8; i++ {
+		if bf.HasPiece(i) {
+			return true
+		}
+	}
+	return false
+}
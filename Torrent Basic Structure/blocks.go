@@ -0,0 +1,247 @@
+package main
+
+import "sync"
+
+// Size of the blocks pieces are requested in
+const blockSize = 1 << 14 // 16 KB
+
+// pieceProgress is a piece being assembled from its blocks. It is shared by
+// every peer the piece is assigned to, so a block one of them delivered is
+// not fetched again, and in endgame the block is cancelled on the others as
+// soon as it arrives. The fields after buf are guarded by the registry.
+type pieceProgress struct {
+	index  int
+	length int    // Bytes to request; padding past length stays zero
+	buf    []byte // The whole piece
+
+	received []bool
+	count    int                  // Number of blocks received
+	requests []int                // Requests out for each block, over all peers
+	holders  map[*peerSlot][]bool // Blocks each peer working on the piece has requested
+	from     map[*peerSlot]bool   // Peers that sent the blocks received
+	excluded map[*peerSlot]bool   // Holders whose blocks failed the piece hash
+}
+
+func (pp *pieceProgress) numBlocks() int {
+	return len(pp.received)
+}
+
+func (pp *pieceProgress) blockLength(block int) int {
+	length := blockSize
+	if (block+1)*blockSize > pp.length {
+		length = pp.length - block*blockSize // Handle last block
+	}
+	return length
+}
+
+// pieceRegistry holds the pieces being downloaded, from the first peer
+// starting one until the scheduler has it verified
+type pieceRegistry struct {
+	mu      sync.Mutex
+	pieces  map[int]*pieceProgress
+	endgame bool // Peers may request blocks other peers already requested
+}
+
+func newPieceRegistry() *pieceRegistry {
+	return &pieceRegistry{pieces: make(map[int]*pieceProgress)}
+}
+
+// Start work on a piece for a peer, picking up the blocks other peers
+// already delivered. length is the data to request and size the whole piece.
+func (r *pieceRegistry) join(slot *peerSlot, index, length, size int) *pieceProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pp := r.pieces[index]
+	if pp == nil {
+		blocks := (length + blockSize - 1) / blockSize
+		pp = &pieceProgress{
+			index:    index,
+			length:   length,
+			buf:      make([]byte, size),
+			received: make([]bool, blocks),
+			requests: make([]int, blocks),
+			holders:  make(map[*peerSlot][]bool),
+			from:     make(map[*peerSlot]bool),
+			excluded: make(map[*peerSlot]bool),
+		}
+		r.pieces[index] = pp
+	}
+	pp.holders[slot] = make([]bool, pp.numBlocks())
+	delete(pp.excluded, slot)
+	return pp
+}
+
+// Stop work on a piece for a peer and return the blocks it still had
+// requested, which the peer should cancel
+func (r *pieceRegistry) leave(slot *peerSlot, pp *pieceProgress) []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	outstanding := r.release(slot, pp)
+	delete(pp.holders, slot)
+	return outstanding
+}
+
+// Forget the peer's requests for a piece, as when it chokes us. Returns the
+// blocks that were requested. Called with mu held.
+func (r *pieceRegistry) release(slot *peerSlot, pp *pieceProgress) []int {
+	var outstanding []int
+	mine := pp.holders[slot]
+	for block, requested := range mine {
+		if requested {
+			mine[block] = false
+			pp.requests[block]--
+			outstanding = append(outstanding, block)
+		}
+	}
+	return outstanding
+}
+
+// Forget the peer's requests for all its pieces after it choked us
+func (r *pieceRegistry) choked(slot *peerSlot, active []*pieceProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, pp := range active {
+		r.release(slot, pp)
+	}
+}
+
+// Choose the next block for a peer to request among its pieces, oldest
+// first, and record the request. A block nobody requested yet comes first;
+// in endgame, blocks requested from other peers are asked for as well.
+// Returns nil if the peer has nothing left to request.
+func (r *pieceRegistry) nextRequest(slot *peerSlot, active []*pieceProgress) (*pieceProgress, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for pass := 0; pass < 2; pass++ {
+		if pass == 1 && !r.endgame {
+			break
+		}
+		for _, pp := range active {
+			mine := pp.holders[slot]
+			for block, received := range pp.received {
+				if received || mine[block] || (pass == 0 && pp.requests[block] > 0) {
+					continue
+				}
+				mine[block] = true
+				pp.requests[block]++
+				return pp, block
+			}
+		}
+	}
+	return nil, -1
+}
+
+// Store a block a peer delivered. requested reports whether the peer had
+// asked for it, fresh whether nobody had delivered it before, and complete
+// whether it was the piece's last block, in which case the peer verifies the
+// piece. others are the peers to tell to cancel their request for the block.
+func (r *pieceRegistry) receive(slot *peerSlot, pp *pieceProgress, block int, data []byte) (requested, fresh, complete bool, others []*peerSlot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mine := pp.holders[slot]
+	if mine != nil && mine[block] {
+		mine[block] = false
+		pp.requests[block]--
+		requested = true
+	}
+	if pp.received[block] {
+		return requested, false, false, nil
+	}
+	copy(pp.buf[block*blockSize:], data)
+	pp.received[block] = true
+	pp.count++
+	pp.from[slot] = true
+	for other, theirs := range pp.holders {
+		if other != slot && theirs[block] {
+			others = append(others, other)
+		}
+	}
+	return requested, true, pp.count == pp.numBlocks(), others
+}
+
+// Blocks of a peer's piece that arrived from other peers while it had them
+// requested, which it should cancel. excluded is set if blocks from the peer
+// failed the piece hash, so it should drop the piece.
+func (r *pieceRegistry) arrivedElsewhere(slot *peerSlot, pp *pieceProgress) (cancel []int, excluded bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if pp.excluded[slot] {
+		return nil, true
+	}
+	mine := pp.holders[slot]
+	for block, requested := range mine {
+		if requested && pp.received[block] {
+			mine[block] = false
+			pp.requests[block]--
+			cancel = append(cancel, block)
+		}
+	}
+	return cancel, false
+}
+
+// Throw away the blocks of a piece that failed its hash, so it is fetched
+// again. The other peers still working on it that sent some of the blocks are
+// excluded from it. Returns the peers to wake to see the change.
+func (r *pieceRegistry) reject(pp *pieceProgress) []*peerSlot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var holders []*peerSlot
+	for slot := range pp.holders {
+		if pp.from[slot] {
+			pp.excluded[slot] = true
+		}
+		holders = append(holders, slot)
+	}
+	for block := range pp.received {
+		pp.received[block] = false
+	}
+	pp.count = 0
+	pp.from = make(map[*peerSlot]bool)
+	return holders
+}
+
+// Forget a piece once it is verified
+func (r *pieceRegistry) remove(index int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pieces, index)
+}
+
+// Report whether a block of the piece is neither received nor requested,
+// which is always the case for a piece nobody started
+func (r *pieceRegistry) hasUnrequested(index int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.unrequested(index)
+}
+
+// Called with mu held
+func (r *pieceRegistry) unrequested(index int) bool {
+	pp := r.pieces[index]
+	if pp == nil {
+		return true
+	}
+	for block, received := range pp.received {
+		if !received && pp.requests[block] == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Switch to endgame once every block of the given pieces has been requested
+// or received. Reports whether the registry is in endgame.
+func (r *pieceRegistry) startEndgame(indices map[int]map[*peerSlot]bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.endgame {
+		return true
+	}
+	for index := range indices {
+		if r.unrequested(index) {
+			return false
+		}
+	}
+	r.endgame = true
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Before endgame a block is requested from one peer only, and a block that
+// arrived is never requested again
+func TestPieceRegistryShareBlocks(t *testing.T) {
+	r := newPieceRegistry()
+	a, b := &peerSlot{address: "a"}, &peerSlot{address: "b"}
+	pp := r.join(a, 0, 3*blockSize, 3*blockSize)
+	if r.join(b, 0, 3*blockSize, 3*blockSize) != pp {
+		t.Fatal("second peer got its own copy of the piece")
+	}
+
+	if got, block := r.nextRequest(a, []*pieceProgress{pp}); got != pp || block != 0 {
+		t.Fatalf("a requested block %d", block)
+	}
+	if _, block := r.nextRequest(b, []*pieceProgress{pp}); block != 1 {
+		t.Fatalf("b requested block %d, want 1", block)
+	}
+	requested, fresh, complete, others := r.receive(a, pp, 0, make([]byte, blockSize))
+	if !requested || !fresh || complete || len(others) != 0 {
+		t.Fatalf("receive: %v %v %v %v", requested, fresh, complete, others)
+	}
+	if _, block := r.nextRequest(a, []*pieceProgress{pp}); block != 2 {
+		t.Fatalf("a requested block %d, want 2", block)
+	}
+	if got, _ := r.nextRequest(a, []*pieceProgress{pp}); got != nil {
+		t.Fatal("a requested a block b has out before endgame")
+	}
+	if r.hasUnrequested(0) || !r.hasUnrequested(1) {
+		t.Error("unrequested blocks misreported")
+	}
+
+	// A choke gives the blocks back to other peers
+	r.choked(a, []*pieceProgress{pp})
+	if !r.hasUnrequested(0) {
+		t.Error("blocks still requested from a choking peer")
+	}
+	if _, block := r.nextRequest(b, []*pieceProgress{pp}); block != 2 {
+		t.Fatalf("b requested block %d after a choked, want 2", block)
+	}
+}
+
+// In endgame every block still out is requested from the other holders too,
+// and cancelled on them as soon as one peer delivers it
+func TestPieceRegistryEndgameCancelsBlock(t *testing.T) {
+	r := newPieceRegistry()
+	a, b := &peerSlot{address: "a"}, &peerSlot{address: "b"}
+	inProgress := map[int]map[*peerSlot]bool{0: {a: true}, 1: {b: true}}
+	pa := r.join(a, 0, 2*blockSize, 2*blockSize)
+	pb := r.join(b, 1, blockSize, blockSize)
+	r.nextRequest(a, []*pieceProgress{pa})
+	r.nextRequest(b, []*pieceProgress{pb})
+	if r.startEndgame(inProgress) {
+		t.Fatal("endgame with block 1 of piece 0 not requested")
+	}
+	r.nextRequest(a, []*pieceProgress{pa})
+	if !r.startEndgame(inProgress) {
+		t.Fatal("no endgame with every block requested")
+	}
+
+	// b joins piece 0 and asks for both blocks a has out
+	inProgress[0][b] = true
+	r.join(b, 0, 2*blockSize, 2*blockSize)
+	var blocks []int
+	for {
+		pp, block := r.nextRequest(b, []*pieceProgress{pb, pa})
+		if pp == nil {
+			break
+		}
+		if pp == pa {
+			blocks = append(blocks, block)
+		}
+	}
+	if fmt.Sprint(blocks) != "[0 1]" {
+		t.Fatalf("b requested blocks %v of piece 0, want [0 1]", blocks)
+	}
+
+	_, fresh, _, others := r.receive(b, pa, 1, make([]byte, blockSize))
+	if !fresh || len(others) != 1 || others[0] != a {
+		t.Fatalf("block 1 from b: fresh %v, others %v", fresh, others)
+	}
+	if cancel, excluded := r.arrivedElsewhere(a, pa); excluded || fmt.Sprint(cancel) != "[1]" {
+		t.Fatalf("a cancels %v, excluded %v; want [1]", cancel, excluded)
+	}
+	if cancel, _ := r.arrivedElsewhere(a, pa); len(cancel) != 0 {
+		t.Fatalf("a cancels %v a second time", cancel)
+	}
+
+	// The late copy from a is a duplicate, and a still holds block 0
+	requested, fresh, _, _ := r.receive(a, pa, 1, make([]byte, blockSize))
+	if requested || fresh {
+		t.Fatalf("late block: requested %v, fresh %v", requested, fresh)
+	}
+	if cancel := r.leave(a, pa); fmt.Sprint(cancel) != "[0]" {
+		t.Fatalf("a leaves with %v out, want [0]", cancel)
+	}
+}
+
+// A piece that failed its hash starts over, without the peers that sent
+// blocks of it
+func TestPieceRegistryReject(t *testing.T) {
+	r := newPieceRegistry()
+	a, b, c := &peerSlot{address: "a"}, &peerSlot{address: "b"}, &peerSlot{address: "c"}
+	pp := r.join(a, 0, 2*blockSize, 2*blockSize)
+	r.join(b, 0, 2*blockSize, 2*blockSize)
+	r.join(c, 0, 2*blockSize, 2*blockSize)
+	r.endgame = true
+	r.nextRequest(b, []*pieceProgress{pp})
+	r.receive(b, pp, 0, make([]byte, blockSize))
+	r.receive(a, pp, 1, make([]byte, blockSize))
+	r.leave(a, pp) // a verifies the piece
+
+	if holders := r.reject(pp); len(holders) != 2 {
+		t.Fatalf("woke %d holders, want b and c", len(holders))
+	}
+	if _, excluded := r.arrivedElsewhere(b, pp); !excluded {
+		t.Error("b sent a block of the bad piece but keeps it")
+	}
+	if _, excluded := r.arrivedElsewhere(c, pp); excluded {
+		t.Error("c sent nothing but was excluded")
+	}
+	if pp.count != 0 || pp.received[0] || pp.received[1] {
+		t.Error("blocks of the bad piece kept")
+	}
+	if got, block := r.nextRequest(c, []*pieceProgress{pp}); got != pp || block != 0 {
+		t.Fatalf("c requested block %d, want 0", block)
+	}
+}
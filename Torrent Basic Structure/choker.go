@@ -0,0 +1,172 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Choking intervals and slot count as recommended by BEP 3
+const (
+	chokeInterval             = 10 * time.Second
+	optimisticUnchokeInterval = 30 * time.Second
+	uploadSlots               = 4
+)
+
+// rateCounter turns the bytes a peer goroutine transfers into a rate the
+// choker can rank by. add may be called from any goroutine; sample and rate
+// belong to the scheduler.
+type rateCounter struct {
+	total int64 // Bytes so far, updated atomically
+	last  int64 // total at the previous sample
+	rate  float64
+}
+
+func (r *rateCounter) add(n int) {
+	atomic.AddInt64(&r.total, int64(n))
+}
+
+// Measure the rate over the elapsed time since the previous sample
+func (r *rateCounter) sample(elapsed time.Duration) {
+	total := atomic.LoadInt64(&r.total)
+	if elapsed > 0 {
+		r.rate = float64(total-r.last) / elapsed.Seconds()
+	}
+	r.last = total
+}
+
+// Bytes per second over the last sample interval
+func (r *rateCounter) bytesPerSecond() float64 {
+	return r.rate
+}
+
+// What the choker knows about one connection
+type chokeCandidate struct {
+	peer         *peerSlot
+	interested   bool    // The peer wants pieces from us
+	downloadRate float64 // Bytes per second the peer sends us
+	uploadRate   float64 // Bytes per second we send the peer
+}
+
+// choker implements tit-for-tat: the interested peers that upload to us
+// fastest get the regular upload slots, and one more interested peer is
+// unchoked at random so new peers get a chance to prove themselves. Once
+// we are seeding nobody uploads to us, so peers are ranked by how fast
+// they download from us instead.
+type choker struct {
+	slots          int
+	rand           *rand.Rand
+	optimistic     *peerSlot // Current optimistic unchoke, if any
+	lastOptimistic time.Time // When it was chosen
+}
+
+func newChoker(slots int) *choker {
+	return &choker{slots: slots, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Decide which peers are unchoked; everyone else is choked. Uninterested
+// peers are always choked since they would not request anything.
+func (c *choker) rechoke(peers []chokeCandidate, seeding bool, now time.Time) map[*peerSlot]bool {
+	var interested []chokeCandidate
+	for _, candidate := range peers {
+		if candidate.interested {
+			interested = append(interested, candidate)
+		}
+	}
+	rate := func(candidate chokeCandidate) float64 {
+		if seeding {
+			return candidate.uploadRate
+		}
+		return candidate.downloadRate
+	}
+	sort.SliceStable(interested, func(i, j int) bool {
+		return rate(interested[i]) > rate(interested[j])
+	})
+
+	unchoked := make(map[*peerSlot]bool)
+	for i := 0; i < len(interested) && i < c.slots; i++ {
+		unchoked[interested[i].peer] = true
+	}
+
+	// The rest compete for the optimistic unchoke
+	var others []*peerSlot
+	current := false
+	for _, candidate := range interested {
+		if unchoked[candidate.peer] {
+			continue
+		}
+		others = append(others, candidate.peer)
+		if candidate.peer == c.optimistic {
+			current = true
+		}
+	}
+	if len(others) == 0 {
+		c.optimistic = nil
+		return unchoked
+	}
+	if !current || now.Sub(c.lastOptimistic) >= optimisticUnchokeInterval {
+		// Rotate to a different peer when there is one
+		previous := c.optimistic
+		if current && len(others) > 1 {
+			for i, peer := range others {
+				if peer == previous {
+					others = append(others[:i], others[i+1:]...)
+					break
+				}
+			}
+		}
+		c.optimistic = others[c.rand.Intn(len(others))]
+		c.lastOptimistic = now
+	}
+	unchoked[c.optimistic] = true
+	return unchoked
+}
+
+// Measure every live peer's transfer rates since the previous sample
+func (d *downloader) sampleRates() {
+	now := time.Now()
+	elapsed := now.Sub(d.lastChoke)
+	d.lastChoke = now
+	for _, slot := range d.peers {
+		if !slot.gone {
+			slot.downloadRate.sample(elapsed)
+			slot.uploadRate.sample(elapsed)
+		}
+	}
+}
+
+// Run the choker over the live peers and tell the peers whose choke state
+// changed. Once the download is complete the choker works in seed mode.
+func (d *downloader) rechoke() {
+	var candidates []chokeCandidate
+	for _, slot := range d.peers {
+		if slot.gone {
+			continue
+		}
+		candidates = append(candidates, chokeCandidate{
+			peer:         slot,
+			interested:   slot.interested,
+			downloadRate: slot.downloadRate.bytesPerSecond(),
+			uploadRate:   slot.uploadRate.bytesPerSecond(),
+		})
+	}
+	unchoked := d.choker.rechoke(candidates, d.completed == d.numPieces, time.Now())
+
+	for _, slot := range d.peers {
+		if slot.gone {
+			continue
+		}
+		var state int32
+		if unchoked[slot] {
+			state = 1
+		}
+		if atomic.SwapInt32(&slot.unchoked, state) == state {
+			continue
+		}
+		select {
+		case slot.wake <- struct{}{}:
+		default: // Already woken
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// simPeer is a simulated connection that moves a fixed number of bytes per
+// second in each direction
+type simPeer struct {
+	slot       *peerSlot
+	interested bool
+	sendsUs    int // Bytes per second the peer uploads to us
+	takesFrom  int // Bytes per second we upload to the peer
+}
+
+func newSimPeers(count int) []*simPeer {
+	peers := make([]*simPeer, count)
+	for i := range peers {
+		peers[i] = &simPeer{slot: &peerSlot{address: fmt.Sprintf("peer%d", i)}, interested: true}
+	}
+	return peers
+}
+
+// Advance the simulation by one choke interval and run the choker
+func runChokeRound(c *choker, peers []*simPeer, seeding bool, now time.Time) map[*peerSlot]bool {
+	var candidates []chokeCandidate
+	for _, p := range peers {
+		p.slot.downloadRate.add(p.sendsUs * int(chokeInterval/time.Second))
+		p.slot.uploadRate.add(p.takesFrom * int(chokeInterval/time.Second))
+		p.slot.downloadRate.sample(chokeInterval)
+		p.slot.uploadRate.sample(chokeInterval)
+		candidates = append(candidates, chokeCandidate{
+			peer:         p.slot,
+			interested:   p.interested,
+			downloadRate: p.slot.downloadRate.bytesPerSecond(),
+			uploadRate:   p.slot.uploadRate.bytesPerSecond(),
+		})
+	}
+	return c.rechoke(candidates, seeding, now)
+}
+
+func TestRateCounter(t *testing.T) {
+	var r rateCounter
+	r.add(30000)
+	r.add(20000)
+	r.sample(10 * time.Second)
+	if got := r.bytesPerSecond(); got != 5000 {
+		t.Fatalf("rate = %v, want 5000", got)
+	}
+	r.sample(10 * time.Second)
+	if got := r.bytesPerSecond(); got != 0 {
+		t.Fatalf("rate after an idle interval = %v, want 0", got)
+	}
+}
+
+func TestChokerUnchokesFastestUploaders(t *testing.T) {
+	peers := newSimPeers(8)
+	for i, p := range peers {
+		p.sendsUs = (i + 1) * 1000
+	}
+	// The fastest peer is not interested, so it gets no slot
+	peers[7].interested = false
+
+	c := newChoker(uploadSlots)
+	unchoked := runChokeRound(c, peers, false, time.Now())
+
+	if len(unchoked) != uploadSlots+1 {
+		t.Fatalf("%d peers unchoked, want %d", len(unchoked), uploadSlots+1)
+	}
+	for _, i := range []int{3, 4, 5, 6} {
+		if !unchoked[peers[i].slot] {
+			t.Errorf("peer %d with rate %d is choked", i, peers[i].sendsUs)
+		}
+	}
+	if unchoked[peers[7].slot] {
+		t.Error("uninterested peer is unchoked")
+	}
+	if c.optimistic == nil || !unchoked[c.optimistic] {
+		t.Fatal("no optimistic unchoke")
+	}
+	for _, i := range []int{3, 4, 5, 6, 7} {
+		if c.optimistic == peers[i].slot {
+			t.Fatalf("optimistic unchoke went to peer %d", i)
+		}
+	}
+}
+
+func TestChokerSeedModeRanksByUploadRate(t *testing.T) {
+	peers := newSimPeers(6)
+	for i, p := range peers {
+		// The slowest downloaders send us the most, which must not earn
+		// them a slot once we are seeding
+		p.sendsUs = (6 - i) * 1000
+		p.takesFrom = (i + 1) * 1000
+	}
+
+	c := newChoker(uploadSlots)
+	unchoked := runChokeRound(c, peers, true, time.Now())
+	for _, i := range []int{2, 3, 4, 5} {
+		if !unchoked[peers[i].slot] {
+			t.Errorf("peer %d downloading at %d is choked", i, peers[i].takesFrom)
+		}
+	}
+	if c.optimistic != peers[0].slot && c.optimistic != peers[1].slot {
+		t.Error("optimistic unchoke is not one of the remaining peers")
+	}
+}
+
+// The optimistic unchoke stays put for 30 seconds and then moves on, and a
+// peer that starts uploading to us fast takes a regular slot
+func TestChokerRotatesOptimisticUnchoke(t *testing.T) {
+	peers := newSimPeers(10)
+	for i, p := range peers {
+		p.sendsUs = (i + 1) * 1000
+	}
+
+	c := newChoker(uploadSlots)
+	start := time.Now()
+	runChokeRound(c, peers, false, start)
+	first := c.optimistic
+
+	for round := 1; round < 3; round++ {
+		runChokeRound(c, peers, false, start.Add(time.Duration(round)*chokeInterval))
+		if c.optimistic != first {
+			t.Fatalf("optimistic unchoke changed after %v", time.Duration(round)*chokeInterval)
+		}
+	}
+	unchoked := runChokeRound(c, peers, false, start.Add(optimisticUnchokeInterval))
+	if c.optimistic == first {
+		t.Fatal("optimistic unchoke was not rotated after 30 seconds")
+	}
+	if unchoked[first] {
+		t.Fatal("previous optimistic unchoke is still unchoked")
+	}
+
+	// The slowest peer suddenly becomes the fastest
+	peers[0].sendsUs = 100000
+	unchoked = runChokeRound(c, peers, false, start.Add(optimisticUnchokeInterval+chokeInterval))
+	if !unchoked[peers[0].slot] || c.optimistic == peers[0].slot {
+		t.Fatal("fast peer did not get a regular upload slot")
+	}
+	if unchoked[peers[6].slot] && c.optimistic != peers[6].slot {
+		t.Fatal("peer pushed out of the top four kept its slot")
+	}
+}
+
+func TestChokerFewInterestedPeers(t *testing.T) {
+	peers := newSimPeers(3)
+	peers[2].interested = false
+
+	c := newChoker(uploadSlots)
+	unchoked := runChokeRound(c, peers, false, time.Now())
+	if len(unchoked) != 2 || !unchoked[peers[0].slot] || !unchoked[peers[1].slot] {
+		t.Fatalf("unchoked %v, want the two interested peers", unchoked)
+	}
+	if c.optimistic != nil {
+		t.Fatal("optimistic unchoke without a spare peer")
+	}
+}
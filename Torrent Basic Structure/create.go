@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"bittorrent-client/bencode"
+)
+
+// Piece lengths picked automatically stay between these powers of two
+const (
+	minAutoPieceLength = 16 * 1024
+	maxAutoPieceLength = 16 * 1024 * 1024
+)
+
+// Automatic piece lengths grow until the torrent has at most this many pieces
+const targetPieceCount = 1500
+
+// What goes into a new .torrent besides the data
+type createOptions struct {
+	trackers    [][]string // Tiers of announce URLs; the first one is the announce
+	webSeeds    []string
+	comment     string
+	private     bool
+	pieceLength int // 0 picks one from the size of the data
+}
+
+// A command line flag that may be given more than once
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// A file found under the path being shared
+type createEntry struct {
+	path   []string // Relative to the shared directory
+	length int64
+}
+
+// Pick a piece length for data of the given size: the smallest power of two
+// that keeps the piece count near targetPieceCount
+func autoPieceLength(total int64) int {
+	length := minAutoPieceLength
+	for length < maxAutoPieceLength && total/int64(length) > targetPieceCount {
+		length *= 2
+	}
+	return length
+}
+
+// Build a torrent for the file or directory at root. Directories become
+// multi-file torrents of every regular file below them, in lexical order.
+func createTorrent(root string, opts createOptions) (TorrentFile, error) {
+	var torrent TorrentFile
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return torrent, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return torrent, err
+	}
+
+	var entries []createEntry
+	var total int64
+	if info.IsDir() {
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			fileInfo, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, createEntry{path: strings.Split(filepath.ToSlash(rel), "/"), length: fileInfo.Size()})
+			total += fileInfo.Size()
+			return nil
+		})
+		if err != nil {
+			return torrent, err
+		}
+	} else {
+		total = info.Size()
+	}
+	if total == 0 {
+		return torrent, fmt.Errorf("%s has no data to share", root)
+	}
+
+	pieceLength := opts.pieceLength
+	if pieceLength == 0 {
+		pieceLength = autoPieceLength(total)
+	}
+	if pieceLength < minAutoPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return torrent, fmt.Errorf("piece length %d is not a power of two of at least %d", pieceLength, minAutoPieceLength)
+	}
+
+	torrent.Info.Name = filepath.Base(root)
+	torrent.Info.PieceLength = pieceLength
+	if info.IsDir() {
+		for _, e := range entries {
+			torrent.Info.Files = append(torrent.Info.Files, torrentFileEntry{Length: int(e.length), Path: e.path})
+		}
+	} else {
+		torrent.Info.Length = int(total)
+	}
+	if opts.private {
+		torrent.Info.Private = 1
+	}
+
+	torrent.Info.Pieces, err = hashPieces(torrent, filepath.Dir(root))
+	if err != nil {
+		return torrent, err
+	}
+
+	for _, tier := range opts.trackers {
+		if len(tier) > 0 && torrent.Announce == "" {
+			torrent.Announce = tier[0]
+		}
+	}
+	// A single tracker needs no announce-list
+	if len(opts.trackers) > 1 || (len(opts.trackers) == 1 && len(opts.trackers[0]) > 1) {
+		torrent.AnnounceList = opts.trackers
+	}
+	if len(opts.webSeeds) > 0 {
+		torrent.URLList = opts.webSeeds
+	}
+	torrent.Comment = opts.comment
+	torrent.CreatedBy = clientVersion
+	torrent.CreationDate = time.Now().Unix()
+
+	torrent.RawInfo, err = bencode.Marshal(torrent.Info)
+	if err != nil {
+		return torrent, err
+	}
+	return torrent, nil
+}
+
+// Hash every piece of the torrent's data below baseDir, reading and hashing
+// as many pieces at once as there are CPUs
+func hashPieces(torrent TorrentFile, baseDir string) (string, error) {
+	storage, err := openFileStorage(torrent, baseDir)
+	if err != nil {
+		return "", err
+	}
+	defer storage.Close()
+
+	numPieces := torrent.numPieces()
+	hashes := make([]byte, numPieces*sha1.Size)
+	indexes := make(chan int)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				data, err := storage.ReadPiece(index, torrent.pieceSize(index))
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					continue
+				}
+				sum := sha1.Sum(data)
+				copy(hashes[index*sha1.Size:], sum[:])
+			}
+		}()
+	}
+	for i := 0; i < numPieces; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return "", err
+	default:
+	}
+	return string(hashes), nil
+}
+
+// Write the torrent to path
+func saveTorrent(torrent TorrentFile, path string) error {
+	data, err := bencode.Marshal(torrent)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Create a .torrent for the file or directory at root and write it to
+// output, or to <name>.torrent if output is empty
+func runCreate(root string, output string, opts createOptions) {
+	torrent, err := createTorrent(root, opts)
+	if err != nil {
+		fmt.Printf("Error creating torrent: %v\n", err)
+		return
+	}
+	if output == "" {
+		output = torrent.Info.Name + ".torrent"
+	}
+	err = saveTorrent(torrent, output)
+	if err != nil {
+		fmt.Printf("Error writing %s: %v\n", output, err)
+		return
+	}
+	fmt.Printf("Created %s: %d pieces of %d bytes, %d bytes in total\n", output, torrent.numPieces(), torrent.Info.PieceLength, torrent.totalLength())
+	fmt.Printf("Info Hash: %x\n", sha1.Sum(torrent.RawInfo))
+}
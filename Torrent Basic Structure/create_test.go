@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCreateTorrent(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "build")
+	files := map[string][]byte{
+		"a.bin":         randomData(70000),
+		"empty":         nil,
+		"sub/b.bin":     randomData(20000),
+		"sub/z/c.bin":   randomData(100),
+		"sub/z/d.other": randomData(40000),
+	}
+	var all []byte
+	for _, name := range []string{"a.bin", "empty", "sub/b.bin", "sub/z/c.bin", "sub/z/d.other"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err := os.WriteFile(path, files[name], 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, files[name]...)
+	}
+
+	opts := createOptions{
+		trackers:    [][]string{{"http://a.example/an", "http://b.example/an"}, {"udp://c.example:80"}},
+		webSeeds:    []string{"http://files.example/"},
+		comment:     "nightly",
+		private:     true,
+		pieceLength: 32768,
+	}
+	created, err := createTorrent(root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "build.torrent")
+	err = saveTorrent(created, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, infoHash, err := openTorrent(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha1.Sum(created.RawInfo); !bytes.Equal(infoHash, sum[:]) {
+		t.Fatalf("info hash %x, created %x", infoHash, sum)
+	}
+	if torrent.Announce != "http://a.example/an" || !reflect.DeepEqual(torrent.AnnounceList, opts.trackers) {
+		t.Fatalf("trackers %q %q", torrent.Announce, torrent.AnnounceList)
+	}
+	if torrent.Comment != "nightly" || torrent.CreatedBy != clientVersion || torrent.CreationDate == 0 || torrent.Info.Private != 1 {
+		t.Fatalf("decoded %+v", torrent)
+	}
+	if !reflect.DeepEqual(torrent.webSeeds(), opts.webSeeds) {
+		t.Fatalf("web seeds %q", torrent.webSeeds())
+	}
+	if torrent.Info.Name != "build" || len(torrent.Info.Files) != 5 || torrent.totalLength() != len(all) {
+		t.Fatalf("info %+v", torrent.Info)
+	}
+	if !reflect.DeepEqual(torrent.Info.Files[3].Path, []string{"sub", "z", "c.bin"}) {
+		t.Fatalf("files %+v", torrent.Info.Files)
+	}
+
+	// The pieces match the data read front to back, and the downloader
+	// finds all of them on disk
+	want := makeTestTorrent("build", all, 32768)
+	if torrent.Info.Pieces != want.Info.Pieces {
+		t.Fatal("piece hashes differ from hashing the concatenated files")
+	}
+	storage, err := openFileStorage(torrent, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if have := recheckPieces(torrent, storage); have.Count(torrent.numPieces()) != torrent.numPieces() {
+		t.Fatal("created torrent does not verify against its own data")
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "one.iso")
+	data := randomData(100000)
+	os.WriteFile(path, data, 0644)
+
+	torrent, err := createTorrent(path, createOptions{trackers: [][]string{{"http://a.example/an"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Info.Name != "one.iso" || torrent.Info.Length != len(data) || len(torrent.Info.Files) != 0 {
+		t.Fatalf("info %+v", torrent.Info)
+	}
+	if torrent.Info.PieceLength != minAutoPieceLength || torrent.Info.Pieces != makeTestTorrent("one.iso", data, minAutoPieceLength).Info.Pieces {
+		t.Fatalf("pieces of %d bytes", torrent.Info.PieceLength)
+	}
+	if torrent.AnnounceList != nil || torrent.URLList != nil || torrent.Info.Private != 0 {
+		t.Fatalf("optional keys set: %+v", torrent)
+	}
+
+	for _, length := range []int{1000, 40000, 8192} {
+		_, err = createTorrent(path, createOptions{pieceLength: length})
+		if err == nil {
+			t.Errorf("piece length %d was accepted", length)
+		}
+	}
+	empty := filepath.Join(t.TempDir(), "empty")
+	os.WriteFile(empty, nil, 0644)
+	if _, err = createTorrent(empty, createOptions{}); err == nil {
+		t.Error("empty file was accepted")
+	}
+}
+
+func TestAutoPieceLength(t *testing.T) {
+	for total, want := range map[int64]int{
+		1:         16 * 1024,
+		20 << 20:  16 * 1024,
+		100 << 20: 128 * 1024,
+		4 << 30:   4 << 20,
+		1 << 40:   16 << 20,
+	} {
+		if got := autoPieceLength(total); got != want {
+			t.Errorf("%d bytes: got %d, want %d", total, got, want)
+		}
+	}
+}
@@ -0,0 +1,844 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"bittorrent-client/bencode"
+)
+
+// Mainline DHT (BEP 5): a Kademlia network over UDP that maps info hashes to
+// the peers downloading them, for torrents and magnets without a working
+// tracker. Only IPv4 nodes are supported.
+const (
+	dhtK                = 8                // Nodes per bucket and per lookup result
+	dhtAlpha            = 3                // Queries in flight during a lookup
+	dhtQueryTimeout     = 2 * time.Second  // Time a node gets to answer
+	dhtMaxFailures      = 2                // Unanswered queries before a node can be replaced
+	dhtTokenInterval    = 5 * time.Minute  // Token secret rotation; the previous secret stays valid
+	dhtPeerTTL          = 30 * time.Minute // Announced peers are forgotten after this
+	dhtMaxValues        = 50               // Peers returned for one get_peers query
+	dhtMaxPeers         = 200              // Peers stored per info hash; the oldest gives way
+	dhtMaxInfoHashes    = 2000             // Info hashes peers are stored for
+	dhtAnnounceInterval = 15 * time.Minute // How often a running download announces itself
+)
+
+// Well-known routers used to join the network
+var defaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// KRPC error codes
+const (
+	krpcProtocolError = 203
+	krpcMethodUnknown = 204
+)
+
+type nodeID [20]byte
+
+func randomNodeID() nodeID {
+	var id nodeID
+	rand.Read(id[:])
+	return id
+}
+
+// Number of leading bits a and b share; 160 if they are equal
+func commonPrefix(a, b nodeID) int {
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
+
+// Report whether a is closer to target than b by the XOR metric
+func closer(target, a, b nodeID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// A DHT node known to the routing table
+type dhtNode struct {
+	id       nodeID
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int // Queries in a row the node did not answer
+}
+
+// routingTable keeps up to dhtK nodes for each length of prefix they share
+// with our ID, so it knows many nodes close to us and a few far away. Not
+// safe for concurrent use; the dht guards it with its mutex.
+type routingTable struct {
+	self    nodeID
+	buckets [160][]*dhtNode // By prefix length shared with self, least recently seen first
+}
+
+func newRoutingTable(self nodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+// Record that a node was seen. A full bucket only takes the node if one of
+// its nodes has stopped answering: nodes that stay up longest are the most
+// likely to stay up, so Kademlia keeps old nodes over new ones.
+func (t *routingTable) insert(id nodeID, addr *net.UDPAddr, now time.Time) {
+	if id == t.self {
+		return
+	}
+	b := commonPrefix(t.self, id)
+	bucket := t.buckets[b]
+	for i, n := range bucket {
+		if n.id == id {
+			n.addr, n.lastSeen, n.failures = addr, now, 0
+			t.buckets[b] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+			return
+		}
+	}
+	node := &dhtNode{id: id, addr: addr, lastSeen: now}
+	if len(bucket) < dhtK {
+		t.buckets[b] = append(bucket, node)
+		return
+	}
+	for i, n := range bucket {
+		if n.failures >= dhtMaxFailures {
+			t.buckets[b] = append(append(bucket[:i:i], bucket[i+1:]...), node)
+			return
+		}
+	}
+}
+
+// Count a query the node did not answer
+func (t *routingTable) failed(id nodeID) {
+	for _, n := range t.buckets[commonPrefix(t.self, id)] {
+		if n.id == id {
+			n.failures++
+		}
+	}
+}
+
+// Up to count nodes closest to target, closest first, skipping nodes that
+// stopped answering
+func (t *routingTable) closest(target nodeID, count int) []*dhtNode {
+	var nodes []*dhtNode
+	for _, n := range t.nodes() {
+		if n.failures < dhtMaxFailures {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return closer(target, nodes[i].id, nodes[j].id) })
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+func (t *routingTable) nodes() []*dhtNode {
+	var nodes []*dhtNode
+	for _, bucket := range t.buckets {
+		nodes = append(nodes, bucket...)
+	}
+	return nodes
+}
+
+// KRPC messages as received. Queries, replies and errors are sent with the
+// krpcQuery, krpcReply and krpcError types, which leave out the other parts.
+type krpcMessage struct {
+	T string        `bencode:"t"` // Transaction ID, echoed in the reply
+	Y string        `bencode:"y"` // q, r or e
+	Q string        `bencode:"q"`
+	A krpcArgs      `bencode:"a"`
+	R krpcValues    `bencode:"r"`
+	E []interface{} `bencode:"e"` // Error code and message
+}
+
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"` // Use the source port of the packet instead of port
+	Token       string `bencode:"token,omitempty"`
+}
+
+type krpcValues struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`  // Compact node info, 26 bytes per node
+	Values []string `bencode:"values,omitempty"` // Compact peers
+	Token  string   `bencode:"token,omitempty"`
+}
+
+type krpcQuery struct {
+	T string   `bencode:"t"`
+	Y string   `bencode:"y"`
+	Q string   `bencode:"q"`
+	A krpcArgs `bencode:"a"`
+}
+
+type krpcReply struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	R krpcValues `bencode:"r"`
+}
+
+type krpcError struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	E []interface{} `bencode:"e"`
+}
+
+// Decode a KRPC packet
+func decodeKRPC(packet []byte) (krpcMessage, error) {
+	var msg krpcMessage
+	_, err := unmarshalPrefix(packet, &msg)
+	return msg, err
+}
+
+// A node in a compact node info string
+type compactNode struct {
+	id   nodeID
+	addr *net.UDPAddr
+}
+
+// Encode nodes as compact node info: the 20-byte ID followed by the compact
+// IPv4 address and port
+func encodeNodes(nodes []*dhtNode) string {
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		ip4 := n.addr.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		buf.Write(n.id[:])
+		buf.Write(ip4)
+		buf.Write([]byte{byte(n.addr.Port >> 8), byte(n.addr.Port)})
+	}
+	return buf.String()
+}
+
+func decodeNodes(s string) []compactNode {
+	const size = 26
+	if len(s)%size != 0 {
+		return nil
+	}
+	var nodes []compactNode
+	for i := 0; i < len(s); i += size {
+		var n compactNode
+		copy(n.id[:], s[i:i+20])
+		port := int(s[i+24])<<8 | int(s[i+25])
+		if port == 0 {
+			continue
+		}
+		n.addr = &net.UDPAddr{IP: net.IP([]byte(s[i+20 : i+24])), Port: port}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// A query waiting for its reply
+type pendingQuery struct {
+	addr  string // Only replies from here are accepted
+	reply chan krpcMessage
+}
+
+// dht is a DHT node. It answers queries from other nodes on its own
+// goroutine and runs lookups for the download.
+type dht struct {
+	conn      *net.UDPConn
+	id        nodeID
+	statePath string // Where the routing table is saved; "" to not save it
+	quit      chan struct{}
+
+	mu         sync.Mutex
+	table      *routingTable
+	pending    map[string]pendingQuery         // By transaction ID
+	nextTID    uint16                          // Counter the transaction IDs are taken from
+	peers      map[string]map[string]time.Time // Info hash to announced peers and when
+	sweepTime  time.Time                       // When expired peers were last dropped from every info hash
+	secret     [20]byte                        // Token secret
+	oldSecret  [20]byte                        // Previous token secret, still accepted
+	rotateTime time.Time                       // When secret was chosen
+}
+
+// Start a DHT node on address, such as ":6881". The node ID and the routing
+// table are loaded from statePath if an earlier run saved them there.
+func newDHT(address string, statePath string) (*dht, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	d := &dht{
+		conn:       conn,
+		statePath:  statePath,
+		quit:       make(chan struct{}),
+		pending:    make(map[string]pendingQuery),
+		peers:      make(map[string]map[string]time.Time),
+		rotateTime: time.Now(),
+	}
+	rand.Read(d.secret[:])
+	d.oldSecret = d.secret
+
+	d.id = randomNodeID()
+	var nodes []compactNode
+	if statePath != "" {
+		id, saved, err := loadDHTState(statePath)
+		if err == nil {
+			d.id, nodes = id, saved
+		} else if !os.IsNotExist(err) {
+			fmt.Printf("Ignoring DHT state %s: %v\n", statePath, err)
+		}
+	}
+	d.table = newRoutingTable(d.id)
+	for _, n := range nodes {
+		d.table.insert(n.id, n.addr, time.Time{})
+	}
+
+	go d.serve()
+	return d, nil
+}
+
+// Address the node receives queries on
+func (d *dht) addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Stop the node and save its routing table
+func (d *dht) close() error {
+	close(d.quit)
+	d.conn.Close()
+	if d.statePath == "" {
+		return nil
+	}
+	d.mu.Lock()
+	nodes := d.table.closest(d.id, len(d.table.nodes()))
+	d.mu.Unlock()
+	return saveDHTState(d.statePath, d.id, nodes)
+}
+
+// Number of nodes in the routing table
+func (d *dht) size() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.table.nodes())
+}
+
+// Saved node ID and routing table
+type dhtState struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"` // Compact node info
+}
+
+func loadDHTState(path string) (nodeID, []compactNode, error) {
+	var id nodeID
+	file, err := os.Open(path)
+	if err != nil {
+		return id, nil, err
+	}
+	defer file.Close()
+
+	var state dhtState
+	err = bencode.NewDecoder(file).Decode(&state)
+	if err != nil {
+		return id, nil, err
+	}
+	if len(state.ID) != len(id) {
+		return id, nil, fmt.Errorf("invalid node ID")
+	}
+	copy(id[:], state.ID)
+	return id, decodeNodes(state.Nodes), nil
+}
+
+// Save the state the same way as resume files, through a temporary file
+func saveDHTState(path string, id nodeID, nodes []*dhtNode) error {
+	data, err := bencode.Marshal(dhtState{ID: string(id[:]), Nodes: encodeNodes(nodes)})
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Read packets until the node is closed
+func (d *dht) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.quit:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		msg, err := decodeKRPC(buf[:n])
+		if err != nil {
+			continue // Not worth answering
+		}
+		switch msg.Y {
+		case "q":
+			d.handleQuery(msg, addr)
+		case "r", "e":
+			d.mu.Lock()
+			query, ok := d.pending[msg.T]
+			if ok && query.addr == addr.String() {
+				delete(d.pending, msg.T)
+				query.reply <- msg
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+func (d *dht) send(addr *net.UDPAddr, v interface{}) error {
+	data, err := bencode.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+// Send a query and wait for the reply. Nodes that answer are added to the
+// routing table; ones that don't are counted against.
+func (d *dht) query(addr *net.UDPAddr, method string, args krpcArgs) (krpcValues, error) {
+	args.ID = string(d.id[:])
+	reply := make(chan krpcMessage, 1)
+	d.mu.Lock()
+	d.nextTID++
+	tid := string([]byte{byte(d.nextTID >> 8), byte(d.nextTID)})
+	d.pending[tid] = pendingQuery{addr: addr.String(), reply: reply}
+	d.mu.Unlock()
+
+	err := d.send(addr, krpcQuery{T: tid, Y: "q", Q: method, A: args})
+	if err == nil {
+		timer := time.NewTimer(dhtQueryTimeout)
+		defer timer.Stop()
+		select {
+		case msg := <-reply:
+			return d.handleReply(msg, addr)
+		case <-timer.C:
+			err = fmt.Errorf("%s to %s timed out", method, addr)
+		case <-d.quit:
+			err = errors.New("DHT closed")
+		}
+	}
+
+	d.mu.Lock()
+	delete(d.pending, tid)
+	d.mu.Unlock()
+	return krpcValues{}, err
+}
+
+func (d *dht) handleReply(msg krpcMessage, addr *net.UDPAddr) (krpcValues, error) {
+	if msg.Y == "e" {
+		return krpcValues{}, fmt.Errorf("error from %s: %v", addr, msg.E)
+	}
+	if len(msg.R.ID) != len(nodeID{}) {
+		return krpcValues{}, fmt.Errorf("reply from %s has no node ID", addr)
+	}
+	var id nodeID
+	copy(id[:], msg.R.ID)
+	d.mu.Lock()
+	d.table.insert(id, addr, time.Now())
+	d.mu.Unlock()
+	return msg.R, nil
+}
+
+// Answer a query from another node
+func (d *dht) handleQuery(msg krpcMessage, addr *net.UDPAddr) {
+	fail := func(code int, message string) {
+		d.send(addr, krpcError{T: msg.T, Y: "e", E: []interface{}{code, message}})
+	}
+	var id nodeID
+	if len(msg.A.ID) != len(id) {
+		fail(krpcProtocolError, "invalid id")
+		return
+	}
+	copy(id[:], msg.A.ID)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.table.insert(id, addr, time.Now())
+
+	r := krpcValues{ID: string(d.id[:])}
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		if len(msg.A.Target) != len(id) {
+			fail(krpcProtocolError, "invalid target")
+			return
+		}
+		var target nodeID
+		copy(target[:], msg.A.Target)
+		r.Nodes = encodeNodes(d.table.closest(target, dhtK))
+	case "get_peers":
+		if len(msg.A.InfoHash) != len(id) {
+			fail(krpcProtocolError, "invalid info_hash")
+			return
+		}
+		r.Token = d.token(addr.IP)
+		r.Values = d.storedPeers(msg.A.InfoHash)
+		if len(r.Values) == 0 {
+			var target nodeID
+			copy(target[:], msg.A.InfoHash)
+			r.Nodes = encodeNodes(d.table.closest(target, dhtK))
+		}
+	case "announce_peer":
+		if len(msg.A.InfoHash) != len(id) {
+			fail(krpcProtocolError, "invalid info_hash")
+			return
+		}
+		if !d.validToken(msg.A.Token, addr.IP) {
+			fail(krpcProtocolError, "bad token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			fail(krpcProtocolError, "invalid port")
+			return
+		}
+		d.storePeer(msg.A.InfoHash, net.JoinHostPort(addr.IP.String(), strconv.Itoa(port)))
+	default:
+		fail(krpcMethodUnknown, "Method Unknown")
+		return
+	}
+	d.send(addr, krpcReply{T: msg.T, Y: "r", R: r})
+}
+
+// Compact addresses of the peers announced for an info hash, dropping the
+// ones that have not announced again in time. Called with mu held.
+func (d *dht) storedPeers(infoHash string) []string {
+	var values []string
+	expirePeers(d.peers[infoHash], time.Now())
+	for address := range d.peers[infoHash] {
+		compact, _ := compactPeer(address)
+		if compact != nil && len(values) < dhtMaxValues {
+			values = append(values, string(compact))
+		}
+	}
+	return values
+}
+
+// Record a peer announced for an info hash. Expired peers are dropped from
+// every info hash once per dhtPeerTTL; past that, a full info hash forgets its
+// oldest peer and announces for new info hashes are ignored while the store
+// is full, so announcing nodes cannot grow it without bound. Called with mu
+// held.
+func (d *dht) storePeer(infoHash string, address string) {
+	now := time.Now()
+	if now.Sub(d.sweepTime) >= dhtPeerTTL {
+		for hash, peers := range d.peers {
+			expirePeers(peers, now)
+			if len(peers) == 0 {
+				delete(d.peers, hash)
+			}
+		}
+		d.sweepTime = now
+	}
+
+	peers := d.peers[infoHash]
+	if peers == nil {
+		if len(d.peers) >= dhtMaxInfoHashes {
+			return
+		}
+		peers = make(map[string]time.Time)
+		d.peers[infoHash] = peers
+	}
+	if _, ok := peers[address]; !ok && len(peers) >= dhtMaxPeers {
+		expirePeers(peers, now)
+		if len(peers) >= dhtMaxPeers {
+			oldest := ""
+			for a, announced := range peers {
+				if oldest == "" || announced.Before(peers[oldest]) {
+					oldest = a
+				}
+			}
+			delete(peers, oldest)
+		}
+	}
+	peers[address] = now
+}
+
+// Drop the peers that have not announced again within dhtPeerTTL
+func expirePeers(peers map[string]time.Time, now time.Time) {
+	for address, announced := range peers {
+		if now.Sub(announced) > dhtPeerTTL {
+			delete(peers, address)
+		}
+	}
+}
+
+// Tokens are a hash of the querying IP and a secret that changes every five
+// minutes, so only a node that did get_peers recently can announce. Called
+// with mu held.
+func (d *dht) token(ip net.IP) string {
+	if time.Since(d.rotateTime) >= dhtTokenInterval {
+		d.oldSecret = d.secret
+		rand.Read(d.secret[:])
+		d.rotateTime = time.Now()
+	}
+	return tokenFor(d.secret, ip)
+}
+
+func (d *dht) validToken(token string, ip net.IP) bool {
+	d.token(ip) // Rotate if due
+	return token == tokenFor(d.secret, ip) || token == tokenFor(d.oldSecret, ip)
+}
+
+func tokenFor(secret [20]byte, ip net.IP) string {
+	hash := sha1.New()
+	hash.Write(secret[:])
+	hash.Write(ip.To16())
+	return string(hash.Sum(nil))
+}
+
+// Join the network through the given nodes, then look up our own ID to fill
+// the routing table with our neighbours. Nodes saved by an earlier run are
+// used as well, so this only fails if none of them answers.
+func (d *dht) bootstrap(addresses []string) error {
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		addr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			fmt.Printf("Skipping DHT bootstrap node %s: %v\n", address, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.query(addr, "find_node", krpcArgs{Target: string(d.id[:])})
+		}()
+	}
+	wg.Wait()
+
+	nodes, _ := d.lookup(d.id, false)
+	if len(nodes) == 0 {
+		return fmt.Errorf("no DHT nodes answered")
+	}
+	return nil
+}
+
+// A node found during a lookup
+type lookupNode struct {
+	id    nodeID
+	addr  *net.UDPAddr
+	token string // From its get_peers reply, needed to announce to it
+}
+
+// Iterative lookup: query the closest nodes we know for target, dhtAlpha at
+// a time, moving on to the closer nodes they return until the dhtK closest
+// have all answered. With getPeers set, get_peers is sent instead of
+// find_node and the peers the nodes list are returned too.
+func (d *dht) lookup(target nodeID, getPeers bool) ([]*lookupNode, []string) {
+	method, args := "find_node", krpcArgs{Target: string(target[:])}
+	if getPeers {
+		method, args = "get_peers", krpcArgs{InfoHash: string(target[:])}
+	}
+
+	var shortlist []*lookupNode
+	seen := make(map[string]bool)
+	add := func(id nodeID, addr *net.UDPAddr) {
+		if id == d.id || seen[addr.String()] {
+			return
+		}
+		seen[addr.String()] = true
+		shortlist = append(shortlist, &lookupNode{id: id, addr: addr})
+	}
+	d.mu.Lock()
+	for _, n := range d.table.closest(target, dhtK) {
+		add(n.id, n.addr)
+	}
+	d.mu.Unlock()
+
+	type result struct {
+		node *lookupNode
+		r    krpcValues
+		err  error
+	}
+	results := make(chan result)
+	queried := make(map[*lookupNode]bool)
+	failed := make(map[*lookupNode]bool)
+	inFlight := 0
+	var peers []string
+	peerSeen := make(map[string]bool)
+
+	for {
+		sort.Slice(shortlist, func(i, j int) bool { return closer(target, shortlist[i].id, shortlist[j].id) })
+		candidates := 0
+		for _, n := range shortlist {
+			if candidates >= dhtK || inFlight >= dhtAlpha {
+				break
+			}
+			if failed[n] {
+				continue
+			}
+			candidates++
+			if queried[n] {
+				continue
+			}
+			queried[n] = true
+			inFlight++
+			go func(n *lookupNode) {
+				r, err := d.query(n.addr, method, args)
+				results <- result{node: n, r: r, err: err}
+			}(n)
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		res := <-results
+		inFlight--
+		if res.err != nil {
+			failed[res.node] = true
+			d.mu.Lock()
+			d.table.failed(res.node.id)
+			d.mu.Unlock()
+			continue
+		}
+		res.node.token = res.r.Token
+		for _, n := range decodeNodes(res.r.Nodes) {
+			add(n.id, n.addr)
+		}
+		for _, value := range res.r.Values {
+			if len(value) != net.IPv4len+2 && len(value) != net.IPv6len+2 {
+				continue
+			}
+			found, _ := parseCompactPeers([]byte(value), len(value)-2)
+			if !peerSeen[found[0]] {
+				peerSeen[found[0]] = true
+				peers = append(peers, found[0])
+			}
+		}
+	}
+
+	var closest []*lookupNode
+	for _, n := range shortlist {
+		if queried[n] && !failed[n] && len(closest) < dhtK {
+			closest = append(closest, n)
+		}
+	}
+	return closest, peers
+}
+
+// Find peers for an info hash
+func (d *dht) getPeers(infoHash []byte) ([]string, error) {
+	var target nodeID
+	copy(target[:], infoHash)
+	nodes, peers := d.lookup(target, true)
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no DHT nodes answered")
+	}
+	return peers, nil
+}
+
+// Find peers for an info hash and announce to the closest nodes that we
+// accept connections for it on port. A port of 0 only finds peers.
+func (d *dht) announce(infoHash []byte, port int) ([]string, error) {
+	var target nodeID
+	copy(target[:], infoHash)
+	nodes, peers := d.lookup(target, true)
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no DHT nodes answered")
+	}
+	if port == 0 {
+		return peers, nil
+	}
+
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		if n.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(n *lookupNode) {
+			defer wg.Done()
+			d.query(n.addr, "announce_peer", krpcArgs{InfoHash: string(infoHash), Port: port, Token: n.token})
+		}(n)
+	}
+	wg.Wait()
+	return peers, nil
+}
+
+// Start the DHT node configured for the client and join the network. Returns
+// nil if the DHT is disabled or can't be started.
+func startDHT(config downloadConfig) *dht {
+	if config.dhtPort == 0 {
+		return nil
+	}
+	node, err := newDHT(fmt.Sprintf(":%d", config.dhtPort), config.dhtStatePath)
+	if err != nil {
+		fmt.Printf("DHT disabled: %v\n", err)
+		return nil
+	}
+	// A node that couldn't join still learns about the network from the
+	// nodes that contact it
+	err = node.bootstrap(config.bootstrapNodes)
+	if err != nil {
+		fmt.Printf("Error joining the DHT: %v\n", err)
+	} else {
+		fmt.Printf("Joined the DHT with %d nodes\n", node.size())
+	}
+	return node
+}
+
+// Announce the download to the DHT every dhtAnnounceInterval and pass the
+// peers found to the scheduler
+func (d *downloader) announceDHT(infoHash []byte) {
+	defer d.background.Done()
+	ticker := time.NewTicker(dhtAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.quit:
+			return
+		}
+		port := 0
+		if d.listening {
+			port = d.config.listenPort
+		}
+		peers, err := d.config.dht.announce(infoHash, port)
+		if err != nil {
+			fmt.Printf("Error announcing to the DHT: %v\n", err)
+			continue
+		}
+		select {
+		case d.found <- peers:
+		case <-d.quit:
+			return
+		}
+	}
+}
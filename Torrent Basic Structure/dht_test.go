@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A node ID that differs from the zero ID first at bit prefix, with the rest
+// taken from n
+func testNodeID(prefix int, n byte) nodeID {
+	var id nodeID
+	id[prefix/8] = 0x80 >> (prefix % 8)
+	id[19] |= n
+	return id
+}
+
+func TestRoutingTable(t *testing.T) {
+	table := newRoutingTable(nodeID{})
+	now := time.Now()
+	addr := func(n int) *net.UDPAddr { return &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(n)), Port: 6881} }
+
+	// Nodes sharing no prefix with us all go in one bucket, which holds dhtK
+	for i := 0; i < dhtK+1; i++ {
+		table.insert(testNodeID(0, byte(i)), addr(i), now)
+	}
+	table.insert(testNodeID(5, 1), addr(100), now)
+	table.insert(nodeID{}, addr(101), now) // Ourselves
+	if len(table.buckets[0]) != dhtK || len(table.buckets[5]) != 1 || len(table.nodes()) != dhtK+1 {
+		t.Fatalf("table holds %d nodes, %d in the first bucket", len(table.nodes()), len(table.buckets[0]))
+	}
+
+	// A node that stops answering makes room for a new one
+	table.failed(testNodeID(0, 2))
+	table.insert(testNodeID(0, 20), addr(20), now)
+	if len(table.buckets[0]) != dhtK || table.buckets[0][dhtK-1].id == testNodeID(0, 20) {
+		t.Fatal("node replaced one that failed only once")
+	}
+	table.failed(testNodeID(0, 2))
+	table.insert(testNodeID(0, 20), addr(20), now)
+	if table.buckets[0][dhtK-1].id != testNodeID(0, 20) {
+		t.Fatal("node did not replace one that stopped answering")
+	}
+	for _, n := range table.buckets[0] {
+		if n.id == testNodeID(0, 2) {
+			t.Fatal("failed node is still in the bucket")
+		}
+	}
+
+	// Nodes seen again move to the end of their bucket
+	table.insert(testNodeID(0, 0), addr(50), now)
+	last := table.buckets[0][dhtK-1]
+	if last.id != testNodeID(0, 0) || last.addr.String() != "10.0.0.50:6881" {
+		t.Fatal("node seen again was not moved to the end")
+	}
+
+	closest := table.closest(testNodeID(5, 0), 3)
+	if len(closest) != 3 || closest[0].id != testNodeID(5, 1) || closest[1].id != testNodeID(0, 0) || closest[2].id != testNodeID(0, 1) {
+		t.Fatal("closest nodes are in the wrong order")
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []*dhtNode{
+		{id: testNodeID(1, 1), addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}},
+		{id: testNodeID(2, 2), addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}}, // Left out
+		{id: testNodeID(3, 3), addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 51413}},
+	}
+	decoded := decodeNodes(encodeNodes(nodes))
+	if len(decoded) != 2 || decoded[0].id != nodes[0].id || decoded[1].addr.String() != "10.0.0.3:51413" {
+		t.Fatalf("decoded %v", decoded)
+	}
+	if decodeNodes("short") != nil {
+		t.Fatal("truncated node info was decoded")
+	}
+}
+
+// Start a node on loopback that is closed at the end of the test
+func startTestDHT(t *testing.T, statePath string) *dht {
+	node, err := newDHT("127.0.0.1:0", statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.close() })
+	return node
+}
+
+// A small network on loopback: every node joins through the first one, then
+// a peer announced through one node can be found through any other
+func TestDHTCluster(t *testing.T) {
+	nodes := []*dht{startTestDHT(t, "")}
+	router := nodes[0].addr().String()
+	for i := 1; i < 16; i++ {
+		node := startTestDHT(t, "")
+		err := node.bootstrap([]string{router})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	for i, node := range nodes[1:] {
+		if node.size() < 2 {
+			t.Fatalf("node %d knows only %d nodes after joining", i+1, node.size())
+		}
+	}
+
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	_, err := nodes[3].announce(infoHash, 5555)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = nodes[7].announce(infoHash, 6666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{1, 10, 15} {
+		peers, err := nodes[i].getPeers(infoHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(mergePeers([]string{"127.0.0.1:5555", "127.0.0.1:6666"}, peers)) != "[127.0.0.1:5555 127.0.0.1:6666]" {
+			t.Errorf("node %d found peers %q", i, peers)
+		}
+	}
+
+	other, err := nodes[12].getPeers(bytes.Repeat([]byte{0x01}, 20))
+	if err != nil || len(other) != 0 {
+		t.Errorf("peers %q for an info hash nobody announced", other)
+	}
+}
+
+func TestDHTQueries(t *testing.T) {
+	a, b := startTestDHT(t, ""), startTestDHT(t, "")
+	infoHash := string(bytes.Repeat([]byte{0x42}, 20))
+
+	_, err := a.query(b.addr(), "announce_peer", krpcArgs{InfoHash: infoHash, Port: 5555, Token: "forged"})
+	if err == nil {
+		t.Fatal("announce with a forged token was accepted")
+	}
+	r, err := a.query(b.addr(), "get_peers", krpcArgs{InfoHash: infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Values) != 0 || r.Token == "" {
+		t.Fatalf("get_peers reply %+v", r)
+	}
+	_, err = a.query(b.addr(), "announce_peer", krpcArgs{InfoHash: infoHash, ImpliedPort: 1, Token: r.Token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = a.query(b.addr(), "get_peers", krpcArgs{InfoHash: infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, _ := parseCompactPeers([]byte(r.Values[0]), net.IPv4len)
+	if len(r.Values) != 1 || peers[0] != a.addr().String() {
+		t.Fatalf("implied port announce stored %q", peers)
+	}
+
+	// Garbage and unknown methods get no answer or an error, not a crash
+	conn, err := net.DialUDP("udp4", nil, b.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, junk := range []string{"", "x", "d1:t2:aa1:y1:q1:q4:ping1:ai42ee", "d1:ti1e1:y1:qe", "li1ee"} {
+		conn.Write([]byte(junk))
+	}
+	_, err = a.query(b.addr(), "vote", krpcArgs{})
+	if err == nil {
+		t.Fatal("unknown method was answered")
+	}
+	_, err = a.query(b.addr(), "ping", krpcArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDHTPeerStoreLimits(t *testing.T) {
+	d := &dht{peers: make(map[string]map[string]time.Time)}
+	address := func(i int) string { return fmt.Sprintf("10.0.%d.%d:6881", i/256, i%256) }
+
+	// A full info hash forgets its oldest peer for a new one
+	for i := 0; i < dhtMaxPeers; i++ {
+		d.storePeer("a", address(i))
+	}
+	d.peers["a"][address(7)] = time.Now().Add(-time.Minute)
+	d.storePeer("a", address(dhtMaxPeers))
+	if _, ok := d.peers["a"][address(7)]; ok || len(d.peers["a"]) != dhtMaxPeers {
+		t.Fatalf("%d peers stored, oldest kept %v", len(d.peers["a"]), ok)
+	}
+	// Announcing again refreshes a peer without dropping any
+	d.storePeer("a", address(0))
+	if len(d.peers["a"]) != dhtMaxPeers {
+		t.Fatalf("%d peers after a repeated announce", len(d.peers["a"]))
+	}
+
+	// New info hashes are ignored once there are enough of them
+	for i := 1; i < dhtMaxInfoHashes; i++ {
+		d.storePeer(fmt.Sprint(i), address(0))
+	}
+	d.storePeer("new", address(0))
+	if len(d.peers) != dhtMaxInfoHashes || d.peers["new"] != nil {
+		t.Fatalf("%d info hashes stored", len(d.peers))
+	}
+
+	// The periodic sweep drops expired peers, and then their info hashes,
+	// which makes room again
+	for hash := range d.peers {
+		if hash != "a" {
+			d.peers[hash][address(0)] = time.Now().Add(-dhtPeerTTL - time.Minute)
+		}
+	}
+	d.sweepTime = time.Now().Add(-dhtPeerTTL)
+	d.storePeer("new", address(0))
+	if len(d.peers) != 2 || len(d.peers["new"]) != 1 || len(d.peers["a"]) != dhtMaxPeers {
+		t.Fatalf("%d info hashes after the sweep", len(d.peers))
+	}
+
+	// Reads drop expired peers too
+	d.peers["new"][address(1)] = time.Now().Add(-dhtPeerTTL - time.Minute)
+	if values := d.storedPeers("new"); len(values) != 1 || len(d.peers["new"]) != 1 {
+		t.Fatalf("expired peer returned: %q", values)
+	}
+}
+
+func TestDHTStatePersists(t *testing.T) {
+	router := startTestDHT(t, "")
+	statePath := filepath.Join(t.TempDir(), "dht.dat")
+
+	node, err := newDHT("127.0.0.1:0", statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node.bootstrap([]string{router.addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next run comes back with the same ID and can join without any
+	// bootstrap nodes
+	restarted := startTestDHT(t, statePath)
+	if restarted.id != node.id || restarted.size() != 1 {
+		t.Fatalf("restarted with %d nodes", restarted.size())
+	}
+	err = restarted.bootstrap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
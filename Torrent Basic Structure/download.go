@@ -0,0 +1,1151 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of pieces that can be queued on a single peer
+const peerQueueSize = 5
+
+// How long the download waits for new peers once none are connected; long
+// enough for the trackers to be retried after a failed announce
+const peerWaitTimeout = 2 * trackerRetryInterval
+
+// Download settings that can be changed from the command line
+type downloadConfig struct {
+	picker        PiecePicker
+	pipelineDepth int    // Block requests kept outstanding per peer
+	outputDir     string // Where the torrent's files are written
+
+	// Incoming peers are accepted on listenPort (0 disables the listener).
+	// After the download we keep seeding until the share ratio reaches
+	// seedRatio or seedTime has passed; zero turns either limit off, and
+	// both zero means we stop as soon as the download completes.
+	listenPort int
+	seedRatio  float64
+	seedTime   time.Duration
+
+	// The DHT node listens on UDP dhtPort (0 disables it), joins through
+	// bootstrapNodes and keeps its routing table in dhtStatePath between
+	// runs. dht is the running node, set once it has started.
+	dhtPort        int
+	bootstrapNodes []string
+	dhtStatePath   string
+	dht            *dht
+
+	// The torrent's trackers, announced to for as long as the download
+	// runs; nil if it has none
+	trackers *trackerSession
+
+	// Closed to end the download or seeding early, as on Ctrl-C; the
+	// trackers still hear stopped
+	interrupt <-chan struct{}
+}
+
+func defaultDownloadConfig() downloadConfig {
+	return downloadConfig{
+		picker:         newRarestFirstPicker(),
+		pipelineDepth:  10,
+		outputDir:      ".",
+		listenPort:     6881,
+		seedRatio:      1.0,
+		seedTime:       30 * time.Minute,
+		dhtPort:        6881,
+		bootstrapNodes: defaultBootstrapNodes,
+		dhtStatePath:   "dht.dat",
+	}
+}
+
+// Define a struct to hold piece download results
+type pieceResult struct {
+	peer  *peerSlot
+	index int
+	data  []byte
+	err   error
+}
+
+type peerEventKind int
+
+const (
+	peerReady    peerEventKind = iota // Peer unchoked us and can take work
+	peerBitfield                      // Peer sent its bitfield
+	peerHave                          // Peer announced a piece it just got
+	peerInterest                      // Peer became interested or not interested in us
+	peerGone                          // Connection closed
+)
+
+// Something the scheduler needs to know about a peer
+type peerEvent struct {
+	peer       *peerSlot
+	kind       peerEventKind
+	index      int
+	bitfield   Bitfield
+	interested bool
+}
+
+// The scheduler's view of one peer. After the peer goroutine is started,
+// only the scheduler goroutine touches these fields, apart from unchoked and
+// the rate counter totals.
+type peerSlot struct {
+	address  string
+	incoming bool          // The peer connected to us
+	queue    chan int      // Pieces assigned to the peer
+	cancel   chan int      // Pieces the peer should drop, finished elsewhere
+	wake     chan struct{} // New pieces to announce or a choke change to send
+	arrived  chan struct{} // Blocks it requested came from other peers, or its piece failed
+	bitfield Bitfield      // Pieces the peer has told us about
+	ready    bool          // Unchoked us at least once
+	gone     bool          // Connection is closed
+	assigned map[int]bool  // Pieces queued on or being downloaded by the peer
+	wanted   []int         // Pending pieces the peer has, in increasing order
+
+	interested   bool        // Peer wants pieces from us
+	unchoked     int32       // Choker decision, read atomically by the peer goroutine
+	downloadRate rateCounter // Piece data received from the peer
+	uploadRate   rateCounter // Piece data sent to the peer
+}
+
+// downloader hands pieces to peers that have them and collects the verified
+// pieces they send back. Apart from the have bitfield and the byte counters,
+// its state is owned by the scheduler goroutine; peer goroutines talk to it
+// only through the events and results channels.
+type downloader struct {
+	torrent     TorrentFile
+	infoHashHex string
+	peerID      string
+	numPieces   int
+	config      downloadConfig
+
+	storage    PieceStorage
+	haveMu     sync.RWMutex // Guards have, which peer goroutines read to upload
+	have       Bitfield
+	haveLog    []int // Pieces in the order they were verified, guarded by haveMu
+	resumePath string
+	completed  int
+	onPiece    func(completed int, total int)
+
+	uploaded   int64 // Bytes of piece data sent, updated atomically
+	downloaded int64 // Bytes of piece data received, updated atomically
+
+	results    chan pieceResult
+	events     chan peerEvent
+	newConns   chan incomingConn // Incoming connections that passed the handshake
+	discovered chan pexUpdate    // Peers learned from other peers
+	found      chan []string     // Peers found in the DHT
+	listening  bool              // Incoming connections are being accepted
+	quit       chan struct{}     // Closed when the download and seeding are over
+	done       chan struct{}     // Closed when the last piece is verified
+	background sync.WaitGroup    // Announce goroutines, waited for after quit
+
+	known      map[string]bool // Addresses we have dialed or will dial
+	candidates []string        // Known addresses not dialed yet, oldest first
+
+	peers        []*peerSlot
+	availability []int                      // Number of live peers that have each piece
+	pending      map[int]bool               // Pieces waiting to be assigned
+	inProgress   map[int]map[*peerSlot]bool // Peers each assigned piece is with
+	failedOn     map[int]map[*peerSlot]bool // Peers a piece already failed on
+	endgame      bool                       // Every missing block has been requested
+	blocks       *pieceRegistry             // Pieces being assembled, shared with the peer goroutines
+
+	extensions []Extension // Offered to peers that support BEP 10
+	pex        *utPex
+
+	choker    *choker
+	chokeTick <-chan time.Time
+	lastChoke time.Time // When rates were last sampled
+}
+
+// Download torrent using multiple peers in parallel. Verified pieces are written
+// to disk as they arrive and recorded in a resume file, so an interrupted
+// download only fetches the missing pieces next time. onPiece, if set, is
+// called with the number of pieces on disk whenever that changes.
+func downloadTorrent(torrent TorrentFile, infoHashHex string, peerID string, peers []string, config downloadConfig, onPiece func(completed int, total int)) error {
+	numPieces := torrent.numPieces()
+
+	// Find pieces left on disk by an earlier run
+	have, err := verifiedPieces(torrent, infoHashHex, config.outputDir)
+	if err != nil {
+		return fmt.Errorf("error checking existing data: %v", err)
+	}
+
+	storage, err := newFileStorage(torrent, config.outputDir)
+	if err != nil {
+		return fmt.Errorf("error creating output files: %v", err)
+	}
+	defer storage.Close()
+
+	d := &downloader{
+		torrent:      torrent,
+		infoHashHex:  infoHashHex,
+		peerID:       peerID,
+		numPieces:    numPieces,
+		config:       config,
+		storage:      storage,
+		have:         have,
+		resumePath:   resumeFilePath(torrent, config.outputDir),
+		onPiece:      onPiece,
+		results:      make(chan pieceResult),
+		events:       make(chan peerEvent),
+		newConns:     make(chan incomingConn),
+		discovered:   make(chan pexUpdate),
+		found:        make(chan []string),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+		known:        make(map[string]bool),
+		availability: make([]int, numPieces),
+		pending:      make(map[int]bool),
+		inProgress:   make(map[int]map[*peerSlot]bool),
+		failedOn:     make(map[int]map[*peerSlot]bool),
+		blocks:       newPieceRegistry(),
+		choker:       newChoker(uploadSlots),
+	}
+
+	// Serve the info dictionary to peers that start from a magnet link
+	metadata := torrentMetadata(torrent, infoHashHex)
+	if metadata != nil {
+		infoHash, _ := hex.DecodeString(infoHashHex)
+		d.extensions = append(d.extensions, newUTMetadata(infoHash, metadata))
+	}
+	// Private torrents get their peers from the trackers only (BEP 27)
+	if torrent.isPrivate() {
+		d.config.dht = nil
+	} else {
+		d.pex = newUTPex(func(added []pexPeer, dropped []string) {
+			select {
+			case d.discovered <- pexUpdate{added: added, dropped: dropped}:
+			case <-d.quit:
+			}
+		})
+		d.extensions = append(d.extensions, d.pex)
+	}
+
+	for i := 0; i < numPieces; i++ {
+		if !have.HasPiece(i) {
+			d.pending[i] = true
+		}
+	}
+	d.completed = numPieces - len(d.pending)
+	if d.completed > 0 {
+		fmt.Printf("Resuming with %d/%d pieces already verified\n", d.completed, numPieces)
+		if onPiece != nil {
+			onPiece(d.completed, numPieces)
+		}
+	}
+
+	seeding := config.seedRatio > 0 || config.seedTime > 0
+	if len(d.pending) == 0 && !seeding {
+		fmt.Printf("File %s downloaded successfully\n", torrent.Info.Name)
+		return nil
+	}
+	defer d.stop()
+
+	chokeTicker := time.NewTicker(chokeInterval)
+	defer chokeTicker.Stop()
+	d.chokeTick = chokeTicker.C
+	d.lastChoke = time.Now()
+
+	// Accept incoming peers; they can help with the download as well as
+	// take pieces from us
+	if config.listenPort != 0 {
+		listener, err := d.listen(config.listenPort)
+		if err != nil {
+			fmt.Printf("Not accepting incoming peers: %v\n", err)
+		} else {
+			defer listener.Close()
+		}
+	}
+
+	// Peers are dialed by the scheduler, up to maxPeers at a time
+	d.addPeers(peers)
+	if config.trackers != nil {
+		d.background.Add(1)
+		go d.announceTrackers(len(d.pending) == 0)
+	}
+	if d.config.dht != nil {
+		infoHash, _ := hex.DecodeString(infoHashHex)
+		d.background.Add(1)
+		go d.announceDHT(infoHash)
+	}
+	err = d.run()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("File %s downloaded successfully\n", torrent.Info.Name)
+
+	if seeding {
+		d.seed()
+	}
+	return nil
+}
+
+func (d *downloader) newPeerSlot(address string) *peerSlot {
+	slot := &peerSlot{
+		address: address,
+		queue:   make(chan int, peerQueueSize),
+		// A peer holds at most its queue plus one piece per pipelined
+		// request, so cancelling all of them never blocks the scheduler
+		cancel:   make(chan int, peerQueueSize+d.config.pipelineDepth+1),
+		wake:     make(chan struct{}, 1),
+		arrived:  make(chan struct{}, 1),
+		bitfield: newBitfield(d.numPieces),
+		assigned: make(map[int]bool),
+	}
+	if d.completed == d.numPieces {
+		close(slot.queue) // Only here to download from us
+	}
+	d.peers = append(d.peers, slot)
+	return slot
+}
+
+// Scheduler loop: assign work, then wait for the next event or result. With
+// no peers connected, the trackers, the DHT or an incoming connection may
+// still bring some, so we wait up to peerWaitTimeout for them.
+func (d *downloader) run() error {
+	var waitTimer *time.Timer
+	var noPeers <-chan time.Time
+	defer func() {
+		if waitTimer != nil {
+			waitTimer.Stop()
+		}
+	}()
+
+	for d.completed < d.numPieces {
+		d.connectCandidates()
+		d.assignPieces()
+
+		switch {
+		case d.livePeers() > 0 && waitTimer != nil:
+			waitTimer.Stop()
+			waitTimer, noPeers = nil, nil
+		case d.livePeers() == 0 && !d.canFindPeers():
+			return d.noPeersError()
+		case d.livePeers() == 0 && waitTimer == nil:
+			fmt.Println("No peers connected, waiting for new ones")
+			waitTimer = time.NewTimer(peerWaitTimeout)
+			noPeers = waitTimer.C
+		}
+
+		select {
+		case ev := <-d.events:
+			d.handleEvent(ev)
+		case incoming := <-d.newConns:
+			d.addIncomingPeer(incoming)
+		case update := <-d.discovered:
+			d.handleDiscovered(update)
+		case found := <-d.found:
+			d.addPeers(found)
+		case <-d.chokeTick:
+			d.sampleRates()
+			d.rechoke()
+		case result := <-d.results:
+			err := d.handleResult(result)
+			if err != nil {
+				return err
+			}
+		case <-noPeers:
+			return d.noPeersError()
+		case <-d.config.interrupt:
+			return fmt.Errorf("interrupted with %d/%d pieces downloaded", d.completed, d.numPieces)
+		}
+	}
+
+	// Peers keep their connections for uploading but get no more work
+	for _, slot := range d.peers {
+		close(slot.queue)
+	}
+	d.rechoke() // Switch the choker to seed mode
+	close(d.done)
+	return nil
+}
+
+// Report whether new peers can still turn up without any connected
+func (d *downloader) canFindPeers() bool {
+	return d.config.trackers != nil || d.config.dht != nil || d.listening
+}
+
+func (d *downloader) noPeersError() error {
+	if len(d.peers) == 0 {
+		return fmt.Errorf("no peers found")
+	}
+	return fmt.Errorf("all peers disconnected with %d/%d pieces downloaded", d.completed, d.numPieces)
+}
+
+// End the download: tell peer and announce goroutines to stop and wait for
+// the final announces
+func (d *downloader) stop() {
+	close(d.quit)
+	d.background.Wait()
+}
+
+// Remember new peer addresses to dial. Addresses seen before are ignored,
+// whether or not the connection worked.
+func (d *downloader) addPeers(addresses []string) {
+	for _, address := range addresses {
+		if d.known[address] {
+			continue
+		}
+		d.known[address] = true
+		d.candidates = append(d.candidates, address)
+	}
+}
+
+// Forget a peer we haven't dialed yet, so it can be added again later
+func (d *downloader) dropCandidate(address string) {
+	for i, candidate := range d.candidates {
+		if candidate == address {
+			d.candidates = append(d.candidates[:i], d.candidates[i+1:]...)
+			delete(d.known, address)
+			return
+		}
+	}
+}
+
+// Dial candidates while there is room for more connections
+func (d *downloader) connectCandidates() {
+	for len(d.candidates) > 0 && d.livePeers() < maxPeers {
+		address := d.candidates[0]
+		d.candidates = d.candidates[1:]
+		slot := d.newPeerSlot(address)
+		go d.handlePeerConnection(slot)
+	}
+}
+
+func (d *downloader) livePeers() int {
+	count := 0
+	for _, slot := range d.peers {
+		if !slot.gone {
+			count++
+		}
+	}
+	return count
+}
+
+// Fill the queue of every ready peer with pending pieces it has. Once no
+// pieces are pending, idle peers take on pieces in progress that still have
+// blocks nobody requested, such as pieces queued behind others on a slow
+// peer. When every missing block has been requested, switch to endgame mode:
+// the pieces go to every other peer that has them, which request the missing
+// blocks too, so a slow peer can't hold up the last few pieces.
+func (d *downloader) assignPieces() {
+	for _, slot := range d.peers {
+		if !slot.ready || slot.gone {
+			continue
+		}
+		// Only the scheduler sends on the queue, so this never blocks
+		for len(slot.queue) < cap(slot.queue) {
+			index, ok := d.pickPiece(slot)
+			if !ok {
+				break
+			}
+			d.removePending(index)
+			d.assign(index, slot)
+		}
+	}
+
+	if len(d.pending) > 0 || len(d.inProgress) == 0 {
+		return
+	}
+	if !d.endgame && d.blocks.startEndgame(d.inProgress) {
+		fmt.Printf("Entering endgame mode with %d pieces in progress\n", len(d.inProgress))
+		d.endgame = true
+	}
+	for _, slot := range d.peers {
+		if !slot.ready || slot.gone {
+			continue
+		}
+		for len(slot.queue) < cap(slot.queue) {
+			index, ok := d.pickEndgamePiece(slot)
+			if !ok {
+				break
+			}
+			d.assign(index, slot)
+		}
+	}
+}
+
+func (d *downloader) assign(index int, slot *peerSlot) {
+	if d.inProgress[index] == nil {
+		d.inProgress[index] = make(map[*peerSlot]bool)
+	}
+	d.inProgress[index][slot] = true
+	slot.assigned[index] = true
+	slot.queue <- index
+}
+
+// Choose an in-progress piece for a peer that has it but isn't working on it,
+// preferring the piece with the fewest peers on it. Before endgame, only
+// pieces with blocks nobody requested yet are handed out.
+func (d *downloader) pickEndgamePiece(slot *peerSlot) (int, bool) {
+	best := -1
+	for index, holders := range d.inProgress {
+		if holders[slot] || d.failedOn[index][slot] || !slot.bitfield.HasPiece(index) {
+			continue
+		}
+		if !d.endgame && !d.blocks.hasUnrequested(index) {
+			continue
+		}
+		if best < 0 || len(holders) < len(d.inProgress[best]) || (len(holders) == len(d.inProgress[best]) && index < best) {
+			best = index
+		}
+	}
+	return best, best >= 0
+}
+
+// Let the picker choose among the pending pieces the peer has. A piece that
+// already failed on this peer is left for another peer that has it, if there
+// is one.
+func (d *downloader) pickPiece(slot *peerSlot) (int, bool) {
+	candidates := slot.wanted
+	var skip map[int]bool
+	for index, failed := range d.failedOn {
+		if failed[slot] && d.pending[index] && slot.bitfield.HasPiece(index) && d.hasOtherSource(index, slot) {
+			if skip == nil {
+				skip = make(map[int]bool)
+			}
+			skip[index] = true
+		}
+	}
+	if skip != nil {
+		candidates = nil
+		for _, index := range slot.wanted {
+			if !skip[index] {
+				candidates = append(candidates, index)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	return d.config.picker.Pick(candidates, d.availability, d.completed), true
+}
+
+// Take a piece out of the pending set and the wanted set of every peer
+func (d *downloader) removePending(index int) {
+	delete(d.pending, index)
+	for _, slot := range d.peers {
+		if slot.bitfield.HasPiece(index) {
+			slot.wanted = removeIndex(slot.wanted, index)
+		}
+	}
+}
+
+// Put a piece back in the pending set and the wanted set of every connected
+// peer that has it
+func (d *downloader) addPending(index int) {
+	d.pending[index] = true
+	for _, slot := range d.peers {
+		if !slot.gone && slot.bitfield.HasPiece(index) {
+			slot.wanted = insertIndex(slot.wanted, index)
+		}
+	}
+}
+
+// Insert index into the sorted slice s, if it isn't there yet
+func insertIndex(s []int, index int) []int {
+	i := sort.SearchInts(s, index)
+	if i < len(s) && s[i] == index {
+		return s
+	}
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = index
+	return s
+}
+
+// Remove index from the sorted slice s, if it is there
+func removeIndex(s []int, index int) []int {
+	i := sort.SearchInts(s, index)
+	if i == len(s) || s[i] != index {
+		return s
+	}
+	return append(s[:i], s[i+1:]...)
+}
+
+// Add (delta 1) or remove (delta -1) a peer's pieces from the availability
+// counts. Adding them also fills the peer's wanted set; removing them empties
+// it.
+func (d *downloader) updateAvailability(slot *peerSlot, delta int) {
+	if delta > 0 {
+		slot.wanted = slot.wanted[:0]
+	}
+	for i, b := range slot.bitfield {
+		if b == 0 {
+			continue // Most bytes are empty early in a download
+		}
+		for index := i * 8; index < (i+1)*8 && index < d.numPieces; index++ {
+			if !slot.bitfield.HasPiece(index) {
+				continue
+			}
+			d.availability[index] += delta
+			if delta > 0 && d.pending[index] {
+				slot.wanted = append(slot.wanted, index)
+			}
+		}
+	}
+	if delta < 0 {
+		slot.wanted = nil
+	}
+}
+
+// Report whether a ready peer other than slot has the piece and has not
+// failed it yet
+func (d *downloader) hasOtherSource(index int, slot *peerSlot) bool {
+	for _, other := range d.peers {
+		if other == slot || !other.ready || other.gone {
+			continue
+		}
+		if other.bitfield.HasPiece(index) && !d.failedOn[index][other] {
+			return true
+		}
+	}
+	return false
+}
+
+// Take a piece away from a peer. If no other peer is working on it, it goes
+// back in the pending set.
+func (d *downloader) unassign(index int, slot *peerSlot) {
+	delete(slot.assigned, index)
+	delete(d.inProgress[index], slot)
+	if len(d.inProgress[index]) > 0 || d.have.HasPiece(index) {
+		return
+	}
+	delete(d.inProgress, index)
+	d.addPending(index)
+}
+
+func (d *downloader) handleEvent(ev peerEvent) {
+	slot := ev.peer
+	switch ev.kind {
+	case peerReady:
+		slot.ready = true
+	case peerBitfield:
+		d.updateAvailability(slot, -1)
+		slot.bitfield = ev.bitfield
+		d.updateAvailability(slot, 1)
+	case peerHave:
+		if !slot.bitfield.HasPiece(ev.index) {
+			slot.bitfield.SetPiece(ev.index)
+			d.availability[ev.index]++
+			if d.pending[ev.index] {
+				slot.wanted = insertIndex(slot.wanted, ev.index)
+			}
+		}
+	case peerInterest:
+		slot.interested = ev.interested
+		d.rechoke()
+	case peerGone:
+		slot.gone = true
+		d.updateAvailability(slot, -1)
+		for index := range slot.assigned {
+			d.unassign(index, slot)
+		}
+		if slot.interested {
+			slot.interested = false
+			d.rechoke() // Free its upload slot
+		}
+	}
+}
+
+func (d *downloader) handleResult(result pieceResult) error {
+	slot := result.peer
+	if d.have.HasPiece(result.index) {
+		delete(slot.assigned, result.index)
+		return nil // Already downloaded by another peer in endgame
+	}
+
+	if result.err != nil {
+		// Remember the failure so the piece goes to a different peer next
+		if d.failedOn[result.index] == nil {
+			d.failedOn[result.index] = make(map[*peerSlot]bool)
+		}
+		d.failedOn[result.index][slot] = true
+		d.unassign(result.index, slot)
+		fmt.Printf("Piece %d failed on peer %s, re-queuing\n", result.index, slot.address)
+		return nil
+	}
+
+	// Write the verified piece straight to its place on disk
+	err := d.storage.WritePiece(result.index, result.data)
+	if err != nil {
+		return fmt.Errorf("error writing piece %d: %v", result.index, err)
+	}
+	delete(slot.assigned, result.index)
+	for other := range d.inProgress[result.index] {
+		if other != slot {
+			// Endgame duplicate: tell the peer to cancel its requests
+			delete(other.assigned, result.index)
+			other.cancel <- result.index
+		}
+	}
+	delete(d.inProgress, result.index)
+	delete(d.failedOn, result.index)
+	d.blocks.remove(result.index)
+	d.haveMu.Lock()
+	d.have.SetPiece(result.index)
+	d.haveLog = append(d.haveLog, result.index)
+	d.haveMu.Unlock()
+	d.completed++
+
+	// Have every peer announce the new piece
+	for _, other := range d.peers {
+		wakeSlot(other.wake)
+	}
+
+	err = saveResume(d.resumePath, d.infoHashHex, d.numPieces, d.have)
+	if err != nil {
+		fmt.Printf("Error updating resume file: %v\n", err)
+	}
+	fmt.Printf("Piece %d downloaded successfully (%d/%d)\n", result.index, d.completed, d.numPieces)
+	if d.onPiece != nil {
+		d.onPiece(d.completed, d.numPieces)
+	}
+	return nil
+}
+
+// Signal a peer goroutine without blocking; a signal already pending covers
+// this one
+func wakeSlot(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Send an event to the scheduler; gives up once the download is over
+func (d *downloader) notify(ev peerEvent) bool {
+	select {
+	case d.events <- ev:
+		return true
+	case <-d.quit:
+		return false
+	}
+}
+
+func (d *downloader) report(result pieceResult) bool {
+	select {
+	case d.results <- result:
+		return true
+	case <-d.quit:
+		return false
+	}
+}
+
+// Read messages from the connection until it fails or stop is closed
+func readMessages(conn net.Conn, incoming chan<- *message, errs chan<- error, stop <-chan struct{}) {
+	for {
+		m, err := readMessage(conn)
+		if err != nil {
+			select {
+			case errs <- err:
+			case <-stop:
+			}
+			return
+		}
+		select {
+		case incoming <- m:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Connect to a peer from the tracker and exchange pieces with it
+func (d *downloader) handlePeerConnection(slot *peerSlot) {
+	defer d.notify(peerEvent{peer: slot, kind: peerGone})
+	address := slot.address
+
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		fmt.Printf("Error connecting to peer %s: %v\n", address, err)
+		return
+	}
+	defer conn.Close()
+
+	handshake := d.handshake(d.infoHashHex)
+	_, err = conn.Write(handshake)
+	if err != nil {
+		fmt.Printf("Error sending handshake to peer %s: %v\n", address, err)
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+	response := make([]byte, 68)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		fmt.Printf("Error reading handshake response from peer %s: %v\n", address, err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	infoHash, _ := hex.DecodeString(d.infoHashHex)
+	_, err = checkHandshake(response, infoHash, d.peerID)
+	if err != nil {
+		fmt.Printf("Rejected peer %s: %v\n", address, err)
+		return
+	}
+
+	fmt.Printf("Received handshake response from peer %s\n", address)
+
+	// A peer we could dial accepts connections, so others may try it too
+	if d.pex != nil {
+		d.pex.peerConnected(address, pexReachable)
+		defer d.pex.peerDisconnected(address)
+	}
+	d.runPeer(slot, conn, supportsExtensions(response))
+}
+
+// Run the message exchange with a peer once the handshake is done.
+// extensions is set when the peer's handshake offered BEP 10.
+func (d *downloader) runPeer(slot *peerSlot, conn net.Conn, extensions bool) {
+	address := slot.address
+	peer := newPeerConn(conn, address, d.numPieces)
+	defer func() {
+		if peer.ext != nil {
+			peer.ext.close()
+		}
+	}()
+
+	// Tell the peer which pieces we can upload
+	announced := d.newAnnouncement()
+	if announced.pieces.Count(d.numPieces) > 0 {
+		err := peer.send(&message{ID: msgBitfield, Payload: announced.pieces})
+		if err != nil {
+			fmt.Printf("Error sending bitfield to peer %s: %v\n", address, err)
+			return
+		}
+	}
+
+	if extensions {
+		var remoteIP net.IP
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			remoteIP = addr.IP
+		}
+		port := 0
+		if d.listening {
+			port = d.config.listenPort
+		}
+		peer.ext = newExtensionConn(address, slot.incoming, d.extensions, peer.send)
+		err := peer.ext.sendHandshake(remoteIP, port)
+		if err != nil {
+			fmt.Printf("Error sending extended handshake to peer %s: %v\n", address, err)
+			return
+		}
+	}
+
+	// Messages are read on their own goroutine so bitfield and have updates
+	// reach the scheduler even while the peer has no work
+	incoming := make(chan *message)
+	readErrs := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go readMessages(conn, incoming, readErrs, stop)
+
+	err := d.peerLoop(slot, peer, announced, incoming, readErrs)
+	if err != nil && err != errDownloadOver {
+		fmt.Printf("[Peer %s] %v\n", address, err)
+	}
+}
+
+// Block requests to keep outstanding with a peer, no more than the reqq it
+// sent in its extended handshake
+func (d *downloader) pipelineDepth(peer *peerConn) int {
+	depth := d.config.pipelineDepth
+	if peer.ext != nil && peer.ext.remote != nil && peer.ext.remote.Reqq > 0 && peer.ext.remote.Reqq < depth {
+		depth = peer.ext.remote.Reqq
+	}
+	return depth
+}
+
+// Returned by peerLoop when the scheduler has no more use for the peer
+var errDownloadOver = errors.New("download over")
+
+// Drive one peer connection: download the pieces the scheduler queues on it,
+// announce the pieces we finish and serve the peer's requests. announced is
+// what we have told the peer about our pieces.
+func (d *downloader) peerLoop(slot *peerSlot, peer *peerConn, announced *announcement, incoming <-chan *message, readErrs <-chan error) error {
+	announcedReady := false
+	queue := (<-chan int)(slot.queue) // nil once the download is complete
+	var active []*pieceProgress       // Pieces being downloaded, oldest first
+	cancelled := make(map[int]bool)   // Queued pieces finished by another peer
+	backlog := 0                      // Requests sent but not answered
+	lastMessage := time.Now()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer func() {
+		for _, pp := range active {
+			d.blocks.leave(slot, pp)
+		}
+	}()
+
+	// Give every unfinished piece back to the scheduler as failed
+	failActive := func(err error) {
+		for _, pp := range active {
+			d.report(pieceResult{peer: slot, index: pp.index, err: err})
+		}
+	}
+
+	// Stop work on the piece at position i, cancelling the blocks still
+	// requested from the peer
+	dropPiece := func(i int) error {
+		pp := active[i]
+		active = append(active[:i], active[i+1:]...)
+		for _, block := range d.blocks.leave(slot, pp) {
+			err := peer.send(formatCancel(pp.index, block*blockSize, pp.blockLength(block)))
+			if err != nil {
+				return fmt.Errorf("error cancelling block of piece %d: %w", pp.index, err)
+			}
+			backlog--
+		}
+		return nil
+	}
+
+	for {
+		if !peer.peerChoking && !announcedReady {
+			fmt.Printf("Peer %s unchoked us\n", peer.address)
+			if !d.notify(peerEvent{peer: slot, kind: peerReady}) {
+				return errDownloadOver
+			}
+			announcedReady = true
+		}
+
+		// Keep up to depth block requests outstanding while we are unchoked
+		depth := d.pipelineDepth(peer)
+		needWork := len(active) == 0
+		for !peer.peerChoking && backlog < depth {
+			pp, block := d.blocks.nextRequest(slot, active)
+			if pp == nil {
+				needWork = true
+				break
+			}
+			err := peer.send(formatRequest(pp.index, block*blockSize, pp.blockLength(block)))
+			if err != nil {
+				failActive(err)
+				return fmt.Errorf("error requesting block of piece %d: %w", pp.index, err)
+			}
+			backlog++
+		}
+
+		// Take the next piece once everything assigned so far is requested,
+		// so the pipeline never drains between pieces
+		var nextPiece <-chan int
+		if needWork && backlog < depth {
+			nextPiece = queue
+		}
+
+		select {
+		case <-d.quit:
+			return errDownloadOver
+
+		case <-slot.wake:
+			err := peer.setChoking(atomic.LoadInt32(&slot.unchoked) == 0)
+			if err == nil {
+				err = d.syncPeer(peer, announced)
+			}
+			if err != nil {
+				failActive(err)
+				return err
+			}
+
+		case index := <-slot.cancel:
+			// Another peer finished this piece
+			cancelled[index] = true
+			for i, pp := range active {
+				if pp.index != index {
+					continue
+				}
+				err := dropPiece(i)
+				if err != nil {
+					failActive(err)
+					return err
+				}
+				delete(cancelled, index)
+				break
+			}
+
+		case <-slot.arrived:
+			// Cancel the blocks other peers delivered first, and drop the
+			// pieces our blocks spoilt
+			for i := 0; i < len(active); i++ {
+				pp := active[i]
+				blocks, excluded := d.blocks.arrivedElsewhere(slot, pp)
+				if excluded {
+					fmt.Printf("[Peer %s] Dropping piece %d, which failed with its blocks\n", peer.address, pp.index)
+					err := dropPiece(i)
+					if err != nil {
+						failActive(err)
+						return err
+					}
+					if !d.report(pieceResult{peer: slot, index: pp.index, err: fmt.Errorf("piece validation failed")}) {
+						return errDownloadOver
+					}
+					i--
+					continue
+				}
+				for _, block := range blocks {
+					err := peer.send(formatCancel(pp.index, block*blockSize, pp.blockLength(block)))
+					if err != nil {
+						failActive(err)
+						return fmt.Errorf("error cancelling block of piece %d: %w", pp.index, err)
+					}
+					backlog--
+				}
+			}
+
+		case index, ok := <-nextPiece:
+			if !ok {
+				// Nothing left to download; stay connected to upload
+				queue = nil
+				if d.isSeed(peer) {
+					return errDownloadOver
+				}
+				continue
+			}
+			if cancelled[index] {
+				delete(cancelled, index) // Finished elsewhere before we started
+				continue
+			}
+			length := d.torrent.pieceDataSize(index)
+			fmt.Printf("[Peer %s] Downloading piece %d, length %d\n", peer.address, index, length)
+			active = append(active, d.blocks.join(slot, index, length, d.torrent.pieceSize(index)))
+			lastMessage = time.Now()
+
+		case err := <-readErrs:
+			failActive(err)
+			return fmt.Errorf("error reading from peer: %w", err)
+
+		case now := <-ticker.C:
+			// Pieces whose blocks all went to other peers don't wait on this one
+			waiting := backlog > 0 || (peer.peerChoking && len(active) > 0)
+			if waiting && now.Sub(lastMessage) > peerReadTimeout {
+				err := fmt.Errorf("timed out waiting for blocks")
+				failActive(err)
+				return err
+			}
+			if peer.ext != nil {
+				err := peer.ext.tick(now)
+				if err != nil {
+					failActive(err)
+					return err
+				}
+			}
+
+		case m := <-incoming:
+			lastMessage = time.Now()
+			if m == nil {
+				continue // Keep-alive message
+			}
+			piecesBefore := peer.pieces
+			err := peer.handle(m)
+			if err != nil {
+				failActive(err)
+				return err
+			}
+
+			switch m.ID {
+			case msgBitfield:
+				if !d.notify(peerEvent{peer: slot, kind: peerBitfield, bitfield: append(Bitfield(nil), peer.bitfield...)}) {
+					return errDownloadOver
+				}
+				err = d.updateInterest(peer, announced)
+			case msgHave:
+				index, _ := parseHave(m)
+				if !d.notify(peerEvent{peer: slot, kind: peerHave, index: index}) {
+					return errDownloadOver
+				}
+				if peer.pieces > piecesBefore && !announced.pieces.HasPiece(index) {
+					announced.missing++
+				}
+				err = peer.setInterested(announced.missing > 0)
+			case msgInterested, msgNotInterested:
+				// The choker decides whether the peer gets an upload slot
+				if !d.notify(peerEvent{peer: slot, kind: peerInterest, interested: peer.peerInterested}) {
+					return errDownloadOver
+				}
+			case msgRequest:
+				err = d.serveRequest(slot, peer, m)
+			case msgExtended:
+				if peer.ext != nil {
+					err = peer.ext.handle(m)
+				}
+			case msgHashRequest:
+				err = d.serveHashRequest(peer, m)
+			case msgChoke:
+				// A choking peer drops our pending requests, so ask again after the unchoke
+				d.blocks.choked(slot, active)
+				backlog = 0
+			case msgPiece:
+				index, begin, data, _ := parsePiece(m)
+
+				// Match the block to its request by (index, begin); replies may come in any order
+				var pp *pieceProgress
+				position := 0
+				for i, candidate := range active {
+					if candidate.index == index {
+						pp, position = candidate, i
+					}
+				}
+				if pp == nil || begin%blockSize != 0 || begin/blockSize >= pp.numBlocks() {
+					continue // Not something we asked for
+				}
+				block := begin / blockSize
+				if len(data) != pp.blockLength(block) {
+					err := fmt.Errorf("block at offset %d of piece %d has length %d", begin, index, len(data))
+					failActive(err)
+					return err
+				}
+				requested, fresh, complete, others := d.blocks.receive(slot, pp, block, data)
+				if requested {
+					backlog--
+				}
+				if !fresh {
+					continue // Duplicate
+				}
+				atomic.AddInt64(&d.downloaded, int64(len(data)))
+				slot.downloadRate.add(len(data))
+
+				// In endgame other peers asked for the block too; they cancel
+				// it right away
+				for _, other := range others {
+					wakeSlot(other.arrived)
+				}
+				if !complete {
+					continue
+				}
+				active = append(active[:position], active[position+1:]...)
+				d.blocks.leave(slot, pp)
+
+				// All blocks for the piece received, validate the piece
+				if validatePiece(d.torrent, pp.index, pp.buf) {
+					fmt.Printf("[Peer %s] Piece %d validated successfully\n", peer.address, pp.index)
+					if !d.report(pieceResult{peer: slot, index: pp.index, data: pp.buf}) {
+						return errDownloadOver
+					}
+				} else {
+					fmt.Printf("[Peer %s] Piece %d validation failed\n", peer.address, pp.index)
+					for _, other := range d.blocks.reject(pp) {
+						wakeSlot(other.arrived)
+					}
+					if !d.report(pieceResult{peer: slot, index: pp.index, err: fmt.Errorf("piece validation failed")}) {
+						return errDownloadOver
+					}
+				}
+			}
+			if err != nil {
+				failActive(err)
+				return err
+			}
+			if queue == nil && d.isSeed(peer) {
+				return errDownloadOver // Neither side needs anything
+			}
+		}
+	}
+}
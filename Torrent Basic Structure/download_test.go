@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testInfoHash = "00112233445566778899aabbccddeeff00112233"
+
+// Build a single-file torrent for data
+func makeTestTorrent(name string, data []byte, pieceLength int) TorrentFile {
+	var torrent TorrentFile
+	torrent.Info.Name = name
+	torrent.Info.PieceLength = pieceLength
+	torrent.Info.Length = len(data)
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[begin:end])
+		torrent.Info.Pieces += string(hash[:])
+	}
+	return torrent
+}
+
+// fakePeer is an in-process seeder on loopback. Every request is answered
+// after latency plus a random jitter, so replies arrive out of order. A
+// request for a piece the peer did not advertise fails the test and drops the
+// connection.
+type fakePeer struct {
+	listener    net.Listener
+	data        []byte
+	pieceLength int
+	has         func(index int) bool // nil means every piece
+	corrupt     map[int]bool         // Pieces served with a flipped byte
+	latency     time.Duration
+	jitter      time.Duration
+	cancels     int32 // Cancel messages received
+	unexpected  int32 // Requests for pieces the peer does not have
+}
+
+func startFakePeer(t testing.TB, data []byte, pieceLength int) *fakePeer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakePeer{listener: listener, data: data, pieceLength: pieceLength}
+	t.Cleanup(func() {
+		listener.Close()
+		if n := atomic.LoadInt32(&p.unexpected); n > 0 {
+			t.Errorf("peer %s got %d requests for pieces it does not have", p.address(), n)
+		}
+	})
+	go p.serve()
+	return p
+}
+
+func (p *fakePeer) address() string {
+	return p.listener.Addr().String()
+}
+
+func (p *fakePeer) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *fakePeer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	handshake := make([]byte, 68)
+	_, err := io.ReadFull(conn, handshake)
+	if err != nil {
+		return
+	}
+	var writeMu sync.Mutex
+	write := func(m *message) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.Write(m.serialize())
+	}
+	copy(handshake[48:], newPeerID()) // Answer with a peer ID of our own
+	conn.Write(handshake)
+
+	numPieces := (len(p.data) + p.pieceLength - 1) / p.pieceLength
+	bitfield := newBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		if p.has == nil || p.has(i) {
+			bitfield.SetPiece(i)
+		}
+	}
+	write(&message{ID: msgBitfield, Payload: bitfield})
+	write(&message{ID: msgUnchoke})
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		m, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		if m != nil && m.ID == msgCancel {
+			atomic.AddInt32(&p.cancels, 1)
+		}
+		if m == nil || m.ID != msgRequest {
+			continue
+		}
+		index, begin, length, err := parseRequest(m)
+		if err != nil {
+			return
+		}
+		if !bitfield.HasPiece(index) {
+			atomic.AddInt32(&p.unexpected, 1)
+			return
+		}
+		offset := index*p.pieceLength + begin
+		block := append([]byte(nil), p.data[offset:offset+length]...)
+		if p.corrupt[index] {
+			block[0] ^= 0xff
+		}
+
+		delay := p.latency
+		if p.jitter > 0 {
+			delay += time.Duration(rng.Int63n(int64(p.jitter)))
+		}
+		if delay == 0 {
+			write(formatPiece(index, begin, block))
+			continue
+		}
+		time.AfterFunc(delay, func() { write(formatPiece(index, begin, block)) })
+	}
+}
+
+// Download settings for tests: no listener and no seeding afterwards
+func testDownloadConfig(outputDir string) downloadConfig {
+	config := defaultDownloadConfig()
+	config.outputDir = outputDir
+	config.listenPort = 0
+	config.seedRatio = 0
+	config.seedTime = 0
+	config.dhtPort = 0
+	return config
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestDownloadTorrentFromFakePeers(t *testing.T) {
+	data := randomData(40*32768 + 1000)
+	torrent := makeTestTorrent("download.bin", data, 32768)
+
+	// No peer has every piece: one has the even pieces and serves some of
+	// them corrupted, one the odd pieces and one only the first few, so
+	// the corrupted pieces can only come from it
+	even := startFakePeer(t, data, 32768)
+	even.has = func(index int) bool { return index%2 == 0 }
+	even.corrupt = map[int]bool{0: true, 2: true, 4: true}
+	even.jitter = time.Millisecond
+	odd := startFakePeer(t, data, 32768)
+	odd.has = func(index int) bool { return index%2 == 1 }
+	odd.jitter = time.Millisecond
+	early := startFakePeer(t, data, 32768)
+	early.has = func(index int) bool { return index < 5 }
+
+	config := testDownloadConfig(t.TempDir())
+	peers := []string{even.address(), odd.address(), early.address()}
+	err := downloadTorrent(torrent, testInfoHash, newPeerID(), peers, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(config.outputDir, "download.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data does not match")
+	}
+}
+
+// A peer that never answers must not hold up the pieces it was given: in
+// endgame they are fetched from the other peer and the stuck requests cancelled
+func TestDownloadEndgameCancelsStalledPeer(t *testing.T) {
+	data := randomData(16 * 32768)
+	torrent := makeTestTorrent("endgame.bin", data, 32768)
+
+	stalled := startFakePeer(t, data, 32768)
+	stalled.latency = time.Hour
+	fast := startFakePeer(t, data, 32768)
+
+	config := testDownloadConfig(t.TempDir())
+	peers := []string{stalled.address(), fast.address()}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- downloadTorrent(torrent, testInfoHash, newPeerID(), peers, config, nil)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(peerReadTimeout / 2):
+		t.Fatal("download stalled on the unresponsive peer")
+	}
+
+	got, err := os.ReadFile(filepath.Join(config.outputDir, "endgame.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data does not match")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&stalled.cancels) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stalled peer received no cancel messages")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A complete copy on disk is seeded to an incoming leecher until the share
+// ratio is reached
+func TestSeedToIncomingPeer(t *testing.T) {
+	data := randomData(12*32768 + 500)
+	torrent := makeTestTorrent("seed.bin", data, 32768)
+
+	// Find a free port for the seeder to listen on
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	seedConfig := testDownloadConfig(t.TempDir())
+	seedConfig.listenPort = port
+	seedConfig.seedRatio = 1.0
+	seedConfig.seedTime = 10 * time.Second
+	err = os.WriteFile(filepath.Join(seedConfig.outputDir, "seed.bin"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seeded := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		seeded <- downloadTorrent(torrent, testInfoHash, "-PC0001-SEEDER000000", nil, seedConfig, nil)
+	}()
+
+	// Retry until the seeder is listening
+	leechConfig := testDownloadConfig(t.TempDir())
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	for {
+		err = downloadTorrent(torrent, testInfoHash, "-PC0001-LEECHER00000", []string{address}, leechConfig, nil)
+		if err == nil || time.Since(start) > 5*time.Second {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(leechConfig.outputDir, "seed.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data does not match")
+	}
+
+	// Uploading the whole torrent once takes the seeder to ratio 1.0
+	select {
+	case err := <-seeded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("seeder kept going after reaching its share ratio")
+	}
+	if time.Since(start) >= seedConfig.seedTime {
+		t.Fatal("seeder stopped on the time limit, not the share ratio")
+	}
+}
+
+func TestShareRatio(t *testing.T) {
+	d := &downloader{torrent: makeTestTorrent("ratio.bin", randomData(400), 100), uploaded: 600}
+	if got := d.shareRatio(); got != 1.5 {
+		t.Errorf("ratio %v, want 1.5", got)
+	}
+
+	// A torrent of empty files has no ratio to divide out
+	var empty TorrentFile
+	empty.Info.Name = "empty"
+	empty.Info.PieceLength = 16
+	empty.Info.Files = []torrentFileEntry{{Length: 0, Path: []string{"a"}}, {Length: 0, Path: []string{"b"}}}
+	d = &downloader{torrent: empty, uploaded: 10}
+	if got := d.shareRatio(); got != 0 {
+		t.Errorf("ratio of an empty torrent %v, want 0", got)
+	}
+	d.config.seedTime = time.Hour
+	finished := make(chan struct{})
+	go func() {
+		d.seed()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("seeding a torrent without data did not return")
+	}
+}
+
+// Throughput against a single peer with a 2 ms round trip for different
+// pipeline depths. With one request in flight every block costs a full round
+// trip; deeper pipelines keep the connection busy.
+func BenchmarkDownloadPipelineDepth(b *testing.B) {
+	data := randomData(4 << 20)
+	torrent := makeTestTorrent("bench.bin", data, 256<<10)
+	peer := startFakePeer(b, data, 256<<10)
+	peer.latency = 2 * time.Millisecond
+
+	// Keep the per-piece log lines out of the benchmark output
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer devNull.Close()
+
+	for _, depth := range []int{1, 5, 10, 20} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				config := testDownloadConfig(b.TempDir())
+				config.pipelineDepth = depth
+
+				os.Stdout = devNull
+				err := downloadTorrent(torrent, testInfoHash, newPeerID(), []string{peer.address()}, config, nil)
+				os.Stdout = stdout
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
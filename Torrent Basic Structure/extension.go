@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"bittorrent-client/bencode"
+)
+
+// Client name sent in the v field of the extended handshake
+const clientVersion = "bittorrent-client 0.1"
+
+// Requests we let a peer queue on us, sent as reqq. We answer requests as
+// they arrive, so this only tells the peer how far it may pipeline.
+const localReqq = 250
+
+// Extended handshake (BEP 10), sent as extended message 0 right after the
+// BitTorrent handshake. m maps extension names to the message IDs the
+// sender wants to receive them with; an ID of 0 means not supported.
+type extendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	YourIP       string         `bencode:"yourip,omitempty"` // Our address as the peer sees it
+	P            int            `bencode:"p,omitempty"`      // Sender's listen port
+}
+
+// Extension is one message type of the extension protocol, such as
+// ut_metadata or ut_pex. A download registers its extensions once and every
+// connection that negotiates them gets its own session.
+type Extension interface {
+	// Name in the m dictionary
+	Name() string
+	// Add this extension's fields, such as metadata_size, to our extended
+	// handshake
+	ExtendHandshake(h *extendedHandshake)
+	// Start the extension on a connection whose extended handshake named
+	// it. Returning an error drops the connection.
+	NewSession(peer *extensionPeer) (ExtensionSession, error)
+}
+
+// ExtensionSession is an extension's state on one connection. Its methods
+// are called from the connection's goroutine, so sessions need no locking.
+type ExtensionSession interface {
+	// Handle the payload of a message the peer sent for this extension
+	Handle(payload []byte) error
+	// Called about once a second, for extensions that send periodically
+	Tick(now time.Time) error
+	// Called once the connection is closed
+	Close()
+}
+
+// extensionPeer is what an extension session sees of its connection
+type extensionPeer struct {
+	address  string
+	incoming bool // The peer connected to us
+	remote   *extendedHandshake
+	id       byte // The peer's message ID for the extension
+	send     func(*message) error
+}
+
+// Address the peer accepts connections on, or "" if unknown. For incoming
+// connections that is the port from the peer's extended handshake.
+func (p *extensionPeer) listenAddress() string {
+	if !p.incoming {
+		return p.address
+	}
+	host, _, err := net.SplitHostPort(p.address)
+	if err != nil || p.remote.P <= 0 || p.remote.P > 65535 {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.remote.P))
+}
+
+// Send the peer a message of this extension
+func (p *extensionPeer) sendExtended(payload []byte) error {
+	return p.send(formatExtended(p.id, payload))
+}
+
+// extensionConn routes the extended messages of one connection to the
+// registered extensions. Extension i receives messages with local ID i+1.
+type extensionConn struct {
+	address    string
+	incoming   bool
+	extensions []Extension
+	send       func(*message) error
+	remote     *extendedHandshake // nil until the peer's handshake arrives
+	sessions   []ExtensionSession // By local ID minus one; nil where unused
+}
+
+func newExtensionConn(address string, incoming bool, extensions []Extension, send func(*message) error) *extensionConn {
+	return &extensionConn{address: address, incoming: incoming, extensions: extensions, send: send}
+}
+
+// Send our extended handshake. remoteIP is the peer's address, returned as
+// yourip; port is our listen port, or 0 if we don't accept connections.
+func (c *extensionConn) sendHandshake(remoteIP net.IP, port int) error {
+	h := extendedHandshake{
+		M:    make(map[string]int),
+		V:    clientVersion,
+		Reqq: localReqq,
+		P:    port,
+	}
+	for i, ext := range c.extensions {
+		h.M[ext.Name()] = i + 1
+		ext.ExtendHandshake(&h)
+	}
+	if ip4 := remoteIP.To4(); ip4 != nil {
+		h.YourIP = string(ip4)
+	} else if len(remoteIP) == net.IPv6len {
+		h.YourIP = string(remoteIP)
+	}
+
+	data, err := bencode.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return c.send(formatExtended(0, data))
+}
+
+// Report whether the peer's handshake has arrived and named the extension
+func (c *extensionConn) supports(name string) bool {
+	for i, ext := range c.extensions {
+		if ext.Name() == name {
+			return c.sessions != nil && c.sessions[i] != nil
+		}
+	}
+	return false
+}
+
+// Dispatch an extended message from the peer
+func (c *extensionConn) handle(m *message) error {
+	if len(m.Payload) == 0 {
+		return fmt.Errorf("empty extended message")
+	}
+	id := int(m.Payload[0])
+	payload := m.Payload[1:]
+
+	if id == 0 {
+		if c.remote != nil {
+			return nil // Handshake updates are not used
+		}
+		var remote extendedHandshake
+		_, err := unmarshalPrefix(payload, &remote)
+		if err != nil {
+			return fmt.Errorf("invalid extended handshake: %v", err)
+		}
+		c.remote = &remote
+		c.sessions = make([]ExtensionSession, len(c.extensions))
+		for i, ext := range c.extensions {
+			theirID := remote.M[ext.Name()]
+			if theirID <= 0 || theirID > 255 {
+				continue
+			}
+			peer := &extensionPeer{address: c.address, incoming: c.incoming, remote: c.remote, id: byte(theirID), send: c.send}
+			c.sessions[i], err = ext.NewSession(peer)
+			if err != nil {
+				return fmt.Errorf("%s: %v", ext.Name(), err)
+			}
+		}
+		return nil
+	}
+
+	if c.sessions == nil || id > len(c.sessions) || c.sessions[id-1] == nil {
+		return nil // Not something we offered to this peer
+	}
+	err := c.sessions[id-1].Handle(payload)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.extensions[id-1].Name(), err)
+	}
+	return nil
+}
+
+// Give every session a chance to send its periodic messages
+func (c *extensionConn) tick(now time.Time) error {
+	for i, session := range c.sessions {
+		if session == nil {
+			continue
+		}
+		err := session.Tick(now)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.extensions[i].Name(), err)
+		}
+	}
+	return nil
+}
+
+// End every session when the connection closes
+func (c *extensionConn) close() {
+	for _, session := range c.sessions {
+		if session != nil {
+			session.Close()
+		}
+	}
+}
+
+func formatExtended(id byte, payload []byte) *message {
+	return &message{ID: msgExtended, Payload: append([]byte{id}, payload...)}
+}
+
+// Decode the bencoded value at the start of data into v and return the rest
+func unmarshalPrefix(data []byte, v interface{}) ([]byte, error) {
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	err := d.Decode(v)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data[d.InputOffset():], nil
+}
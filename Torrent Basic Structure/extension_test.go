@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoExtension replies to every message with the same payload prefixed by
+// its name, and counts ticks
+type echoExtension struct {
+	name     string
+	received []string
+	ticks    int
+}
+
+func (e *echoExtension) Name() string { return e.name }
+
+func (e *echoExtension) ExtendHandshake(h *extendedHandshake) {}
+
+func (e *echoExtension) NewSession(peer *extensionPeer) (ExtensionSession, error) {
+	return &echoSession{ext: e, peer: peer}, nil
+}
+
+type echoSession struct {
+	ext  *echoExtension
+	peer *extensionPeer
+}
+
+func (s *echoSession) Handle(payload []byte) error {
+	s.ext.received = append(s.ext.received, string(payload))
+	if len(payload) > 0 && payload[0] == '?' {
+		return s.peer.sendExtended([]byte(s.ext.name + string(payload[1:])))
+	}
+	return nil
+}
+
+func (s *echoSession) Tick(now time.Time) error {
+	s.ext.ticks++
+	return nil
+}
+
+func (s *echoSession) Close() {}
+
+// Connect two extension sets back to back; each side's messages are handed
+// straight to the other side
+func linkExtensionConns(a, b []Extension) (*extensionConn, *extensionConn) {
+	var connA, connB *extensionConn
+	connA = newExtensionConn("b", false, a, func(m *message) error { return connB.handle(m) })
+	connB = newExtensionConn("a", true, b, func(m *message) error { return connA.handle(m) })
+	return connA, connB
+}
+
+func TestExtendedHandshake(t *testing.T) {
+	info := []byte("d4:name4:teste")
+	var sent *message
+	conn := newExtensionConn("peer", false, []Extension{newUTMetadata(nil, info), &echoExtension{name: "x_echo"}}, func(m *message) error {
+		sent = m
+		return nil
+	})
+	err := conn.sendHandshake(net.ParseIP("10.1.2.3"), 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.ID != msgExtended || sent.Payload[0] != 0 {
+		t.Fatalf("handshake sent as message %s/%d", sent.ID, sent.Payload[0])
+	}
+
+	var h extendedHandshake
+	_, err = unmarshalPrefix(sent.Payload[1:], &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.M["ut_metadata"] != 1 || h.M["x_echo"] != 2 {
+		t.Errorf("m = %v", h.M)
+	}
+	if h.V != clientVersion || h.Reqq != localReqq || h.P != 6881 || h.MetadataSize != len(info) {
+		t.Errorf("handshake = %+v", h)
+	}
+	if h.YourIP != "\x0a\x01\x02\x03" {
+		t.Errorf("yourip = %x", h.YourIP)
+	}
+
+	conn.sendHandshake(net.ParseIP("2001:db8::1"), 0)
+	h = extendedHandshake{}
+	unmarshalPrefix(sent.Payload[1:], &h)
+	if len(h.YourIP) != 16 || h.P != 0 {
+		t.Errorf("IPv6 handshake = %+v", h)
+	}
+}
+
+// Extensions are registered in a different order on each side, so the IDs
+// used on the wire differ by direction
+func TestExtensionRouting(t *testing.T) {
+	pingA, pongA := &echoExtension{name: "x_ping"}, &echoExtension{name: "x_pong"}
+	pingB, pongB := &echoExtension{name: "x_ping"}, &echoExtension{name: "x_pong"}
+	onlyB := &echoExtension{name: "x_only_b"}
+	a, b := linkExtensionConns([]Extension{pingA, pongA}, []Extension{onlyB, pongB, pingB})
+
+	for _, conn := range []*extensionConn{a, b} {
+		err := conn.sendHandshake(nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !a.supports("x_ping") || !a.supports("x_pong") || !b.supports("x_ping") || b.supports("x_only_b") {
+		t.Fatal("negotiated extensions are wrong")
+	}
+	if a.remote.M["x_only_b"] != 1 || a.remote.M["x_ping"] != 3 {
+		t.Fatalf("remote m = %v", a.remote.M)
+	}
+
+	// a's ping session sends with b's ID for x_ping; b echoes back with a's
+	err := a.sessions[0].(*echoSession).peer.sendExtended([]byte("?1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(pingB.received) != "[?1]" || fmt.Sprint(pingA.received) != "[x_ping1]" {
+		t.Fatalf("ping received %v on b and %v on a", pingB.received, pingA.received)
+	}
+	if len(pongA.received)+len(pongB.received)+len(onlyB.received) != 0 {
+		t.Fatal("message routed to the wrong extension")
+	}
+
+	// IDs we never offered are ignored
+	err = b.handle(formatExtended(9, []byte("?")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.tick(time.Now())
+	if pingA.ticks != 1 || pongA.ticks != 1 {
+		t.Fatal("sessions were not ticked")
+	}
+}
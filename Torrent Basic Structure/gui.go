@@ -1,12 +1,8 @@
 package main
 
 import (
-	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
-	"net/http"
-	"net/url"
-	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -17,24 +13,33 @@ import (
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
-	"github.com/jackpal/bencode-go"
 )
 
+// How long the GUI waits for the trackers' scrape before starting the download
+const guiScrapeTimeout = 5 * time.Second
+
 type DownloadProgress struct {
 	TotalPieces      int
 	DownloadedPieces int
 	ProgressBar      *widget.ProgressBar
 	StatusLabel      *widget.Label
+	SwarmLabel       *widget.Label // Tracker scrape results, filled in once they arrive
 	Window           fyne.Window
 }
 
-func (dp *DownloadProgress) UpdateProgress(pieceIndex int, total int) {
-	dp.DownloadedPieces++
+func (dp *DownloadProgress) UpdateProgress(completed int, total int) {
+	dp.DownloadedPieces = completed
+	dp.TotalPieces = total
 	progress := float64(dp.DownloadedPieces) / float64(dp.TotalPieces)
 
 	// Update UI from the main thread
 	dp.Window.Canvas().Refresh(dp.ProgressBar)
 	dp.ProgressBar.SetValue(progress)
+	if completed == total {
+		// downloadTorrent keeps seeding before it returns
+		dp.StatusLabel.SetText(fmt.Sprintf("Download complete, seeding %d pieces...", total))
+		return
+	}
 	dp.StatusLabel.SetText(fmt.Sprintf("Downloading: %d/%d pieces (%.1f%%)",
 		dp.DownloadedPieces, dp.TotalPieces, progress*100))
 }
@@ -57,11 +62,26 @@ func normalizePath(path string) string {
 	return path
 }
 
+// Name to show for a .torrent path or magnet link
+func displayName(source string) string {
+	if isMagnetLink(source) {
+		link, err := parseMagnet(source)
+		if err != nil {
+			return source
+		}
+		if link.name != "" {
+			return link.name
+		}
+		return fmt.Sprintf("%x", link.infoHash)
+	}
+	return filepath.Base(source)
+}
+
 // Create the main UI content
 func createMainContent(w fyne.Window) fyne.CanvasObject {
 	// File selection
 	filePathEntry := widget.NewEntry()
-	filePathEntry.SetPlaceHolder("Path to .torrent file")
+	filePathEntry.SetPlaceHolder("Path to .torrent file or magnet link")
 	
 	browseButton := widget.NewButton("Browse", func() {
 		dialog.ShowFileOpen(func(uri fyne.URIReadCloser, err error) {
@@ -86,17 +106,19 @@ func createMainContent(w fyne.Window) fyne.CanvasObject {
 	downloadButton := widget.NewButton("Download", func() {
 		filePath := filePathEntry.Text
 		if filePath == "" {
-			dialog.ShowError(fmt.Errorf("please select a .torrent file"), w)
+			dialog.ShowError(fmt.Errorf("please select a .torrent file or paste a magnet link"), w)
 			return
 		}
 		
 		// Create progress tracking
 		progressBar := widget.NewProgressBar()
 		statusLabel := widget.NewLabel("Preparing download...")
+		swarmLabel := widget.NewLabel("")
 		
 		progress := &DownloadProgress{
 			ProgressBar: progressBar,
 			StatusLabel: statusLabel,
+			SwarmLabel:  swarmLabel,
 			Window:      w,
 		}
 		
@@ -107,9 +129,10 @@ func createMainContent(w fyne.Window) fyne.CanvasObject {
 		
 		// Replace the content with the progress view
 		w.SetContent(container.NewVBox(
-			widget.NewLabel(fmt.Sprintf("Downloading: %s", filepath.Base(filePath))),
+			widget.NewLabel(fmt.Sprintf("Downloading: %s", displayName(filePath))),
 			progressBar,
 			statusLabel,
+			swarmLabel,
 			backButton,
 		))
 		
@@ -142,173 +165,58 @@ func LaunchGUI() {
 	w.ShowAndRun()
 }
 
-func downloadTorrentWithGUI(filePath string, progress *DownloadProgress) error {
+func downloadTorrentWithGUI(source string, progress *DownloadProgress) error {
 	// Handle Windows path format if needed
-	if runtime.GOOS == "windows" && !strings.Contains(filePath, ":\\") {
+	if runtime.GOOS == "windows" && !isMagnetLink(source) && !strings.Contains(source, ":\\") {
 		// Convert path format if it's not already in Windows format
-		filePath = strings.ReplaceAll(filePath, "/", "\\")
+		source = strings.ReplaceAll(source, "/", "\\")
 	}
 
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
+	config := defaultDownloadConfig()
+	peerID := newPeerID()
+	if isMagnetLink(source) {
+		progress.StatusLabel.SetText("Fetching metadata from peers...")
 	}
-	defer file.Close()
-
-	var torrent TorrentFile
-	err = bencode.Unmarshal(file, &torrent)
+	torrent, infoHashSum, peerAddresses, node, err := openTorrentSource(source, peerID, config)
 	if err != nil {
-		return fmt.Errorf("error unmarshalling file: %v", err)
+		return err
 	}
-
-	// Generate info_hash
-	infoHash := sha1.New()
-	err = bencode.Marshal(infoHash, torrent.Info)
-	if err != nil {
-		return fmt.Errorf("error generating info_hash: %v", err)
+	if node != nil {
+		defer node.close()
+		config.dht = node
 	}
-	infoHashSum := infoHash.Sum(nil)
 	infoHashHex := hex.EncodeToString(infoHashSum)
 
-	// Construct the tracker URL
-	params := url.Values{
-		"info_hash":  {string(infoHashSum)},
-		"peer_id":    {"-PC0001-123456789012"},
-		"port":       {"6881"},
-		"uploaded":   {"0"},
-		"downloaded": {"0"},
-		"left":       {fmt.Sprintf("%d", torrent.Info.Length)},
-		"compact":    {"1"},
-	}
-	trackerURL := fmt.Sprintf("%s?%s", torrent.Announce, params.Encode())
-
-	// Send GET request to the tracker
-	resp, err := http.Get(trackerURL)
-	if err != nil {
-		return fmt.Errorf("error sending GET request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	var trackerResp TrackerResponse
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
-	if err != nil {
-		return fmt.Errorf("error unmarshalling tracker response: %v", err)
-	}
-
-	if trackerResp.FailureReason != "" {
-		return fmt.Errorf("tracker error: %s", trackerResp.FailureReason)
-	}
-
-	// Process peers
-	var peerAddresses []string
-	peers := []byte(trackerResp.Peers)
-	for i := 0; i < len(peers); i += 6 {
-		ip := fmt.Sprintf("%d.%d.%d.%d", peers[i], peers[i+1], peers[i+2], peers[i+3])
-		port := int(peers[i+4])<<8 + int(peers[i+5])
-		address := fmt.Sprintf("%s:%d", ip, port)
-		peerAddresses = append(peerAddresses, address)
-	}
-
-	// Set up progress tracking
-	pieceLength := torrent.Info.PieceLength
-	fileLength := torrent.Info.Length
-	numPieces := (fileLength + pieceLength - 1) / pieceLength
-	progress.TotalPieces = numPieces
-
-	// Download the torrent using multiple peers in parallel with progress updates
-	return downloadTorrentWithProgress(torrent, infoHashHex, "-PC0001-123456789012", peerAddresses, progress)
-}
-
-func downloadTorrentWithProgress(torrent TorrentFile, infoHashHex string, peerID string, peers []string, progress *DownloadProgress) error {
-	pieceLength := torrent.Info.PieceLength
-	fileLength := torrent.Info.Length
-	numPieces := (fileLength + pieceLength - 1) / pieceLength
-
-	// Create channels for work distribution and result collection
-	resultChan := make(chan pieceResult)
-	pieceQueues := make([]chan int, len(peers))
-
-	// Create a slice to store the pieces
-	pieces := make([][]byte, numPieces)
-
-	// Create a map to track which pieces are being downloaded
-	inProgress := make(map[int]bool)
-
-	// Create a slice to track which pieces need to be downloaded
-	var pendingPieces []int
-	for i := 0; i < numPieces; i++ {
-		pendingPieces = append(pendingPieces, i)
-	}
-
-	// Start a goroutine for each peer
-	for i, peer := range peers {
-		pieceQueues[i] = make(chan int, 5) // Buffer for 5 pieces
-		go handlePeerConnection(peer, infoHashHex, peerID, torrent, resultChan, pieceQueues[i])
-	}
-
-	// Start a goroutine to distribute work
-	go func() {
-		for len(pendingPieces) > 0 || len(inProgress) > 0 {
-			// Assign pending pieces to available peers
-			for _, queue := range pieceQueues {
-				if len(pendingPieces) == 0 {
-					break
-				}
-
-				select {
-				case queue <- pendingPieces[0]:
-					inProgress[pendingPieces[0]] = true
-					pendingPieces = pendingPieces[1:]
-				default:
-					// Queue is full, try next peer
-					continue
-				}
-			}
-
-			// Wait for results
-			result := <-resultChan
-			delete(inProgress, result.index)
-
-			if result.err != nil {
-				// If a piece failed, put it back in the pending list
-				pendingPieces = append(pendingPieces, result.index)
+	// Show the swarm before the download starts. Scraping can take minutes
+	// with slow UDP trackers, so the download starts anyway after a few
+	// seconds and a late answer fills in the label then
+	if tiers := newTrackerTiers(torrent); len(tiers) > 0 {
+		progress.SwarmLabel.SetText("Asking trackers about the swarm...")
+		scraped := make(chan struct{})
+		go func() {
+			defer close(scraped)
+			if stats, ok := bestScrape(tiers.scrape(infoHashSum)); ok {
+				progress.SwarmLabel.SetText("Swarm: " + stats.summary())
 			} else {
-				// Store the successful piece
-				pieces[result.index] = result.data
-				// Update progress in the GUI
-				progress.UpdateProgress(result.index, numPieces)
+				progress.SwarmLabel.SetText("Swarm: no tracker answered")
 			}
+		}()
+		select {
+		case <-scraped:
+		case <-time.After(guiScrapeTimeout):
 		}
-
-		// Close all piece queues when done
-		for _, queue := range pieceQueues {
-			close(queue)
-		}
-	}()
-
-	// Wait for all pieces to be downloaded
-	for i := 0; i < numPieces; i++ {
-		if pieces[i] == nil {
-			i--
-			time.Sleep(100 * time.Millisecond)
-		}
-	}
-
-	// Write the pieces to a file
-	outputFile, err := os.Create(torrent.Info.Name)
-	if err != nil {
-		return fmt.Errorf("error creating output file: %v", err)
 	}
-	defer outputFile.Close()
-
-	for _, piece := range pieces {
-		if piece != nil {
-			_, err = outputFile.Write(piece)
-			if err != nil {
-				return fmt.Errorf("error writing piece to file: %v", err)
-			}
+	config.trackers = newTrackerSession(torrent, infoHashSum, peerID, config.listenPort)
+	if node != nil {
+		found, err := node.announce(infoHashSum, config.listenPort)
+		if err == nil {
+			peerAddresses = mergePeers(peerAddresses, found)
 		}
 	}
 
-	return nil
+	// Set up progress tracking
+	progress.TotalPieces = torrent.numPieces()
+
+	// Download the torrent using multiple peers in parallel with progress updates
+	return downloadTorrent(torrent, infoHashHex, peerID, peerAddresses, config, progress.UpdateProgress)
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Peers exchange the piece layers of v2 torrents with hash request, hashes
+// and hash reject messages (BEP 52). Magnet links only lead to the info
+// dictionary, which doesn't hold the piece layers, so they are asked for
+// before the download starts. Only requests for a file's piece layer are
+// answered; we don't keep the layers below it.
+
+// Most hashes one request may ask for
+const maxHashRequestLength = 512
+
+// Fields shared by hash request, hashes and hash reject messages. Proof
+// layers counts layers above the base layer: the answer includes the uncle
+// hashes of every layer up to that one that isn't covered by the requested
+// hashes themselves.
+type hashRequest struct {
+	piecesRoot  []byte
+	baseLayer   int // 0 is the layer of 16 KiB blocks
+	index       int // First hash, a multiple of length
+	length      int // Number of hashes, a power of two
+	proofLayers int
+}
+
+// Size of the hashRequest fields on the wire
+const hashRequestSize = sha256.Size + 16
+
+func formatHashMessage(id messageID, r hashRequest, hashes merkleLayer) *message {
+	payload := make([]byte, hashRequestSize, hashRequestSize+len(hashes)*sha256.Size)
+	copy(payload, r.piecesRoot)
+	binary.BigEndian.PutUint32(payload[32:36], uint32(r.baseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(r.index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(r.length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(r.proofLayers))
+	for _, hash := range hashes {
+		payload = append(payload, hash[:]...)
+	}
+	return &message{ID: id, Payload: payload}
+}
+
+// Decode a hash request, hashes or hash reject message. Only hashes
+// messages carry hashes: the requested ones followed by the uncle hashes.
+func parseHashMessage(m *message) (hashRequest, merkleLayer, error) {
+	var r hashRequest
+	if m.ID != msgHashRequest && m.ID != msgHashes && m.ID != msgHashReject {
+		return r, nil, fmt.Errorf("expected a hash message, got %s", m.ID)
+	}
+	extra := len(m.Payload) - hashRequestSize
+	if extra < 0 || (m.ID != msgHashes && extra != 0) || extra%sha256.Size != 0 {
+		return r, nil, fmt.Errorf("%s payload of length %d", m.ID, len(m.Payload))
+	}
+	r.piecesRoot = m.Payload[:32]
+	r.baseLayer = int(binary.BigEndian.Uint32(m.Payload[32:36]))
+	r.index = int(binary.BigEndian.Uint32(m.Payload[36:40]))
+	r.length = int(binary.BigEndian.Uint32(m.Payload[40:44]))
+	r.proofLayers = int(binary.BigEndian.Uint32(m.Payload[44:48]))
+	hashes := make(merkleLayer, extra/sha256.Size)
+	for i := range hashes {
+		copy(hashes[i][:], m.Payload[hashRequestSize+i*sha256.Size:])
+	}
+	return r, hashes, nil
+}
+
+// Layer of a file's tree that holds the piece hashes, counted from the
+// blocks
+func (v *v2Info) pieceLayerIndex() int {
+	return log2(v.pieceLength / merkleBlockSize)
+}
+
+// Check that a request or answer fits the piece layer of file f, and return
+// the height of the tree above that layer
+func (v *v2Info) checkHashRequest(f *v2File, r hashRequest) (int, error) {
+	width := nextPowerOfTwo(f.numPieces(v.pieceLength))
+	if r.baseLayer != v.pieceLayerIndex() {
+		return 0, fmt.Errorf("hashes of layer %d requested, only the piece layer is kept", r.baseLayer)
+	}
+	if r.length < 2 || r.length > maxHashRequestLength || r.length&(r.length-1) != 0 {
+		return 0, fmt.Errorf("hash request for %d hashes", r.length)
+	}
+	if r.index%r.length != 0 || r.index+r.length > width {
+		return 0, fmt.Errorf("hash request for %d hashes at %d out of range", r.length, r.index)
+	}
+	return log2(width), nil
+}
+
+// Number of uncle hashes that prove a range of length hashes in a tree of
+// the given height, with proofLayers asked for
+func uncleCount(height, length, proofLayers int) int {
+	if proofLayers > height {
+		proofLayers = height
+	}
+	if n := proofLayers - log2(length); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// The hashes a peer asked for and their uncle hashes
+func (v *v2Info) answerHashRequest(r hashRequest) (merkleLayer, error) {
+	f := v.fileByRoot(r.piecesRoot)
+	if f == nil || f.layer == nil {
+		return nil, fmt.Errorf("no piece layer for pieces root %x", r.piecesRoot)
+	}
+	height, err := v.checkHashRequest(f, r)
+	if err != nil {
+		return nil, err
+	}
+	tree := merkleTree(f.layer, 1<<height, padHash(v.pieceLayerIndex()))
+	hashes := append(merkleLayer(nil), tree[height][r.index:r.index+r.length]...)
+	level, pos := height-log2(r.length), r.index/r.length
+	for i := 0; i < uncleCount(height, r.length, r.proofLayers); i++ {
+		hashes = append(hashes, tree[level][pos^1])
+		level, pos = level-1, pos/2
+	}
+	return hashes, nil
+}
+
+// Check the hashes a peer sent for part of f's piece layer against its
+// pieces root and copy them into layer, which covers the whole padded width
+func (v *v2Info) acceptHashes(f *v2File, r hashRequest, hashes merkleLayer, layer merkleLayer) error {
+	height, err := v.checkHashRequest(f, r)
+	if err != nil {
+		return err
+	}
+	uncles := uncleCount(height, r.length, r.proofLayers)
+	if len(hashes) != r.length+uncles || log2(r.length)+uncles != height {
+		return fmt.Errorf("%d hashes do not prove %d hashes up to the pieces root", len(hashes), r.length)
+	}
+	root := merkleRoot(hashes[:r.length], r.length, [sha256.Size]byte{})
+	pos := r.index / r.length
+	for _, uncle := range hashes[r.length:] {
+		if pos%2 == 0 {
+			root = hashPair(root, uncle)
+		} else {
+			root = hashPair(uncle, root)
+		}
+		pos /= 2
+	}
+	if !bytes.Equal(root[:], f.piecesRoot) {
+		return fmt.Errorf("hashes for %s do not match its pieces root", strings.Join(f.path, "/"))
+	}
+	copy(layer[r.index:], hashes[:r.length])
+	return nil
+}
+
+// Answer a peer's hash request from the piece layers we have, or reject it
+func (d *downloader) serveHashRequest(peer *peerConn, m *message) error {
+	r, _, err := parseHashMessage(m)
+	if err != nil {
+		return err
+	}
+	if d.torrent.v2 == nil {
+		return peer.send(formatHashMessage(msgHashReject, r, nil))
+	}
+	hashes, err := d.torrent.v2.answerHashRequest(r)
+	if err != nil {
+		return peer.send(formatHashMessage(msgHashReject, r, nil))
+	}
+	return peer.send(formatHashMessage(msgHashes, r, hashes))
+}
+
+// The requests that cover the piece layer of f, each proven up to the
+// pieces root
+func (v *v2Info) layerRequests(f *v2File) []hashRequest {
+	width := nextPowerOfTwo(f.numPieces(v.pieceLength))
+	length := width
+	if length > maxHashRequestLength {
+		length = maxHashRequestLength
+	}
+	var requests []hashRequest
+	for index := 0; index < f.numPieces(v.pieceLength); index += length {
+		requests = append(requests, hashRequest{
+			piecesRoot:  f.piecesRoot,
+			baseLayer:   v.pieceLayerIndex(),
+			index:       index,
+			length:      length,
+			proofLayers: log2(width),
+		})
+	}
+	return requests
+}
+
+// Fetch the missing piece layers of a v2 or hybrid torrent from its peers,
+// trying one peer after another until every layer is known
+func fetchPieceLayers(torrent TorrentFile, infoHash []byte, peerID string, peers []string) error {
+	var lastErr error
+	for _, address := range peers {
+		if len(torrent.v2.missingLayers()) == 0 {
+			return nil
+		}
+		err := fetchPieceLayersFrom(address, torrent.v2, infoHash, peerID)
+		if err != nil {
+			fmt.Printf("Error fetching piece layers from %s: %v\n", address, err)
+			lastErr = err
+		}
+	}
+	if len(torrent.v2.missingLayers()) == 0 {
+		return nil
+	}
+	return fmt.Errorf("could not fetch the piece layers from any peer, last error: %v", lastErr)
+}
+
+// Ask one peer for every missing piece layer. Layers are kept only once
+// all their hashes have arrived and checked out.
+func fetchPieceLayersFrom(address string, v2 *v2Info, infoHash []byte, peerID string) error {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(peerReadTimeout))
+
+	_, err = conn.Write(offerV2(createHandshake(hex.EncodeToString(infoHash), peerID)))
+	if err != nil {
+		return err
+	}
+	response := make([]byte, 68)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return fmt.Errorf("error reading handshake: %v", err)
+	}
+	_, err = checkHandshake(response, infoHash, peerID)
+	if err != nil {
+		return err
+	}
+	if !supportsV2(response) {
+		return fmt.Errorf("peer does not support BitTorrent v2")
+	}
+
+	// Hashes collected so far per file, and the requests not answered yet
+	type chunk struct {
+		file  *v2File
+		index int
+	}
+	layers := make(map[*v2File]merkleLayer)
+	remaining := make(map[*v2File]int)
+	outstanding := make(map[chunk]bool)
+	for _, f := range v2.missingLayers() {
+		layers[f] = make(merkleLayer, nextPowerOfTwo(f.numPieces(v2.pieceLength)))
+		for _, r := range v2.layerRequests(f) {
+			_, err = conn.Write(formatHashMessage(msgHashRequest, r, nil).serialize())
+			if err != nil {
+				return err
+			}
+			outstanding[chunk{f, r.index}] = true
+			remaining[f]++
+		}
+	}
+
+	for len(outstanding) > 0 {
+		m, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		if m == nil || (m.ID != msgHashes && m.ID != msgHashReject) {
+			continue // Only the answers matter here
+		}
+		r, hashes, err := parseHashMessage(m)
+		if err != nil {
+			return err
+		}
+		f := v2.fileByRoot(r.piecesRoot)
+		if f == nil || !outstanding[chunk{f, r.index}] {
+			continue // Not something we asked for
+		}
+		if m.ID == msgHashReject {
+			return fmt.Errorf("peer rejected the hash request for %s", strings.Join(f.path, "/"))
+		}
+		err = v2.acceptHashes(f, r, hashes, layers[f])
+		if err != nil {
+			return err
+		}
+		delete(outstanding, chunk{f, r.index})
+		remaining[f]--
+		if remaining[f] == 0 {
+			f.layer = layers[f][:f.numPieces(v2.pieceLength)]
+		}
+	}
+	return nil
+}
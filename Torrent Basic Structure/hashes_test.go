@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+)
+
+// A v2 torrent of one file with pieces piece layer hashes of 16 KiB pieces
+func makeLayerTorrent(pieces int) (*v2Info, *v2File) {
+	v := &v2Info{pieceLength: merkleBlockSize}
+	f := &v2File{path: []string{"big.bin"}, length: int64(pieces) * merkleBlockSize}
+	for i := 0; i < pieces; i++ {
+		f.layer = append(f.layer, sha256.Sum256([]byte{byte(i), byte(i >> 8)}))
+	}
+	root := v.layerRoot(f, f.layer)
+	f.piecesRoot = root[:]
+	v.files = []*v2File{f}
+	return v, f
+}
+
+func TestHashMessages(t *testing.T) {
+	r := hashRequest{piecesRoot: bytes.Repeat([]byte{7}, 32), baseLayer: 1, index: 8, length: 4, proofLayers: 3}
+	hashes := merkleLayer{sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))}
+	var buf bytes.Buffer
+	buf.Write(formatHashMessage(msgHashes, r, hashes).serialize())
+	m, err := readMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, gotHashes, err := parseHashMessage(m)
+	if err != nil || !reflect.DeepEqual(got, r) || !reflect.DeepEqual(gotHashes, hashes) {
+		t.Fatalf("parsed %+v %x: %v", got, gotHashes, err)
+	}
+
+	// Requests and rejects carry no hashes
+	for _, bad := range []*message{
+		{ID: msgHashRequest, Payload: formatHashMessage(msgHashes, r, hashes).Payload},
+		{ID: msgHashes, Payload: make([]byte, hashRequestSize+5)},
+		{ID: msgHashReject, Payload: make([]byte, 20)},
+		{ID: msgRequest, Payload: make([]byte, hashRequestSize)},
+	} {
+		if _, _, err := parseHashMessage(bad); err == nil {
+			t.Errorf("%s of %d bytes accepted", bad.ID, len(bad.Payload))
+		}
+	}
+}
+
+// The piece layer travels in chunks of at most 512 hashes, each proven up to
+// the pieces root by its uncle hashes
+func TestPieceLayerExchange(t *testing.T) {
+	seeder, file := makeLayerTorrent(1000)
+	leecher, missing := makeLayerTorrent(1000)
+	missing.layer = nil
+
+	requests := leecher.layerRequests(missing)
+	if len(requests) != 2 || requests[1].index != 512 || requests[1].proofLayers != 10 {
+		t.Fatalf("requests %+v", requests)
+	}
+	layer := make(merkleLayer, 1024)
+	for _, r := range requests {
+		hashes, err := seeder.answerHashRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hashes) != 512+1 {
+			t.Fatalf("%d hashes in the answer", len(hashes))
+		}
+		err = leecher.acceptHashes(missing, r, hashes, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(layer[:1000], file.layer) {
+		t.Fatal("piece layer differs after the exchange")
+	}
+
+	// A small chunk needs an uncle for every layer above it
+	r := hashRequest{piecesRoot: file.piecesRoot, index: 4, length: 4, proofLayers: 10}
+	hashes, err := seeder.answerHashRequest(r)
+	if err != nil || len(hashes) != 4+8 {
+		t.Fatalf("%d hashes: %v", len(hashes), err)
+	}
+	if err = leecher.acceptHashes(missing, r, hashes, layer); err != nil {
+		t.Fatal(err)
+	}
+	hashes[5][0] ^= 1
+	if leecher.acceptHashes(missing, r, hashes, layer) == nil {
+		t.Fatal("wrong uncle hash accepted")
+	}
+	if leecher.acceptHashes(missing, r, hashes[:11], layer) == nil {
+		t.Fatal("answer without its last uncle accepted")
+	}
+
+	for _, bad := range []hashRequest{
+		{piecesRoot: file.piecesRoot, index: 0, length: 1024, proofLayers: 10},
+		{piecesRoot: file.piecesRoot, index: 2, length: 4, proofLayers: 10},
+		{piecesRoot: file.piecesRoot, index: 1024, length: 2, proofLayers: 10},
+		{piecesRoot: file.piecesRoot, index: 0, length: 6, proofLayers: 10},
+		{piecesRoot: file.piecesRoot, baseLayer: 1, index: 0, length: 2, proofLayers: 10},
+		{piecesRoot: make([]byte, 32), index: 0, length: 2, proofLayers: 10},
+	} {
+		if _, err := seeder.answerHashRequest(bad); err == nil {
+			t.Errorf("request %+v answered", bad)
+		}
+	}
+}
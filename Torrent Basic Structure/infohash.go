@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+
+	"bittorrent-client/bencode"
+)
+
+// Find the info dictionary of a .torrent file and return its bytes exactly as
+// they appear in the file. The info hash is the SHA-1 of these bytes; encoding
+// the decoded Info struct again would drop keys it doesn't model (private,
+// source, md5sum, name.utf-8, ...) and reorder keys that weren't sorted.
+func rawInfoDict(data []byte) ([]byte, error) {
+	var torrent struct {
+		Info bencode.RawMessage `bencode:"info"`
+	}
+	err := bencode.Unmarshal(data, &torrent)
+	if err != nil {
+		return nil, err
+	}
+	if torrent.Info == nil {
+		return nil, fmt.Errorf("torrent has no info dictionary")
+	}
+	if torrent.Info[0] != 'd' {
+		return nil, fmt.Errorf("info is not a dictionary")
+	}
+	return torrent.Info, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bittorrent-client/bencode"
+)
+
+// Torrents in testdata and their info hashes, computed independently of this
+// code. The sample was made by mktorrent 1.1, and its info hash is the one
+// the CodeCrafters BitTorrent course publishes for it. The others are
+// hand-built and carry info keys TorrentFile doesn't model.
+var infoHashCorpus = []struct {
+	file     string
+	name     string
+	infoHash string
+}{
+	{"sample.torrent", "sample.txt", "d69f91e6b2ae4c542468d1073a71d4ea13879a7f"},
+	{"private.torrent", "private.iso", "1444a22a414e198be07c7f06b8ded400ce3cc6de"}, // private, source
+	{"multifile.torrent", "Café", "d110523ae44c7f616240003e4231c2e8257850f9"},      // name.utf-8, md5sum, path.utf-8
+	{"unsorted.torrent", "odd.bin", "e1036653120123d3df069a0353f701587bbf1dfb"},    // Unsorted keys, vendor key
+}
+
+func TestInfoHashFromRawBytes(t *testing.T) {
+	for _, c := range infoHashCorpus {
+		torrent, infoHash, err := openTorrent(filepath.Join("testdata", c.file))
+		if err != nil {
+			t.Errorf("%s: %v", c.file, err)
+			continue
+		}
+		if hex.EncodeToString(infoHash) != c.infoHash {
+			t.Errorf("%s: info hash %x, want %s", c.file, infoHash, c.infoHash)
+		}
+		if torrent.Info.Name != c.name || torrent.numPieces() != len(torrent.Info.Pieces)/20 {
+			t.Errorf("%s: decoded name %q", c.file, torrent.Info.Name)
+		}
+		// Peers fetching the metadata get the same bytes
+		metadata := torrentMetadata(torrent, c.infoHash)
+		if sum := sha1.Sum(metadata); hex.EncodeToString(sum[:]) != c.infoHash {
+			t.Errorf("%s: served metadata does not match the info hash", c.file)
+		}
+		if c.file == "private.torrent" {
+			var encoded bytes.Buffer
+			bencode.NewEncoder(&encoded).Encode(torrent.Info)
+			if sum := sha1.Sum(encoded.Bytes()); hex.EncodeToString(sum[:]) == c.infoHash {
+				t.Error("encoding the Info struct again kept the source key; the corpus no longer tests anything")
+			}
+		}
+	}
+}
+
+// Torrents made by real tools with testdata/tools/make.sh, checked against
+// the info hashes the tools report
+func TestInfoHashOfToolTorrents(t *testing.T) {
+	list, err := os.ReadFile(filepath.Join("testdata", "tools", "hashes.txt"))
+	if os.IsNotExist(err) {
+		t.Skip("no torrents made by tools; run testdata/tools/make.sh")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(list)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("bad line %q in hashes.txt", line)
+		}
+		_, infoHash, err := openTorrent(filepath.Join("testdata", "tools", fields[1]))
+		if err != nil {
+			t.Errorf("%s: %v", fields[1], err)
+			continue
+		}
+		if hex.EncodeToString(infoHash) != strings.ToLower(fields[0]) {
+			t.Errorf("%s: info hash %x, the tool reports %s", fields[1], infoHash, fields[0])
+		}
+	}
+}
+
+func TestRawInfoDictErrors(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"li1ee",
+		"d8:announce3:urle",                    // No info
+		"d4:infoli1eee",                        // Info is a list
+		"d4:infod4:name",                       // Truncated
+		"d4:infod4:name99:xee",                 // String runs past the end
+		"d4:infod4:sizei1x2eee",                // Bad integer
+		"di1e4:infod4:name1:xee",               // Integer key
+		"d4:infod4:name1:x1:yq1:zee",           // Unknown value type
+		"d4:infod1:" + string(make([]byte, 2)), // Bad key length
+	} {
+		info, err := rawInfoDict([]byte(data))
+		if err == nil {
+			t.Errorf("%q gave info %q", data, info)
+		}
+	}
+
+	info, err := rawInfoDict([]byte("d1:ad1:bi1ee4:infod4:name1:xe1:zi2ee"))
+	if err != nil || string(info) != "d4:name1:xe" {
+		t.Fatalf("got info %q: %v", info, err)
+	}
+}
+
+// Torrents whose sizes and piece hashes don't fit together are refused
+// before anything divides by the piece length or slices the hashes
+func TestOpenTorrentBadLayout(t *testing.T) {
+	dir := t.TempDir()
+	for name, info := range map[string]string{
+		"truncated": "d6:lengthi40000e4:name1:x12:piece lengthi16384e6:pieces40:" + string(make([]byte, 40)) + "e",
+		"zero":      "d6:lengthi40000e4:name1:x12:piece lengthi0e6:pieces60:" + string(make([]byte, 60)) + "e",
+		"ragged":    "d6:lengthi40000e4:name1:x12:piece lengthi16384e6:pieces59:" + string(make([]byte, 59)) + "e",
+		"negative":  "d6:lengthi-1e4:name1:x12:piece lengthi16384e6:pieces0:e",
+	} {
+		path := filepath.Join(dir, name+".torrent")
+		os.WriteFile(path, []byte("d8:announce3:url4:info"+info+"e"), 0644)
+		if _, _, err := openTorrent(path); err == nil {
+			t.Errorf("%s: opened", name)
+		}
+		if _, err := torrentFromMetadata([]byte(info)); err == nil {
+			t.Errorf("%s: accepted as metadata", name)
+		}
+	}
+}
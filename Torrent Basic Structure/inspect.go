@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What --info shows about a torrent, in text or as JSON
+type torrentSummary struct {
+	Name           string        `json:"name"`
+	InfoHash       string        `json:"info_hash"`
+	InfoHashBase32 string        `json:"info_hash_base32"`
+	InfoHashV2     string        `json:"info_hash_v2,omitempty"` // SHA-256 of v2 and hybrid torrents
+	TotalSize      int64         `json:"total_size"`
+	PieceLength    int           `json:"piece_length"`
+	Pieces         int           `json:"pieces"`
+	Private        bool          `json:"private"`
+	Files          []summaryFile `json:"files"`
+	Trackers       [][]string    `json:"trackers"`
+	WebSeeds       []string      `json:"web_seeds,omitempty"`
+	Comment        string        `json:"comment,omitempty"`
+	CreatedBy      string        `json:"created_by,omitempty"`
+	CreationDate   int64         `json:"creation_date,omitempty"`
+	Magnet         string        `json:"magnet"`
+}
+
+// A file of the torrent; Path is relative to the download directory and
+// starts with the torrent's name
+type summaryFile struct {
+	Path   []string `json:"path"`
+	Length int64    `json:"length"`
+}
+
+func summarizeTorrent(torrent TorrentFile, infoHash []byte) torrentSummary {
+	s := torrentSummary{
+		Name:           torrent.Info.Name,
+		InfoHash:       hex.EncodeToString(infoHash),
+		InfoHashBase32: base32.StdEncoding.EncodeToString(infoHash),
+		TotalSize:      int64(torrent.dataLength()),
+		PieceLength:    torrent.Info.PieceLength,
+		Pieces:         torrent.numPieces(),
+		Private:        torrent.Info.Private == 1,
+		Trackers:       [][]string{},
+		WebSeeds:       torrent.webSeeds(),
+		Comment:        torrent.Comment,
+		CreatedBy:      torrent.CreatedBy,
+		CreationDate:   torrent.CreationDate,
+	}
+	if len(torrent.Info.Files) == 0 {
+		s.Files = []summaryFile{{Path: []string{torrent.Info.Name}, Length: int64(torrent.Info.Length)}}
+	}
+	for _, f := range torrent.Info.Files {
+		if f.isPadding() {
+			continue
+		}
+		path := append([]string{torrent.Info.Name}, f.Path...)
+		s.Files = append(s.Files, summaryFile{Path: path, Length: int64(f.Length)})
+	}
+
+	// Tiers in the torrent's own order; announcing shuffles them
+	for _, tier := range torrent.AnnounceList {
+		if len(tier) > 0 {
+			s.Trackers = append(s.Trackers, tier)
+		}
+	}
+	if len(s.Trackers) == 0 && torrent.Announce != "" {
+		s.Trackers = [][]string{{torrent.Announce}}
+	}
+
+	link := magnetLink{infoHash: infoHash, name: torrent.Info.Name}
+	if torrent.v2 != nil {
+		s.InfoHashV2 = hex.EncodeToString(torrent.v2.infoHash[:])
+		link.v2Hash = torrent.v2.infoHash[:]
+	}
+	for _, tier := range s.Trackers {
+		link.trackers = append(link.trackers, tier...)
+	}
+	s.Magnet = link.String()
+	return s
+}
+
+// Print the summary for people to read, files as an indented tree
+func (s torrentSummary) print() {
+	fmt.Printf("Name: %s\n", s.Name)
+	fmt.Printf("Info Hash: %s (base32 %s)\n", s.InfoHash, s.InfoHashBase32)
+	if s.InfoHashV2 != "" {
+		fmt.Printf("Info Hash v2: %s\n", s.InfoHashV2)
+	}
+	fmt.Printf("Size: %s (%d bytes)\n", formatBytes(s.TotalSize), s.TotalSize)
+	fmt.Printf("Pieces: %d of %s\n", s.Pieces, formatBytes(int64(s.PieceLength)))
+	if s.Private {
+		fmt.Println("Private: yes")
+	}
+	if s.Comment != "" {
+		fmt.Printf("Comment: %s\n", s.Comment)
+	}
+	if s.CreatedBy != "" {
+		fmt.Printf("Created By: %s\n", s.CreatedBy)
+	}
+	if s.CreationDate != 0 {
+		fmt.Printf("Created: %s\n", time.Unix(s.CreationDate, 0).UTC().Format(time.RFC3339))
+	}
+
+	fmt.Println("Files:")
+	var dir []string
+	for _, f := range s.Files {
+		// Print the directories this file is in that the previous one wasn't
+		common := 0
+		for common < len(dir) && common < len(f.Path)-1 && dir[common] == f.Path[common] {
+			common++
+		}
+		for i := common; i < len(f.Path)-1; i++ {
+			fmt.Printf("%s%s/\n", strings.Repeat("  ", i+1), f.Path[i])
+		}
+		dir = f.Path[:len(f.Path)-1]
+		fmt.Printf("%s%s (%s)\n", strings.Repeat("  ", len(f.Path)), f.Path[len(f.Path)-1], formatBytes(f.Length))
+	}
+
+	if len(s.Trackers) > 0 {
+		fmt.Println("Trackers:")
+		for i, tier := range s.Trackers {
+			fmt.Printf("  Tier %d: %s\n", i+1, strings.Join(tier, ", "))
+		}
+	}
+	if len(s.WebSeeds) > 0 {
+		fmt.Println("Web Seeds:")
+		for _, u := range s.WebSeeds {
+			fmt.Printf("  %s\n", u)
+		}
+	}
+	fmt.Printf("Magnet: %s\n", s.Magnet)
+}
+
+// Format a byte count with a binary unit, such as 1.5 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Show what a .torrent file describes
+func runInfo(filePath string, asJSON bool) {
+	torrent, infoHashSum, err := openTorrent(filePath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	summary := summarizeTorrent(torrent, infoHashSum)
+	if !asJSON {
+		summary.print()
+		return
+	}
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// Point the torrent at data stored under path. A single-file torrent's data
+// is path itself, or the file of the torrent's name inside the directory
+// path; a multi-file torrent's directory is path, whatever it is called.
+// Returns the torrent with its name adjusted and the directory to lay it out
+// in.
+func localLayout(torrent TorrentFile, path string) (TorrentFile, string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return torrent, "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return torrent, "", err
+	}
+	if len(torrent.Info.Files) == 0 && info.IsDir() {
+		return torrent, path, nil
+	}
+	if len(torrent.Info.Files) > 0 && !info.IsDir() {
+		return torrent, "", fmt.Errorf("%s is not a directory, but the torrent has several files", path)
+	}
+	torrent.Info.Name = filepath.Base(path)
+	return torrent, filepath.Dir(path), nil
+}
+
+// Check the data at path against the torrent's piece hashes, reporting
+// missing and wrongly sized files and the pieces that don't match. Returns
+// whether all the data is there and correct.
+func runVerify(filePath string, dataPath string) bool {
+	torrent, _, err := openTorrent(filePath)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	local, baseDir, err := localLayout(torrent, dataPath)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	files, err := local.fileLayout(baseDir)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	ok := true
+	for _, f := range files {
+		if f.padding {
+			continue
+		}
+		info, err := os.Stat(f.path)
+		if err != nil {
+			fmt.Printf("%s: missing\n", f.path)
+			ok = false
+		} else if info.Size() != f.length {
+			fmt.Printf("%s: %d bytes, want %d\n", f.path, info.Size(), f.length)
+			ok = false
+		}
+	}
+
+	storage, err := openFileStorage(local, baseDir)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	have := recheckPieces(local, storage)
+	storage.Close()
+
+	numPieces := torrent.numPieces()
+	var bad []int
+	for i := 0; i < numPieces; i++ {
+		if !have.HasPiece(i) {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) > 0 {
+		fmt.Printf("Bad pieces (%d): %s\n", len(bad), formatPieceRanges(bad))
+	}
+	fmt.Printf("%d/%d pieces verified\n", numPieces-len(bad), numPieces)
+	return ok && len(bad) == 0
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSummarizeTorrent(t *testing.T) {
+	torrent, infoHash, err := openTorrent(filepath.Join("testdata", "multifile.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := summarizeTorrent(torrent, infoHash)
+	if s.InfoHash != "d110523ae44c7f616240003e4231c2e8257850f9" || s.InfoHashBase32 != "2EIFEOXEJR7WCYSAAA7EEMOC5ASXQUHZ" {
+		t.Fatalf("info hash %s %s", s.InfoHash, s.InfoHashBase32)
+	}
+	if s.TotalSize != 40000 || s.Pieces != torrent.numPieces() || s.CreationDate != 1600000000 {
+		t.Fatalf("summary %+v", s)
+	}
+	want := []summaryFile{{[]string{"Café", "a.txt"}, 30000}, {[]string{"Café", "sub", "b.txt"}, 10000}}
+	if !reflect.DeepEqual(s.Files, want) {
+		t.Fatalf("files %+v", s.Files)
+	}
+	trackers := [][]string{{"udp://tracker.example:1337/announce"}, {"http://backup.example/announce"}}
+	if !reflect.DeepEqual(s.Trackers, trackers) {
+		t.Fatalf("trackers %q", s.Trackers)
+	}
+
+	// The magnet link leads back to the same torrent
+	link, err := parseMagnet(s.Magnet)
+	if err != nil || !bytes.Equal(link.infoHash, infoHash) || link.name != "Café" || len(link.trackers) != 2 {
+		t.Fatalf("magnet %s parsed as %+v: %v", s.Magnet, link, err)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded torrentSummary
+	json.Unmarshal(data, &decoded)
+	if !reflect.DeepEqual(decoded, s) {
+		t.Fatalf("JSON %s", data)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:             "0 B",
+		1023:          "1023 B",
+		1024:          "1.0 KiB",
+		1536:          "1.5 KiB",
+		32 << 20:      "32.0 MiB",
+		5 << 40:       "5.0 TiB",
+		1<<62 + 1<<61: "6.0 EiB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("%d: got %s, want %s", n, got, want)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "a.bin"), randomData(50000), 0644)
+	os.WriteFile(filepath.Join(root, "sub", "b.bin"), randomData(30000), 0644)
+	torrent, err := createTorrent(root, createOptions{pieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentPath := filepath.Join(dir, "data.torrent")
+	saveTorrent(torrent, torrentPath)
+
+	// The directory may have been renamed since
+	renamed := filepath.Join(dir, "renamed")
+	os.Rename(root, renamed)
+	if !runVerify(torrentPath, renamed) {
+		t.Fatal("intact data failed to verify")
+	}
+
+	file, _ := os.OpenFile(filepath.Join(renamed, "sub", "b.bin"), os.O_WRONLY, 0)
+	file.WriteAt([]byte{0}, 100)
+	file.Close()
+	if runVerify(torrentPath, renamed) {
+		t.Fatal("corrupt data verified")
+	}
+	os.Remove(filepath.Join(renamed, "sub", "b.bin"))
+	if runVerify(torrentPath, renamed) {
+		t.Fatal("missing file verified")
+	}
+	if runVerify(torrentPath, filepath.Join(renamed, "a.bin")) {
+		t.Fatal("a single file verified as a multi-file torrent")
+	}
+
+	// Single-file torrents take the file or the directory it is in
+	data := randomData(40000)
+	single := filepath.Join(dir, "one.iso")
+	os.WriteFile(single, data, 0644)
+	torrent, err = createTorrent(single, createOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveTorrent(torrent, torrentPath)
+	if !runVerify(torrentPath, single) || !runVerify(torrentPath, dir) {
+		t.Fatal("single file failed to verify")
+	}
+	os.WriteFile(single, append(data, 0), 0644)
+	if runVerify(torrentPath, single) {
+		t.Fatal("file with extra data verified")
+	}
+}
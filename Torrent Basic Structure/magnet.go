@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// magnetLink holds the parts of a magnet URI we use (BEP 9)
+type magnetLink struct {
+	infoHash []byte   // From xt=urn:btih:, or the truncated v2 info hash
+	v2Hash   []byte   // From xt=urn:btmh:, the SHA-256 of a v2 or hybrid torrent
+	name     string   // dn, display name only
+	trackers []string // tr
+	peers    []string // x.pe, host:port
+}
+
+func isMagnetLink(source string) bool {
+	return strings.HasPrefix(strings.ToLower(source), "magnet:")
+}
+
+// Parse a magnet URI. The info hash may be hex or base32 encoded.
+func parseMagnet(uri string) (magnetLink, error) {
+	var link magnetLink
+	start := strings.Index(uri, "?")
+	if !isMagnetLink(uri) || start < 0 {
+		return link, fmt.Errorf("not a magnet link")
+	}
+	query, err := url.ParseQuery(uri[start+1:])
+	if err != nil {
+		return link, fmt.Errorf("invalid magnet link: %v", err)
+	}
+
+	for _, xt := range query["xt"] {
+		if strings.HasPrefix(strings.ToLower(xt), "urn:btmh:") {
+			// A multihash: 0x12 for SHA-256, 0x20 for its length
+			multihash, err := hex.DecodeString(xt[len("urn:btmh:"):])
+			if err != nil || len(multihash) != 34 || multihash[0] != 0x12 || multihash[1] != 0x20 {
+				return link, fmt.Errorf("invalid v2 info hash in magnet link")
+			}
+			link.v2Hash = multihash[2:]
+			continue
+		}
+		if !strings.HasPrefix(strings.ToLower(xt), "urn:btih:") || link.infoHash != nil {
+			continue
+		}
+		encoded := xt[len("urn:btih:"):]
+		switch len(encoded) {
+		case 40:
+			link.infoHash, err = hex.DecodeString(encoded)
+		case 32:
+			link.infoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+		default:
+			err = fmt.Errorf("info hash of length %d", len(encoded))
+		}
+		if err != nil {
+			return link, fmt.Errorf("invalid info hash in magnet link: %v", err)
+		}
+	}
+	// Pure v2 torrents are known to the swarm by the truncated v2 hash
+	if link.infoHash == nil && link.v2Hash != nil {
+		link.infoHash = link.v2Hash[:20]
+	}
+	if link.infoHash == nil {
+		return link, fmt.Errorf("magnet link has no urn:btih or urn:btmh info hash")
+	}
+
+	link.name = query.Get("dn")
+	link.trackers = query["tr"]
+	for _, address := range query["x.pe"] {
+		_, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return link, fmt.Errorf("invalid peer address %q in magnet link: %v", address, err)
+		}
+		link.peers = append(link.peers, address)
+	}
+	return link, nil
+}
+
+// Format the link as a magnet URI, the info hashes in hex. Pure v2 links
+// have only the btmh hash.
+func (link magnetLink) String() string {
+	var xt []string
+	if link.v2Hash == nil || !bytes.Equal(link.infoHash, link.v2Hash[:20]) {
+		xt = append(xt, "xt=urn:btih:"+hex.EncodeToString(link.infoHash))
+	}
+	if link.v2Hash != nil {
+		xt = append(xt, "xt=urn:btmh:1220"+hex.EncodeToString(link.v2Hash))
+	}
+	uri := "magnet:?" + strings.Join(xt, "&")
+	if link.name != "" {
+		uri += "&dn=" + url.QueryEscape(link.name)
+	}
+	for _, tracker := range link.trackers {
+		uri += "&tr=" + url.QueryEscape(tracker)
+	}
+	for _, peer := range link.peers {
+		uri += "&x.pe=" + url.QueryEscape(peer)
+	}
+	return uri
+}
+
+// Resolve a magnet link into a torrent: find peers through its trackers, its
+// x.pe addresses and the DHT node, if there is one, then fetch the info
+// dictionary from them. The peers found are returned for the download.
+func openMagnet(uri string, peerID string, port int, node *dht) (TorrentFile, []byte, []string, error) {
+	var torrent TorrentFile
+	link, err := parseMagnet(uri)
+	if err != nil {
+		return torrent, nil, nil, err
+	}
+	fmt.Printf("Magnet link for %x %s\n", link.infoHash, link.name)
+
+	// Every tr parameter is a tier of its own
+	var tiers trackerTiers
+	for _, tracker := range link.trackers {
+		tiers = append(tiers, []string{tracker})
+	}
+	peers := link.peers
+	if len(tiers) > 0 {
+		// The size is unknown until we have the metadata
+		found, _, err := tiers.announce(announceParams{infoHash: link.infoHash, peerID: peerID, port: port, left: 1, foreground: true})
+		if err == nil {
+			peers = mergePeers(peers, found)
+		}
+	}
+	if node != nil {
+		found, err := node.getPeers(link.infoHash)
+		if err != nil {
+			fmt.Printf("Error looking up peers in the DHT: %v\n", err)
+		} else {
+			peers = mergePeers(peers, found)
+		}
+	}
+	if len(peers) == 0 {
+		return torrent, nil, nil, fmt.Errorf("no peers found for magnet link")
+	}
+
+	info, err := fetchMetadata(link.infoHash, peerID, peers)
+	if err != nil {
+		return torrent, nil, nil, err
+	}
+	torrent, err = torrentFromMetadata(info)
+	if err != nil {
+		return torrent, nil, nil, err
+	}
+	if link.v2Hash != nil && (torrent.v2 == nil || !bytes.Equal(torrent.v2.infoHash[:], link.v2Hash)) {
+		return torrent, nil, nil, fmt.Errorf("metadata does not match the v2 info hash")
+	}
+	if torrent.v2 != nil && len(torrent.v2.missingLayers()) > 0 {
+		err = fetchPieceLayers(torrent, link.infoHash, peerID, peers)
+		if err != nil && !torrent.v2.hybrid {
+			return torrent, nil, nil, err
+		}
+		if err != nil {
+			fmt.Printf("Checking pieces with v1 hashes only: %v\n", err)
+		}
+	}
+	if len(tiers) > 0 {
+		torrent.Announce = tiers[0][0]
+		torrent.AnnounceList = tiers
+	}
+	return torrent, link.infoHash, peers, nil
+}
+
+// Open a .torrent file or resolve a magnet link. Peers already known for the
+// torrent, from the magnet link, are returned as well, along with the DHT
+// node the download should use, or nil. Private torrents are shared through
+// their trackers only (BEP 27), so the DHT is not started for them; a magnet
+// link needs it to find the metadata, so its node is closed again once the
+// torrent turns out to be private.
+func openTorrentSource(source string, peerID string, config downloadConfig) (TorrentFile, []byte, []string, *dht, error) {
+	if !isMagnetLink(source) {
+		torrent, infoHash, err := openTorrent(source)
+		if err != nil {
+			return TorrentFile{}, nil, nil, nil, err
+		}
+		var node *dht
+		if !torrent.isPrivate() {
+			node = startDHT(config)
+		}
+		return torrent, infoHash, nil, node, nil
+	}
+
+	node := startDHT(config)
+	torrent, infoHash, peers, err := openMagnet(source, peerID, config.listenPort, node)
+	if node != nil && (err != nil || torrent.isPrivate()) {
+		node.close()
+		node = nil
+	}
+	return torrent, infoHash, peers, node, err
+}
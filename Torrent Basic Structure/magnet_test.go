@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bittorrent-client/bencode"
+)
+
+func TestParseMagnet(t *testing.T) {
+	link, err := parseMagnet("magnet:?xt=urn:btih:00112233445566778899AABBCCDDEEFF00112233&dn=Some+File" +
+		"&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Ftracker.example%3A6969" +
+		"&x.pe=10.0.0.1%3A6881&x.pe=%5B2001%3Adb8%3A%3A1%5D%3A51413")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(link.infoHash); got != "\x00\x11\x22\x33\x44\x55\x66\x77\x88\x99\xaa\xbb\xcc\xdd\xee\xff\x00\x11\x22\x33" {
+		t.Errorf("info hash = %x", link.infoHash)
+	}
+	if link.name != "Some File" {
+		t.Errorf("name = %q", link.name)
+	}
+	if len(link.trackers) != 2 || link.trackers[0] != "http://tracker.example/announce" || link.trackers[1] != "udp://tracker.example:6969" {
+		t.Errorf("trackers = %q", link.trackers)
+	}
+	if len(link.peers) != 2 || link.peers[0] != "10.0.0.1:6881" || link.peers[1] != "[2001:db8::1]:51413" {
+		t.Errorf("peers = %q", link.peers)
+	}
+
+	// Base32 info hashes from older clients
+	link, err = parseMagnet("magnet:?xt=urn:btih:AAIREM2EKVTHPCEZVK54ZXPO74ABCIZT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(link.infoHash) != 20 || link.infoHash[19] != 0x33 {
+		t.Errorf("base32 info hash = %x", link.infoHash)
+	}
+
+	// v2 links carry the SHA-256 multihash, alone or next to the v1 hash
+	v2Hex := "1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+	link, err = parseMagnet("magnet:?xt=urn:btmh:" + v2Hex + "&dn=v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("1220%x", link.v2Hash) != v2Hex || !bytes.Equal(link.infoHash, link.v2Hash[:20]) {
+		t.Errorf("v2 hashes = %x %x", link.v2Hash, link.infoHash)
+	}
+	if s := link.String(); strings.Contains(s, "btih") || !strings.Contains(s, "urn:btmh:"+v2Hex) {
+		t.Errorf("v2 link written as %s", s)
+	}
+	link, err = parseMagnet("magnet:?xt=urn:btih:00112233445566778899aabbccddeeff00112233&xt=urn:btmh:" + v2Hex)
+	if err != nil || link.infoHash[0] != 0x00 || len(link.v2Hash) != 32 {
+		t.Errorf("hybrid link parsed as %x %x: %v", link.infoHash, link.v2Hash, err)
+	}
+
+	for _, bad := range []string{
+		"magnet:?xt=urn:btmh:1114caf1e1c30e81cb361b9ee167c4aa64228a7f",
+		"http://example.com/file.torrent",
+		"magnet:?dn=nothing",
+		"magnet:?xt=urn:btih:0011",
+		"magnet:?xt=urn:btih:00112233445566778899aabbccddeeff00112233&x.pe=nohost",
+	} {
+		_, err := parseMagnet(bad)
+		if err == nil {
+			t.Errorf("parseMagnet(%q) succeeded", bad)
+		}
+	}
+}
+
+// Serve info over ut_metadata to every connection; corrupt flips a byte
+func startMetadataPeer(t *testing.T, infoHash []byte, info []byte, corrupt bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	served := append([]byte(nil), info...)
+	if corrupt {
+		served[len(served)/2] ^= 0xff
+	}
+	const theirID = 3
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handshake := make([]byte, 68)
+				_, err := io.ReadFull(conn, handshake)
+				if err != nil {
+					return
+				}
+				handshake[25] |= 0x10
+				copy(handshake[48:], newPeerID()) // Answer with a peer ID of our own
+				conn.Write(handshake)
+
+				var ext bytes.Buffer
+				bencode.NewEncoder(&ext).Encode(extendedHandshake{M: map[string]int{"ut_metadata": theirID}, MetadataSize: len(served)})
+				conn.Write(formatExtended(0, ext.Bytes()).serialize())
+				clientID := 0
+				for {
+					m, err := readMessage(conn)
+					if err != nil {
+						return
+					}
+					if m == nil || m.ID != msgExtended {
+						continue
+					}
+					if m.Payload[0] == 0 {
+						var client extendedHandshake
+						unmarshalPrefix(m.Payload[1:], &client)
+						clientID = client.M["ut_metadata"]
+						continue
+					}
+					if m.Payload[0] != theirID {
+						continue
+					}
+					var request metadataMessage
+					_, err = unmarshalPrefix(m.Payload[1:], &request)
+					if err != nil {
+						return
+					}
+					begin := request.Piece * metadataPieceSize
+					end := begin + metadataPieceSize
+					if end > len(served) {
+						end = len(served)
+					}
+					var reply bytes.Buffer
+					bencode.NewEncoder(&reply).Encode(metadataMessage{MsgType: metadataData, Piece: request.Piece, TotalSize: len(served)})
+					reply.Write(served[begin:end])
+					conn.Write(formatExtended(byte(clientID), reply.Bytes()).serialize())
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestFetchMetadata(t *testing.T) {
+	// Enough pieces for an info dictionary spanning three metadata pieces
+	data := randomData(2000 * 16)
+	torrent := makeTestTorrent("magnet.bin", data, 16)
+	var info bytes.Buffer
+	err := bencode.NewEncoder(&info).Encode(torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Len() <= 2*metadataPieceSize {
+		t.Fatalf("info dictionary is only %d bytes", info.Len())
+	}
+	hash := sha1.Sum(info.Bytes())
+
+	bad := startMetadataPeer(t, hash[:], info.Bytes(), true)
+	good := startMetadataPeer(t, hash[:], info.Bytes(), false)
+
+	_, err = fetchMetadata(hash[:], newPeerID(), []string{bad})
+	if err == nil {
+		t.Fatal("metadata that does not match the info hash was accepted")
+	}
+
+	got, err := fetchMetadata(hash[:], newPeerID(), []string{bad, good})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, info.Bytes()) {
+		t.Fatal("fetched metadata does not match")
+	}
+	fetched, err := torrentFromMetadata(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Info.Name != "magnet.bin" || fetched.numPieces() != 2000 || fetched.Info.Pieces != torrent.Info.Pieces {
+		t.Fatal("torrent built from metadata does not match")
+	}
+}
+
+// A magnet download from one of our own seeders: the metadata comes over
+// ut_metadata, then the pieces as usual
+func TestMagnetDownloadFromSeeder(t *testing.T) {
+	data := randomData(6*32768 + 100)
+	torrent := makeTestTorrent("magnet-seed.bin", data, 32768)
+	var info bytes.Buffer
+	err := bencode.NewEncoder(&info).Encode(torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha1.Sum(info.Bytes())
+	infoHashHex := fmt.Sprintf("%x", hash)
+
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	seedConfig := testDownloadConfig(t.TempDir())
+	seedConfig.listenPort = port
+	seedConfig.seedRatio = 1.0
+	seedConfig.seedTime = 10 * time.Second
+	err = os.WriteFile(filepath.Join(seedConfig.outputDir, "magnet-seed.bin"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeded := make(chan error, 1)
+	go func() {
+		seeded <- downloadTorrent(torrent, infoHashHex, "-PC0001-SEEDER000000", nil, seedConfig, nil)
+	}()
+
+	uri := fmt.Sprintf("magnet:?xt=urn:btih:%s&dn=magnet-seed.bin&x.pe=127.0.0.1%%3A%d", infoHashHex, port)
+	var fetched TorrentFile
+	var infoHash []byte
+	var peers []string
+	start := time.Now()
+	for {
+		fetched, infoHash, peers, err = openMagnet(uri, "-PC0001-LEECHER00000", 0, nil)
+		if err == nil || time.Since(start) > 5*time.Second {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Info.Pieces != torrent.Info.Pieces {
+		t.Fatal("metadata from the seeder does not match")
+	}
+
+	leechConfig := testDownloadConfig(t.TempDir())
+	err = downloadTorrent(fetched, fmt.Sprintf("%x", infoHash), "-PC0001-LEECHER00000", peers, leechConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(leechConfig.outputDir, "magnet-seed.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data does not match")
+	}
+	select {
+	case err := <-seeded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("seeder did not stop")
+	}
+}
+
+// The DHT is only started for public torrents: a private one neither binds
+// the DHT port nor contacts the bootstrap nodes
+func TestOpenTorrentSourceSkipsDHTWhenPrivate(t *testing.T) {
+	bootstrap, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bootstrap.Close()
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	dir := t.TempDir()
+	config := testDownloadConfig(dir)
+	config.dhtPort = port
+	config.bootstrapNodes = []string{bootstrap.LocalAddr().String()}
+
+	torrent := makeTestTorrent("private.bin", randomData(100), 32768)
+	torrent.Info.Private = 1
+	path := filepath.Join(dir, "private.torrent")
+	saveTorrent(torrent, path)
+	_, _, _, node, err := openTorrentSource(path, "-PC0001-123456789012", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != nil {
+		node.close()
+		t.Fatal("DHT started for a private torrent")
+	}
+	bootstrap.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := bootstrap.ReadFromUDP(make([]byte, 1500)); err == nil {
+		t.Fatal("bootstrap node contacted for a private torrent")
+	}
+
+	torrent.Info.Private = 0
+	saveTorrent(torrent, path)
+	_, _, _, node, err = openTorrentSource(path, "-PC0001-123456789012", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node == nil {
+		t.Fatal("no DHT for a public torrent")
+	}
+	node.close()
+	bootstrap.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := bootstrap.ReadFromUDP(make([]byte, 1500)); err != nil {
+		t.Fatalf("bootstrap node not contacted: %v", err)
+	}
+}
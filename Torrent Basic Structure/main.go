@@ -4,42 +4,178 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"flag"
 	"fmt"
-	"io"
 	// "math"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
-	"time"
+	"os/signal"
+	"strings"
+	"syscall"
 
-	"github.com/jackpal/bencode-go"
+	"bittorrent-client/bencode"
 )
 
 type TorrentFile struct {
-    Announce string `bencode:"announce"`
+    Announce     string      `bencode:"announce"`
+    AnnounceList [][]string  `bencode:"announce-list,omitempty"` // Tiers of backup trackers (BEP 12)
+    Comment      string      `bencode:"comment,omitempty"`
+    CreatedBy    string      `bencode:"created by,omitempty"`
+    CreationDate int64       `bencode:"creation date,omitempty"` // Unix time
+    URLList      interface{} `bencode:"url-list,omitempty"`      // Web seeds (BEP 19), a string or a list; see webSeeds
     Info     struct {
-        Name        string `bencode:"name"`
-        PieceLength int    `bencode:"piece length"`
-        Pieces      string `bencode:"pieces"`
-        Length      int    `bencode:"length,omitempty"`
-        Files       []struct {
-            Length int      `bencode:"length"`
-            Path   []string `bencode:"path"`
-        } `bencode:"files,omitempty"`
+        Name        string             `bencode:"name"`
+        PieceLength int                `bencode:"piece length"`
+        Pieces      string             `bencode:"pieces,omitempty"` // v1 SHA-1 hashes; absent in pure v2 torrents
+        Length      int                `bencode:"length,omitempty"`
+        Private     int                `bencode:"private,omitempty"` // 1 keeps peers to the trackers (BEP 27)
+        Files       []torrentFileEntry `bencode:"files,omitempty"`
+        MetaVersion int                `bencode:"meta version,omitempty"` // 2 for v2 and hybrid torrents (BEP 52)
+        FileTree    bencode.RawMessage `bencode:"file tree,omitempty"`    // v2 files; see setupV2
     } `bencode:"info"`
+    PieceLayers map[string]string `bencode:"piece layers,omitempty"` // v2 piece hashes by pieces root
+
+    // The info dictionary as it was read, which the info hash is computed
+    // from; nil for torrents built in memory
+    RawInfo []byte `bencode:"-"`
+
+    // Merkle trees of v2 and hybrid torrents, set up by setupV2
+    v2 *v2Info
+}
+
+// A file of a multi-file torrent
+type torrentFileEntry struct {
+    Length int      `bencode:"length"`
+    Path   []string `bencode:"path"`
+    Attr   string   `bencode:"attr,omitempty"` // "p" marks padding that aligns the next file (BEP 47)
+}
+
+// Padding files are all zeros and never stored on disk
+func (f torrentFileEntry) isPadding() bool {
+    return strings.Contains(f.Attr, "p")
 }
 
+// What a tracker answers to an announce. HTTP trackers send it bencoded;
+// see parseTrackerResponse for the peer lists.
 type TrackerResponse struct {
     FailureReason string `bencode:"failure reason"`
+    WarningReason string `bencode:"warning reason,omitempty"`
     Interval      int    `bencode:"interval"`
-    Peers         string `bencode:"peers"`
+    MinInterval   int    `bencode:"min interval"`
+    TrackerID     string `bencode:"tracker id,omitempty"` // Sent back with later announces
+    Complete      int    `bencode:"complete"`             // Seeders
+    Incomplete    int    `bencode:"incomplete"`           // Leechers
+    Peers         string `bencode:"peers"`                // Compact IPv4 peers
+    Peers6        string `bencode:"peers6,omitempty"`     // Compact IPv6 peers (BEP 7)
+}
+
+// Total number of bytes described by the torrent, for single and multi-file torrents
+func (t TorrentFile) totalLength() int {
+    if len(t.Info.Files) == 0 {
+        return t.Info.Length
+    }
+    total := 0
+    for _, f := range t.Info.Files {
+        total += f.Length
+    }
+    return total
+}
+
+// Bytes of file data in the torrent, leaving out padding files
+func (t TorrentFile) dataLength() int {
+    total := t.totalLength()
+    for _, f := range t.Info.Files {
+        if f.isPadding() {
+            total -= f.Length
+        }
+    }
+    return total
+}
+
+// Private torrents keep to their trackers: no DHT and no peer exchange (BEP 27)
+func (t TorrentFile) isPrivate() bool {
+    return t.Info.Private == 1
+}
+
+// Web seed URLs; url-list may hold a single URL or a list of them
+func (t TorrentFile) webSeeds() []string {
+    switch list := t.URLList.(type) {
+    case string:
+        return []string{list}
+    case []interface{}:
+        var urls []string
+        for _, u := range list {
+            if s, ok := u.(string); ok {
+                urls = append(urls, s)
+            }
+        }
+        return urls
+    case []string:
+        return list
+    }
+    return nil
+}
+
+// Check that the sizes and piece hashes fit together, so the piece
+// arithmetic can't divide by zero or slice past the hashes. v1 hashes are
+// required unless v2 ones replace them.
+func (t TorrentFile) validateLayout() error {
+    if t.Info.PieceLength <= 0 {
+        return fmt.Errorf("invalid piece length %d", t.Info.PieceLength)
+    }
+    if t.Info.Length < 0 {
+        return fmt.Errorf("invalid length %d", t.Info.Length)
+    }
+    for _, f := range t.Info.Files {
+        if f.Length < 0 {
+            return fmt.Errorf("invalid length %d of file %s", f.Length, strings.Join(f.Path, "/"))
+        }
+    }
+    if len(t.Info.Pieces)%20 != 0 {
+        return fmt.Errorf("piece hashes of %d bytes are not a multiple of 20", len(t.Info.Pieces))
+    }
+    if (t.Info.Pieces != "" || t.v2 == nil) && len(t.Info.Pieces)/20 != t.numPieces() {
+        return fmt.Errorf("%d piece hashes for %d pieces", len(t.Info.Pieces)/20, t.numPieces())
+    }
+    return nil
+}
+
+func (t TorrentFile) numPieces() int {
+    return (t.totalLength() + t.Info.PieceLength - 1) / t.Info.PieceLength
+}
+
+// Size of the piece at index; only the last piece can be shorter than PieceLength
+func (t TorrentFile) pieceSize(index int) int {
+    begin := index * t.Info.PieceLength
+    end := begin + t.Info.PieceLength
+    if end > t.totalLength() {
+        end = t.totalLength()
+    }
+    return end - begin
+}
+
+// Bytes of the piece at index that hold file data: its size without the
+// padding file it may end in, which is zeros and never requested from peers
+func (t TorrentFile) pieceDataSize(index int) int {
+    begin := index * t.Info.PieceLength
+    end := begin + t.pieceSize(index)
+    offset := 0
+    for _, f := range t.Info.Files {
+        if f.isPadding() && offset < end && offset+f.Length >= end {
+            if offset < begin {
+                return 0
+            }
+            return offset - begin
+        }
+        offset += f.Length
+    }
+    return end - begin
 }
 
 func createHandshake(infoHash, peerID string) []byte {
     pstrlen := byte(19)
     pstr := "BitTorrent protocol"
     reserved := make([]byte, 8)
+    reserved[5] |= 0x10 // We support the extension protocol (BEP 10)
     infoHashBytes, _ := hex.DecodeString(infoHash)
     peerIDBytes := []byte(peerID)
 
@@ -53,414 +189,256 @@ func createHandshake(infoHash, peerID string) []byte {
     return buf.Bytes()
 }
 
-func sendInterested(conn net.Conn) error {
-    interested := []byte{0, 0, 0, 1, 2} // Length prefix (4 bytes) + message ID (1 byte)
-    _, err := conn.Write(interested)
-    return err
-}
-
-func waitForUnchoke(conn net.Conn) error {
-    for {
-        lengthBuf := make([]byte, 4)
-        _, err := io.ReadFull(conn, lengthBuf)
-        if err != nil {
-            return err
-        }
-
-        length := int(lengthBuf[0])<<24 | int(lengthBuf[1])<<16 | int(lengthBuf[2])<<8 | int(lengthBuf[3])
-        if length == 0 {
-            continue // Keep-alive message
-        }
-
-        messageBuf := make([]byte, length)
-        _, err = io.ReadFull(conn, messageBuf)
-        if err != nil {
-            return err
-        }
-
-        messageID := messageBuf[0]
-        if messageID == 1 { // Unchoke message
-            return nil
-        }
+// Split a 68-byte handshake into the info hash and peer ID
+func parseHandshake(handshake []byte) ([]byte, []byte, error) {
+    if len(handshake) != 68 || handshake[0] != 19 || string(handshake[1:20]) != "BitTorrent protocol" {
+        return nil, nil, fmt.Errorf("invalid handshake")
     }
+    return handshake[28:48], handshake[48:68], nil
 }
 
-func sendHave(conn net.Conn, pieceIndex int) error {
-    have := make([]byte, 9)
-    have[0] = 0
-    have[1] = 0
-    have[2] = 0
-    have[3] = 5 // Length prefix (4 bytes)
-    have[4] = 4 // Message ID (1 byte)
-    have[5] = byte(pieceIndex >> 24)
-    have[6] = byte(pieceIndex >> 16)
-    have[7] = byte(pieceIndex >> 8)
-    have[8] = byte(pieceIndex)
-    _, err := conn.Write(have)
-    return err
-}
-
-func requestPiece(conn net.Conn, index, begin, length int) error {
-    request := make([]byte, 17)
-    request[0] = 0
-    request[1] = 0
-    request[2] = 0
-    request[3] = 13 // Length prefix (4 bytes)
-    request[4] = 6  // Message ID (1 byte)
-    request[5] = byte(index >> 24)
-    request[6] = byte(index >> 16)
-    request[7] = byte(index >> 8)
-    request[8] = byte(index)
-    request[9] = byte(begin >> 24)
-    request[10] = byte(begin >> 16)
-    request[11] = byte(begin >> 8)
-    request[12] = byte(begin)
-    request[13] = byte(length >> 24)
-    request[14] = byte(length >> 16)
-    request[15] = byte(length >> 8)
-    request[16] = byte(length)
-    _, err := conn.Write(request)
-    return err
-}
-
-func receivePiece(conn net.Conn, expectedLength int) ([]byte, error) {
-    header := make([]byte, 4+1+4+4) // Message length, ID, index, and begin
-    _, err := io.ReadFull(conn, header)
+// Check a peer's handshake: it must be for our info hash, and a peer ID equal
+// to ours means we dialed ourselves. Returns the peer's ID.
+func checkHandshake(handshake []byte, infoHash []byte, peerID string) ([]byte, error) {
+    theirHash, theirID, err := parseHandshake(handshake)
     if err != nil {
-        return nil, fmt.Errorf("error reading piece header: %w", err)
+        return nil, err
     }
-
-    // Extract message ID and ensure it is a "Piece" message (ID = 7)
-    if header[4] != 7 {
-        return nil, fmt.Errorf("unexpected message ID: %d", header[4])
+    if !bytes.Equal(theirHash, infoHash) {
+        return nil, fmt.Errorf("handshake for a different info hash %x", theirHash)
     }
-
-    // Read the piece data
-    piece := make([]byte, expectedLength)
-    _, err = io.ReadFull(conn, piece)
-    if err != nil {
-        return nil, fmt.Errorf("error reading piece data: %w", err)
+    if string(theirID) == peerID {
+        return nil, fmt.Errorf("connected to ourselves")
     }
-    fmt.Printf("Received piece length: %d, expected length: %d\n", len(piece), expectedLength)
-    return piece, nil
+    return theirID, nil
 }
 
-// func validatePiece(piece []byte, expectedHash []byte) bool {
-//     hash := sha1.Sum(piece)
-//     fmt.Printf("Expected hash: %x\n", expectedHash)
-//     fmt.Printf("Actual hash: %x\n", hash[:])
-//     return bytes.Equal(hash[:], expectedHash)
-// }
-
-// Define a struct to hold piece download results
-type pieceResult struct {
-    index int
-    data  []byte
-    err   error
+// Report whether the sender of a handshake supports the extension protocol
+func supportsExtensions(handshake []byte) bool {
+    return len(handshake) == 68 && handshake[25]&0x10 != 0
 }
 
-func handlePeerConnection(address, infoHash, peerID string, torrent TorrentFile, resultChan chan<- pieceResult, pieceQueue <-chan int) {
-    conn, err := net.DialTimeout("tcp", address, 5*time.Second)
-    if err != nil {
-        fmt.Printf("Error connecting to peer %s: %v\n", address, err)
-        return
-    }
-    defer conn.Close()
-
-    handshake := createHandshake(infoHash, peerID)
-    _, err = conn.Write(handshake)
-    if err != nil {
-        fmt.Printf("Error sending handshake to peer %s: %v\n", address, err)
-        return
-    }
-
-    response := make([]byte, 68)
-    _, err = io.ReadFull(conn, response)
-    if err != nil {
-        fmt.Printf("Error reading handshake response from peer %s: %v\n", address, err)
-        return
-    }
+// Mark a handshake as coming from a client that speaks BitTorrent v2, so
+// peers may send us hash requests (BEP 52)
+func offerV2(handshake []byte) []byte {
+    handshake[27] |= 0x10
+    return handshake
+}
 
-    fmt.Printf("Received handshake response from peer %s\n", address)
+// Report whether the sender of a handshake supports BitTorrent v2
+func supportsV2(handshake []byte) bool {
+    return len(handshake) == 68 && handshake[27]&0x10 != 0
+}
 
-    // Send Interested message
-    err = sendInterested(conn)
-    if err != nil {
-        fmt.Printf("Error sending Interested message to peer %s: %v\n", address, err)
-        return
+// Check a piece against its SHA-1 hash from the torrent, and against its
+// file's merkle tree for v2 and hybrid torrents
+func validatePiece(torrent TorrentFile, index int, piece []byte) bool {
+    if torrent.v2 != nil && !torrent.v2.validatePiece(index, piece) {
+        return false
     }
-
-    // Wait for Unchoke message
-    err = waitForUnchoke(conn)
-    if err != nil {
-        fmt.Printf("Error waiting for Unchoke message from peer %s: %v\n", address, err)
-        return
+    if torrent.Info.Pieces == "" {
+        return torrent.v2 != nil
     }
+    hash := sha1.Sum(piece)
+    expectedHash := []byte(torrent.Info.Pieces[index*20 : (index+1)*20])
+    return bytes.Equal(hash[:], expectedHash)
+}
 
-    fmt.Printf("Peer %s unchoked us\n", address)
-
-    // Download pieces assigned to this connection
-    for pieceIndex := range pieceQueue {
-        pieceLength := torrent.Info.PieceLength
-        fileLength := torrent.Info.Length
-        numPieces := (fileLength + pieceLength - 1) / pieceLength
-        blockSize := 1 << 14 // 16 KB
-
-        var pieceBuffer []byte // Buffer to store concatenated blocks for this piece
+func main() {
+    if len(os.Args) > 1 && os.Args[1] == "--cli" {
+        // CLI mode
+        cliFlags := flag.NewFlagSet("cli", flag.ExitOnError)
+        config := defaultDownloadConfig()
+        pickerName := cliFlags.String("picker", pickerRarest, "piece selection strategy: rarest, sequential or random-first")
+        cliFlags.IntVar(&config.pipelineDepth, "pipeline", config.pipelineDepth, "block requests kept outstanding per peer")
+        cliFlags.IntVar(&config.listenPort, "port", config.listenPort, "port to accept incoming peers on (0 disables)")
+        cliFlags.Float64Var(&config.seedRatio, "seed-ratio", config.seedRatio, "keep seeding until this share ratio (0 for no ratio limit)")
+        cliFlags.DurationVar(&config.seedTime, "seed-time", config.seedTime, "keep seeding for at most this long (0 for no time limit)")
+        cliFlags.IntVar(&config.dhtPort, "dht-port", config.dhtPort, "UDP port for the DHT node (0 disables the DHT)")
+        bootstrap := cliFlags.String("dht-bootstrap", strings.Join(config.bootstrapNodes, ","), "comma-separated DHT nodes to join through")
+        cliFlags.StringVar(&config.dhtStatePath, "dht-state", config.dhtStatePath, "file the DHT routing table is kept in between runs")
+        cliFlags.Parse(os.Args[2:])
+        if cliFlags.NArg() < 1 || config.pipelineDepth < 1 || config.listenPort < 0 || config.seedRatio < 0 || config.seedTime < 0 || config.dhtPort < 0 {
+            fmt.Println("Usage: main --cli [--picker rarest|sequential|random-first] [--pipeline N] [--port N] [--seed-ratio R] [--seed-time D] [--dht-port N] [--dht-bootstrap host:port,...] [--dht-state FILE] <path to .torrent file or magnet link>")
+            return
+        }
+        config.bootstrapNodes = nil
+        if *bootstrap != "" {
+            config.bootstrapNodes = strings.Split(*bootstrap, ",")
+        }
         
-        currentPieceLength := pieceLength
-        if pieceIndex == numPieces-1 { // Last piece
-            currentPieceLength = torrent.Info.Length % pieceLength
-            if currentPieceLength == 0 { // If the file is a perfect multiple of pieceLength
-                currentPieceLength = pieceLength
-            }
+        picker, err := newPiecePicker(*pickerName)
+        if err != nil {
+            fmt.Println(err)
+            return
         }
-        fmt.Printf("[Peer %s] Downloading piece %d, length %d\n", address, pieceIndex, currentPieceLength)
+        config.picker = picker
         
-        for begin := 0; begin < currentPieceLength; begin += blockSize {
-            length := blockSize
-            if begin+length > currentPieceLength {
-                length = currentPieceLength - begin // Handle last block
-            }
-    
-            // Request the block from the peer
-            err = requestPiece(conn, pieceIndex, begin, length)
-            if err != nil {
-                fmt.Printf("[Peer %s] Error requesting block at piece %d, offset %d: %v\n", address, pieceIndex, begin, err)
-                resultChan <- pieceResult{index: pieceIndex, data: nil, err: err}
-                return
-            }
-    
-            // Receive the block from the peer
-            block, err := receivePiece(conn, length)
-            if err != nil {
-                fmt.Printf("[Peer %s] Error receiving block at piece %d, offset %d: %v\n", address, pieceIndex, begin, err)
-                resultChan <- pieceResult{index: pieceIndex, data: nil, err: err}
-                return
-            }
-    
-            // Append the block to the piece buffer
-            pieceBuffer = append(pieceBuffer, block...)
+        source := cliFlags.Arg(0)
+        runCLI(source, config)
+    } else if len(os.Args) > 1 && os.Args[1] == "--recheck" {
+        // Verify previously downloaded data
+        if len(os.Args) < 3 {
+            fmt.Println("Usage: main --recheck <path to .torrent file>")
+            return
         }
-    
-        // All blocks for the piece received, calculate SHA-1 hash
-        computedHash := sha1.Sum(pieceBuffer)
-        expectedHash := []byte(torrent.Info.Pieces[pieceIndex*20 : (pieceIndex+1)*20])
-    
-        // Validate the piece
-        if bytes.Equal(computedHash[:], expectedHash) {
-            fmt.Printf("[Peer %s] Piece %d validated successfully\n", address, pieceIndex)
-            resultChan <- pieceResult{index: pieceIndex, data: pieceBuffer, err: nil}
-            err = sendHave(conn, pieceIndex)
-            if err != nil {
-                fmt.Printf("[Peer %s] Error sending Have message for piece %d: %v\n", address, pieceIndex, err)
-            }
-        } else {
-            fmt.Printf("[Peer %s] Piece %d validation failed\n", address, pieceIndex)
-            resultChan <- pieceResult{index: pieceIndex, data: nil, err: fmt.Errorf("piece validation failed")}
+        
+        runRecheck(os.Args[2])
+    } else if len(os.Args) > 1 && os.Args[1] == "--scrape" {
+        // Show the swarm's size as the trackers see it
+        if len(os.Args) < 3 {
+            fmt.Println("Usage: main --scrape <path to .torrent file>")
+            return
         }
-    }
-}
 
-// Download torrent using multiple peers in parallel
-func downloadTorrent(torrent TorrentFile, infoHashHex string, peerID string, peers []string) error {
-    pieceLength := torrent.Info.PieceLength
-    fileLength := torrent.Info.Length
-    numPieces := (fileLength + pieceLength - 1) / pieceLength
-    
-    // Create channels for work distribution and result collection
-    resultChan := make(chan pieceResult)
-    pieceQueues := make([]chan int, len(peers))
-    
-    // Create a slice to store the pieces
-    pieces := make([][]byte, numPieces)
-    
-    // Create a map to track which pieces are being downloaded
-    inProgress := make(map[int]bool)
-    
-    // Create a slice to track which pieces need to be downloaded
-    var pendingPieces []int
-    for i := 0; i < numPieces; i++ {
-        pendingPieces = append(pendingPieces, i)
-    }
-    
-    // Start a goroutine for each peer
-    for i, peer := range peers {
-        pieceQueues[i] = make(chan int, 5) // Buffer for 5 pieces
-        go handlePeerConnection(peer, infoHashHex, peerID, torrent, resultChan, pieceQueues[i])
-    }
-    
-    // Start a goroutine to distribute work
-    go func() {
-        for len(pendingPieces) > 0 || len(inProgress) > 0 {
-            // Assign pending pieces to available peers
-            for _, queue := range pieceQueues {
-                if len(pendingPieces) == 0 {
-                    break
-                }
-                
-                select {
-                case queue <- pendingPieces[0]:
-                    inProgress[pendingPieces[0]] = true
-                    pendingPieces = pendingPieces[1:]
-                default:
-                    // Queue is full, try next peer
-                    continue
-                }
-            }
-            
-            // Wait for results
-            result := <-resultChan
-            delete(inProgress, result.index)
-            
-            if result.err != nil {
-                // If a piece failed, put it back in the pending list
-                pendingPieces = append(pendingPieces, result.index)
-                fmt.Printf("Piece %d failed, re-queuing\n", result.index)
-            } else {
-                // Store the successful piece
-                pieces[result.index] = result.data
-                fmt.Printf("Piece %d downloaded successfully (%d/%d)\n", 
-                    result.index, numPieces-len(pendingPieces)-len(inProgress), numPieces)
-            }
+        runScrape(os.Args[2])
+    } else if len(os.Args) > 1 && os.Args[1] == "--create" {
+        // Make a .torrent from local data
+        createFlags := flag.NewFlagSet("create", flag.ExitOnError)
+        var opts createOptions
+        var trackers, webSeeds repeatedFlag
+        createFlags.Var(&trackers, "announce", "tracker URL; repeat for more tiers, separate backup trackers of one tier with commas")
+        createFlags.Var(&webSeeds, "web-seed", "URL the data can also be downloaded from (repeatable)")
+        createFlags.StringVar(&opts.comment, "comment", "", "free-form comment")
+        createFlags.BoolVar(&opts.private, "private", false, "mark the torrent private (BEP 27)")
+        createFlags.IntVar(&opts.pieceLength, "piece-length", 0, "piece length in bytes, a power of two (0 picks one from the size)")
+        output := createFlags.String("o", "", "file to write (default <name>.torrent)")
+        createFlags.Parse(os.Args[2:])
+        if createFlags.NArg() < 1 || opts.pieceLength < 0 {
+            fmt.Println("Usage: main --create [--announce URL[,URL...]]... [--web-seed URL]... [--comment TEXT] [--private] [--piece-length N] [-o FILE] <file or directory>")
+            return
         }
-        
-        // Close all piece queues when done
-        for _, queue := range pieceQueues {
-            close(queue)
+        for _, tier := range trackers {
+            opts.trackers = append(opts.trackers, strings.Split(tier, ","))
         }
-    }()
-    
-    // Wait for all pieces to be downloaded
-    for i := 0; i < numPieces; i++ {
-        if pieces[i] == nil {
-            i--
-            time.Sleep(100 * time.Millisecond)
+        opts.webSeeds = webSeeds
+
+        runCreate(createFlags.Arg(0), *output, opts)
+    } else if len(os.Args) > 1 && os.Args[1] == "--info" {
+        // Describe a .torrent file
+        infoFlags := flag.NewFlagSet("info", flag.ExitOnError)
+        asJSON := infoFlags.Bool("json", false, "print the description as JSON")
+        infoFlags.Parse(os.Args[2:])
+        if infoFlags.NArg() < 1 {
+            fmt.Println("Usage: main --info [--json] <path to .torrent file>")
+            return
         }
-    }
-    
-    // Write the pieces to a file
-    outputFile, err := os.Create(torrent.Info.Name)
-    if err != nil {
-        return fmt.Errorf("error creating output file: %v", err)
-    }
-    defer outputFile.Close()
-    
-    for _, piece := range pieces {
-        if piece != nil {
-            _, err = outputFile.Write(piece)
-            if err != nil {
-                return fmt.Errorf("error writing piece to file: %v", err)
-            }
+
+        runInfo(infoFlags.Arg(0), *asJSON)
+    } else if len(os.Args) > 1 && os.Args[1] == "--verify" {
+        // Check local data against the piece hashes; exits with status 1 on
+        // any mismatch so scripts can rely on it
+        if len(os.Args) < 4 {
+            fmt.Println("Usage: main --verify <path to .torrent file> <path to the data>")
+            os.Exit(2)
         }
-    }
-    
-    fmt.Printf("File %s downloaded successfully\n", torrent.Info.Name)
-    return nil
-}
 
-func main() {
-    if len(os.Args) > 1 && os.Args[1] == "--cli" {
-        // CLI mode
-        if len(os.Args) < 3 {
-            fmt.Println("Usage: main --cli <path to .torrent file>")
-            return
+        if !runVerify(os.Args[2], os.Args[3]) {
+            os.Exit(1)
         }
-        
-        filePath := os.Args[2]
-        runCLI(filePath)
     } else {
         // GUI mode
         LaunchGUI()
     }
 }
 
-func runCLI(filePath string) {
-    // Original CLI code
-    file, err := os.Open(filePath)
+// Read a .torrent file and compute its info hash
+func openTorrent(filePath string) (TorrentFile, []byte, error) {
+    var torrent TorrentFile
+    data, err := os.ReadFile(filePath)
     if err != nil {
-        fmt.Printf("Error opening file: %v\n", err)
-        return
+        return torrent, nil, fmt.Errorf("error opening file: %v", err)
     }
-    defer file.Close()
 
-    var torrent TorrentFile
-    err = bencode.Unmarshal(file, &torrent)
+    err = bencode.Unmarshal(data, &torrent)
     if err != nil {
-        fmt.Printf("Error unmarshalling file: %v\n", err)
-        return
+        return torrent, nil, fmt.Errorf("error unmarshalling file: %v", err)
     }
 
-    fmt.Print("\n")
-    fmt.Print("Torrent Info: ", torrent.Info, "\n")
-    fmt.Print("\n\n")
-    fmt.Print("Torrent Announce: ", torrent.Announce, "\n")
-    fmt.Print("Torrent piecelength: ",torrent.Info.PieceLength, "\n")
-    fmt.Print("Torrent length: ",torrent.Info.Length, "\n")
-    fmt.Print("Torrent Announce: ", torrent.Info.Pieces, "\n")
-    fmt.Print("\n\n")
-
-    // Generate info_hash
-    infoHash := sha1.New()
-    err = bencode.Marshal(infoHash, torrent.Info)
+    // Generate info_hash from the info dictionary's original bytes
+    torrent.RawInfo, err = rawInfoDict(data)
     if err != nil {
-        fmt.Printf("Error generating info_hash: %v\n", err)
-        return
+        return torrent, nil, fmt.Errorf("error generating info_hash: %v", err)
     }
-    infoHashSum := infoHash.Sum(nil)
-    infoHashHex := hex.EncodeToString(infoHashSum)
-    fmt.Print("Info Hash: ", infoHashHex, "\n")
-
-
-    // Construct the tracker URL
-    params := url.Values{
-        "info_hash":  {string(infoHashSum)},
-        "peer_id":    {"-PC0001-123456789012"},
-        "port":       {"6881"},
-        "uploaded":   {"0"},
-        "downloaded": {"0"},
-        "left":       {fmt.Sprintf("%d", torrent.Info.Length)},
-        "compact":    {"1"},
+    if torrent.Info.MetaVersion != 0 {
+        err = setupV2(&torrent)
+        if err != nil {
+            return torrent, nil, err
+        }
+        if missing := torrent.v2.missingLayers(); len(missing) > 0 {
+            return torrent, nil, fmt.Errorf("torrent has no piece layer for %s", strings.Join(missing[0].path, "/"))
+        }
     }
-    trackerURL := fmt.Sprintf("%s?%s", torrent.Announce, params.Encode())
-
-    // Send GET request to the tracker
-    resp, err := http.Get(trackerURL)
+    err = torrent.validateLayout()
     if err != nil {
-        fmt.Printf("Error sending GET request: %v\n", err)
-        return
+        return torrent, nil, fmt.Errorf("torrent has an invalid piece layout: %v", err)
     }
-    defer resp.Body.Close()
+    return torrent, torrent.swarmInfoHash(), nil
+}
 
-    var trackerResp TrackerResponse
-    err = bencode.Unmarshal(resp.Body, &trackerResp)
-    if err != nil {
-        fmt.Printf("Error unmarshalling tracker response: %v\n", err)
-        return
+// Info hash used in handshakes, with trackers and in the DHT: the SHA-1 of
+// the info dictionary, or for pure v2 torrents its SHA-256 truncated to 20
+// bytes. Hybrid torrents can be joined with either; we use the v1 one.
+func (t TorrentFile) swarmInfoHash() []byte {
+    if t.v2 != nil && !t.v2.hybrid {
+        return t.v2.infoHash[:20]
     }
+    infoHash := sha1.Sum(t.RawInfo)
+    return infoHash[:]
+}
 
-    if trackerResp.FailureReason != "" {
-        fmt.Printf("Tracker error: %s\n", trackerResp.FailureReason)
+func runCLI(source string, config downloadConfig) {
+    peerID := newPeerID()
+    torrent, infoHashSum, peerAddresses, node, err := openTorrentSource(source, peerID, config)
+    if err != nil {
+        fmt.Println(err)
         return
     }
+    if node != nil {
+        defer node.close()
+        config.dht = node
+    }
 
-    fmt.Printf("Tracker response interval: %d seconds\n", trackerResp.Interval)
+    fmt.Print("\n")
+    summarizeTorrent(torrent, infoHashSum).print()
+    fmt.Print("\n")
 
-    // Process peers
-    var peerAddresses []string
-    peers := []byte(trackerResp.Peers)
-    for i := 0; i < len(peers); i += 6 {
-        ip := fmt.Sprintf("%d.%d.%d.%d", peers[i], peers[i+1], peers[i+2], peers[i+3])
-        port := int(peers[i+4])<<8 + int(peers[i+5])
-        address := fmt.Sprintf("%s:%d", ip, port)
+    infoHashHex := hex.EncodeToString(infoHashSum)
+
+    // The trackers are announced to by the download itself. Magnet links
+    // without trackers rely on the peers they listed and the DHT.
+    config.trackers = newTrackerSession(torrent, infoHashSum, peerID, config.listenPort)
+    if node != nil {
+        found, err := node.announce(infoHashSum, config.listenPort)
+        if err != nil {
+            fmt.Printf("Error announcing to the DHT: %v\n", err)
+        } else {
+            fmt.Printf("Found %d peers in the DHT\n", len(found))
+            peerAddresses = mergePeers(peerAddresses, found)
+        }
+    }
+    for _, address := range peerAddresses {
         fmt.Printf("Peer: %s\n", address)
-        peerAddresses = append(peerAddresses, address)
     }
 
+    // Ctrl-C ends the download cleanly, so the trackers hear stopped; a
+    // second one quits at once
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+    defer signal.Stop(signals)
+    interrupt := make(chan struct{})
+    go func() {
+        <-signals
+        signal.Stop(signals)
+        fmt.Println("\nStopping, press Ctrl-C again to quit at once")
+        close(interrupt)
+    }()
+    config.interrupt = interrupt
+
     // Download the torrent using multiple peers in parallel
-    err = downloadTorrent(torrent, infoHashHex, "-PC0001-123456789012", peerAddresses)
+    err = downloadTorrent(torrent, infoHashHex, peerID, peerAddresses, config, nil)
     if err != nil {
         fmt.Printf("Error downloading torrent: %v\n", err)
         return
     }
-}
\ No newline at end of file
+}
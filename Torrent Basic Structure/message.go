@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type messageID uint8
+
+// Peer wire message IDs from BEP 3
+const (
+	msgChoke         messageID = 0
+	msgUnchoke       messageID = 1
+	msgInterested    messageID = 2
+	msgNotInterested messageID = 3
+	msgHave          messageID = 4
+	msgBitfield      messageID = 5
+	msgRequest       messageID = 6
+	msgPiece         messageID = 7
+	msgCancel        messageID = 8
+
+	// Extension protocol message from BEP 10; the first payload byte is
+	// the extended message ID, 0 being the extended handshake
+	msgExtended messageID = 20
+
+	// Merkle hash exchange of BitTorrent v2 (BEP 52); see hashes.go
+	msgHashRequest messageID = 21
+	msgHashes      messageID = 22
+	msgHashReject  messageID = 23
+)
+
+// Largest message we accept: a 16 KiB block plus headers, with plenty of room
+// for the bitfield of a torrent with many pieces
+const maxMessageLength = 1 << 20
+
+func (id messageID) String() string {
+	switch id {
+	case msgChoke:
+		return "choke"
+	case msgUnchoke:
+		return "unchoke"
+	case msgInterested:
+		return "interested"
+	case msgNotInterested:
+		return "not interested"
+	case msgHave:
+		return "have"
+	case msgBitfield:
+		return "bitfield"
+	case msgRequest:
+		return "request"
+	case msgPiece:
+		return "piece"
+	case msgCancel:
+		return "cancel"
+	case msgExtended:
+		return "extended"
+	case msgHashRequest:
+		return "hash request"
+	case msgHashes:
+		return "hashes"
+	case msgHashReject:
+		return "hash reject"
+	}
+	return fmt.Sprintf("unknown (%d)", uint8(id))
+}
+
+// A length-prefixed peer wire message. A nil *message is a keep-alive.
+type message struct {
+	ID      messageID
+	Payload []byte
+}
+
+// Encode the message with its 4-byte length prefix
+func (m *message) serialize() []byte {
+	if m == nil {
+		return make([]byte, 4)
+	}
+	buf := make([]byte, 4+1+len(m.Payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(m.Payload)))
+	buf[4] = byte(m.ID)
+	copy(buf[5:], m.Payload)
+	return buf
+}
+
+// Read one message from the stream; keep-alives are returned as nil
+func readMessage(r io.Reader) (*message, error) {
+	lengthBuf := make([]byte, 4)
+	_, err := io.ReadFull(r, lengthBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBuf)
+	if length == 0 {
+		return nil, nil // Keep-alive message
+	}
+	if length > maxMessageLength {
+		return nil, fmt.Errorf("message length %d exceeds limit", length)
+	}
+
+	messageBuf := make([]byte, length)
+	_, err = io.ReadFull(r, messageBuf)
+	if err != nil {
+		return nil, err
+	}
+	return &message{ID: messageID(messageBuf[0]), Payload: messageBuf[1:]}, nil
+}
+
+func formatHave(index int) *message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &message{ID: msgHave, Payload: payload}
+}
+
+func formatRequest(index, begin, length int) *message {
+	return &message{ID: msgRequest, Payload: blockPayload(index, begin, length)}
+}
+
+func formatCancel(index, begin, length int) *message {
+	return &message{ID: msgCancel, Payload: blockPayload(index, begin, length)}
+}
+
+func formatPiece(index, begin int, block []byte) *message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &message{ID: msgPiece, Payload: payload}
+}
+
+// Payload shared by request and cancel messages
+func blockPayload(index, begin, length int) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return payload
+}
+
+func parseHave(m *message) (int, error) {
+	if m.ID != msgHave {
+		return 0, fmt.Errorf("expected have, got %s", m.ID)
+	}
+	if len(m.Payload) != 4 {
+		return 0, fmt.Errorf("have payload of length %d", len(m.Payload))
+	}
+	return int(binary.BigEndian.Uint32(m.Payload)), nil
+}
+
+// Decode a request or cancel message
+func parseRequest(m *message) (index, begin, length int, err error) {
+	if m.ID != msgRequest && m.ID != msgCancel {
+		return 0, 0, 0, fmt.Errorf("expected request or cancel, got %s", m.ID)
+	}
+	if len(m.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("%s payload of length %d", m.ID, len(m.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(m.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+func parsePiece(m *message) (index, begin int, block []byte, err error) {
+	if m.ID != msgPiece {
+		return 0, 0, nil, fmt.Errorf("expected piece, got %s", m.ID)
+	}
+	if len(m.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("piece payload of length %d", len(m.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	return index, begin, m.Payload[8:], nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	for _, m := range []*message{
+		nil,
+		{ID: msgChoke},
+		{ID: msgUnchoke},
+		{ID: msgInterested},
+		{ID: msgNotInterested},
+		formatHave(7),
+		{ID: msgBitfield, Payload: []byte{0xa0}},
+		formatRequest(1, 16384, 16384),
+		formatPiece(1, 16384, []byte("block")),
+		formatCancel(1, 16384, 16384),
+		{ID: msgExtended, Payload: []byte{0, 'd', 'e'}},
+	} {
+		got, err := readMessage(bytes.NewReader(m.serialize()))
+		if err != nil || (got == nil) != (m == nil) || got != nil && (got.ID != m.ID || !bytes.Equal(got.Payload, m.Payload)) {
+			t.Errorf("%v read back as %v: %v", m, got, err)
+		}
+	}
+
+	lengthOnly := func(length uint32) []byte {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, length)
+		return buf
+	}
+	for _, test := range []struct {
+		name   string
+		stream []byte
+	}{
+		{"empty stream", nil},
+		{"truncated length", []byte{0, 0}},
+		{"truncated payload", formatRequest(1, 2, 3).serialize()[:10]},
+		{"missing ID", lengthOnly(1)},
+		{"oversized length", lengthOnly(maxMessageLength + 1)},
+		{"length past 2 GiB", lengthOnly(1 << 31)},
+	} {
+		if m, err := readMessage(bytes.NewReader(test.stream)); err == nil {
+			t.Errorf("%s: read %v", test.name, m)
+		}
+	}
+
+	// The largest message allowed still reads
+	big := append(lengthOnly(maxMessageLength), make([]byte, maxMessageLength)...)
+	big[4] = byte(msgBitfield)
+	m, err := readMessage(bytes.NewReader(big))
+	if err != nil || len(m.Payload) != maxMessageLength-1 {
+		t.Fatalf("message of the maximum length: %v", err)
+	}
+	_, err = readMessage(bytes.NewReader(nil))
+	if err != io.EOF {
+		t.Errorf("end of stream read as %v", err)
+	}
+}
+
+func TestParseMessages(t *testing.T) {
+	index, err := parseHave(formatHave(1 << 20))
+	if err != nil || index != 1<<20 {
+		t.Errorf("have parsed as %d: %v", index, err)
+	}
+	index, begin, length, err := parseRequest(formatCancel(3, 16384, 100))
+	if err != nil || index != 3 || begin != 16384 || length != 100 {
+		t.Errorf("cancel parsed as %d %d %d: %v", index, begin, length, err)
+	}
+	index, begin, block, err := parsePiece(formatPiece(2, 32, nil))
+	if err != nil || index != 2 || begin != 32 || len(block) != 0 {
+		t.Errorf("empty piece parsed as %d %d %q: %v", index, begin, block, err)
+	}
+
+	for _, m := range []*message{
+		{ID: msgHave, Payload: []byte{0, 0, 1}},
+		{ID: msgHave, Payload: []byte{0, 0, 0, 1, 0}},
+		{ID: msgRequest, Payload: formatHave(1).Payload},
+	} {
+		if _, err := parseHave(m); err == nil {
+			t.Errorf("have from %s of %d bytes accepted", m.ID, len(m.Payload))
+		}
+	}
+	for _, m := range []*message{
+		{ID: msgRequest, Payload: make([]byte, 11)},
+		{ID: msgCancel, Payload: make([]byte, 13)},
+		{ID: msgPiece, Payload: make([]byte, 12)},
+	} {
+		if _, _, _, err := parseRequest(m); err == nil {
+			t.Errorf("request from %s of %d bytes accepted", m.ID, len(m.Payload))
+		}
+	}
+	for _, m := range []*message{
+		{ID: msgPiece, Payload: make([]byte, 7)},
+		{ID: msgPiece},
+		{ID: msgRequest, Payload: make([]byte, 12)},
+	} {
+		if _, _, _, err := parsePiece(m); err == nil {
+			t.Errorf("piece from %s of %d bytes accepted", m.ID, len(m.Payload))
+		}
+	}
+}
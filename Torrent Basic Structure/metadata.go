@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"bittorrent-client/bencode"
+)
+
+// Metadata is exchanged in 16 KiB pieces (BEP 9)
+const metadataPieceSize = 16 << 10
+
+// Largest info dictionary we are willing to fetch
+const maxMetadataSize = 8 << 20
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// Dictionary at the start of every ut_metadata message; data messages are
+// followed by the piece itself
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// utMetadata is the ut_metadata extension. It serves the info dictionary to
+// peers and, while we don't have it (when starting from a magnet link),
+// fetches it from them.
+type utMetadata struct {
+	infoHash []byte
+	info     []byte // nil until known
+}
+
+func newUTMetadata(infoHash []byte, info []byte) *utMetadata {
+	return &utMetadata{infoHash: infoHash, info: info}
+}
+
+func (e *utMetadata) Name() string {
+	return "ut_metadata"
+}
+
+func (e *utMetadata) ExtendHandshake(h *extendedHandshake) {
+	if e.info != nil {
+		h.MetadataSize = len(e.info)
+	}
+}
+
+func (e *utMetadata) NewSession(peer *extensionPeer) (ExtensionSession, error) {
+	s := &utMetadataSession{ext: e, peer: peer}
+	if e.info != nil {
+		return s, nil
+	}
+
+	// Ask for every piece of the metadata
+	size := peer.remote.MetadataSize
+	if size <= 0 || size > maxMetadataSize {
+		return nil, fmt.Errorf("invalid metadata size %d", size)
+	}
+	s.buf = make([]byte, size)
+	s.received = make([]bool, (size+metadataPieceSize-1)/metadataPieceSize)
+	s.remaining = len(s.received)
+	for piece := range s.received {
+		err := s.send(metadataMessage{MsgType: metadataRequest, Piece: piece}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+type utMetadataSession struct {
+	ext  *utMetadata
+	peer *extensionPeer
+
+	// Metadata being fetched
+	buf       []byte
+	received  []bool
+	remaining int
+}
+
+func (s *utMetadataSession) send(header metadataMessage, data []byte) error {
+	payload, err := bencode.Marshal(header)
+	if err != nil {
+		return err
+	}
+	return s.peer.sendExtended(append(payload, data...))
+}
+
+func (s *utMetadataSession) Handle(payload []byte) error {
+	var header metadataMessage
+	data, err := unmarshalPrefix(payload, &header)
+	if err != nil {
+		return fmt.Errorf("invalid message: %v", err)
+	}
+
+	switch header.MsgType {
+	case metadataRequest:
+		info := s.ext.info
+		numPieces := (len(info) + metadataPieceSize - 1) / metadataPieceSize
+		if header.Piece < 0 || header.Piece >= numPieces {
+			return s.send(metadataMessage{MsgType: metadataReject, Piece: header.Piece}, nil)
+		}
+		begin := header.Piece * metadataPieceSize
+		end := begin + metadataPieceSize
+		if end > len(info) {
+			end = len(info)
+		}
+		return s.send(metadataMessage{MsgType: metadataData, Piece: header.Piece, TotalSize: len(info)}, info[begin:end])
+
+	case metadataData:
+		if s.buf == nil || s.ext.info != nil {
+			return nil // Not fetching
+		}
+		if header.Piece < 0 || header.Piece >= len(s.received) {
+			return fmt.Errorf("metadata piece %d out of range", header.Piece)
+		}
+		begin := header.Piece * metadataPieceSize
+		end := begin + metadataPieceSize
+		if end > len(s.buf) {
+			end = len(s.buf)
+		}
+		if len(data) != end-begin {
+			return fmt.Errorf("metadata piece %d has length %d, expected %d", header.Piece, len(data), end-begin)
+		}
+		if s.received[header.Piece] {
+			return nil
+		}
+		copy(s.buf[begin:], data)
+		s.received[header.Piece] = true
+		s.remaining--
+		if s.remaining > 0 {
+			return nil
+		}
+
+		if !metadataMatches(s.buf, s.ext.infoHash) {
+			return errors.New("metadata does not match the info hash")
+		}
+		s.ext.info = s.buf
+		return nil
+
+	case metadataReject:
+		if s.buf != nil && s.ext.info == nil {
+			return fmt.Errorf("peer rejected metadata piece %d", header.Piece)
+		}
+	}
+	return nil
+}
+
+func (s *utMetadataSession) Tick(now time.Time) error {
+	return nil
+}
+
+func (s *utMetadataSession) Close() {}
+
+// Fetch the info dictionary for infoHash from the first peer that has it.
+// Peers are tried in parallel.
+func fetchMetadata(infoHash []byte, peerID string, peers []string) ([]byte, error) {
+	type fetchResult struct {
+		info []byte
+		err  error
+	}
+	results := make(chan fetchResult, len(peers))
+	for _, address := range peers {
+		go func(address string) {
+			info, err := fetchMetadataFrom(address, infoHash, peerID)
+			if err != nil {
+				err = fmt.Errorf("peer %s: %v", address, err)
+			}
+			results <- fetchResult{info, err}
+		}(address)
+	}
+
+	var lastErr error
+	for range peers {
+		result := <-results
+		if result.err == nil {
+			return result.info, nil
+		}
+		fmt.Printf("Error fetching metadata: %v\n", result.err)
+		lastErr = result.err
+	}
+	return nil, fmt.Errorf("could not fetch metadata from any peer, last error: %v", lastErr)
+}
+
+// Download the info dictionary from one peer with ut_metadata. The
+// extension checks it against the info hash.
+func fetchMetadataFrom(address string, infoHash []byte, peerID string) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(peerReadTimeout))
+
+	_, err = conn.Write(createHandshake(hex.EncodeToString(infoHash), peerID))
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, 68)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, fmt.Errorf("error reading handshake: %v", err)
+	}
+	_, err = checkHandshake(response, infoHash, peerID)
+	if err != nil {
+		return nil, err
+	}
+	if !supportsExtensions(response) {
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	metadata := newUTMetadata(infoHash, nil)
+	send := func(m *message) error {
+		_, err := conn.Write(m.serialize())
+		return err
+	}
+	ext := newExtensionConn(address, false, []Extension{metadata}, send)
+	remoteIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	err = ext.sendHandshake(remoteIP, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for metadata.info == nil {
+		m, err := readMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil || m.ID != msgExtended {
+			continue // Only extended messages matter here
+		}
+		err = ext.handle(m)
+		if err != nil {
+			return nil, err
+		}
+		if ext.remote != nil && !ext.supports(metadata.Name()) {
+			return nil, fmt.Errorf("peer does not support ut_metadata")
+		}
+	}
+	return metadata.info, nil
+}
+
+// Bencoded info dictionary of a torrent for serving over ut_metadata: the
+// bytes it was read from, or the Info struct encoded again for torrents built
+// in memory. nil if they don't match the info hash.
+func torrentMetadata(torrent TorrentFile, infoHashHex string) []byte {
+	info := torrent.RawInfo
+	if info == nil {
+		var err error
+		info, err = bencode.Marshal(torrent.Info)
+		if err != nil {
+			return nil
+		}
+	}
+	infoHash, _ := hex.DecodeString(infoHashHex)
+	if !metadataMatches(info, infoHash) {
+		return nil
+	}
+	return info
+}
+
+// Check an info dictionary against a 20-byte info hash: its SHA-1, or the
+// truncated SHA-256 that identifies v2 torrents
+func metadataMatches(info []byte, infoHash []byte) bool {
+	v1 := sha1.Sum(info)
+	v2 := sha256.Sum256(info)
+	return bytes.Equal(v1[:], infoHash) || bytes.Equal(v2[:20], infoHash)
+}
+
+// Build a torrent from a verified info dictionary
+func torrentFromMetadata(info []byte) (TorrentFile, error) {
+	var torrent TorrentFile
+	err := bencode.Unmarshal(info, &torrent.Info)
+	if err != nil {
+		return torrent, fmt.Errorf("error unmarshalling metadata: %v", err)
+	}
+	torrent.RawInfo = info
+	if torrent.Info.MetaVersion != 0 {
+		// The piece layers aren't part of the info dictionary; see
+		// fetchPieceLayers
+		err = setupV2(&torrent)
+		if err != nil {
+			return torrent, err
+		}
+	}
+	err = torrent.validateLayout()
+	if err != nil {
+		return torrent, fmt.Errorf("metadata has an invalid piece layout: %v", err)
+	}
+	return torrent, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// How long we wait for any message while we have requests outstanding
+const peerReadTimeout = 30 * time.Second
+
+// peerConn is an established connection to a peer. It decodes every BEP 3
+// message and keeps track of the choke and interest state of both sides and
+// of the pieces the remote peer has announced.
+type peerConn struct {
+	conn      net.Conn
+	address   string
+	numPieces int
+
+	peerChoking    bool // The peer is choking us
+	peerInterested bool // The peer wants pieces from us
+	amChoking      bool
+	amInterested   bool
+	bitfield       Bitfield // Pieces the peer has
+	pieces         int      // Number of pieces set in bitfield
+
+	ext *extensionConn // Extension protocol state, nil if the peer has none
+}
+
+func newPeerConn(conn net.Conn, address string, numPieces int) *peerConn {
+	return &peerConn{
+		conn:        conn,
+		address:     address,
+		numPieces:   numPieces,
+		peerChoking: true,
+		amChoking:   true,
+		bitfield:    newBitfield(numPieces),
+	}
+}
+
+func (p *peerConn) send(m *message) error {
+	_, err := p.conn.Write(m.serialize())
+	return err
+}
+
+// Update the peer state for a message; piece, request and cancel messages
+// are left for the caller
+func (p *peerConn) handle(m *message) error {
+	switch m.ID {
+	case msgChoke:
+		p.peerChoking = true
+	case msgUnchoke:
+		p.peerChoking = false
+	case msgInterested:
+		p.peerInterested = true
+	case msgNotInterested:
+		p.peerInterested = false
+	case msgHave:
+		index, err := parseHave(m)
+		if err != nil {
+			return err
+		}
+		if index >= p.numPieces {
+			return fmt.Errorf("have for piece %d out of range", index)
+		}
+		if !p.bitfield.HasPiece(index) {
+			p.bitfield.SetPiece(index)
+			p.pieces++
+		}
+	case msgBitfield:
+		if len(m.Payload) != len(p.bitfield) {
+			return fmt.Errorf("bitfield of length %d, expected %d", len(m.Payload), len(p.bitfield))
+		}
+		bf := Bitfield(m.Payload)
+		if bf.spareBitsSet(p.numPieces) {
+			return fmt.Errorf("bitfield has spare bits set")
+		}
+		p.bitfield = append(Bitfield(nil), bf...)
+		p.pieces = bf.Count(p.numPieces)
+	case msgRequest, msgCancel:
+		_, _, _, err := parseRequest(m)
+		if err != nil {
+			return err
+		}
+	case msgPiece:
+		_, _, _, err := parsePiece(m)
+		if err != nil {
+			return err
+		}
+	default:
+		// Unknown messages are ignored as the spec asks
+	}
+	return nil
+}
+
+// Tell the peer whether we want pieces from it, if that changed
+func (p *peerConn) setInterested(interested bool) error {
+	if interested == p.amInterested {
+		return nil
+	}
+	p.amInterested = interested
+	if interested {
+		return p.send(&message{ID: msgInterested})
+	}
+	return p.send(&message{ID: msgNotInterested})
+}
+
+// Choke or unchoke the peer, if that changed
+func (p *peerConn) setChoking(choking bool) error {
+	if choking == p.amChoking {
+		return nil
+	}
+	p.amChoking = choking
+	if choking {
+		return p.send(&message{ID: msgChoke})
+	}
+	return p.send(&message{ID: msgUnchoke})
+}
+
+func (p *peerConn) sendHave(index int) error {
+	return p.send(formatHave(index))
+}
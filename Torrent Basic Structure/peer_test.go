@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Feed a peer of 11 pieces one message after another, checking the state and
+// bitfield after each
+func TestPeerConnHandle(t *testing.T) {
+	type state struct {
+		choking, interested bool
+		bitfield            string
+	}
+	steps := []struct {
+		m    *message
+		want state
+	}{
+		{&message{ID: msgUnchoke}, state{false, false, "\x00\x00"}},
+		{formatHave(3), state{false, false, "\x10\x00"}},
+		{formatHave(10), state{false, false, "\x10\x20"}},
+		{&message{ID: msgInterested}, state{false, true, "\x10\x20"}},
+		{&message{ID: msgChoke}, state{true, true, "\x10\x20"}},
+		{&message{ID: msgNotInterested}, state{true, false, "\x10\x20"}},
+		{&message{ID: msgBitfield, Payload: []byte{0xff, 0xe0}}, state{true, false, "\xff\xe0"}},
+		{&message{ID: msgUnchoke}, state{false, false, "\xff\xe0"}},
+		{formatRequest(0, 0, 16384), state{false, false, "\xff\xe0"}},
+		{formatPiece(0, 0, []byte{1}), state{false, false, "\xff\xe0"}},
+		{&message{ID: 99, Payload: []byte("unknown")}, state{false, false, "\xff\xe0"}},
+	}
+	p := newPeerConn(nil, "test", 11)
+	if !p.peerChoking || p.peerInterested || !p.amChoking || p.amInterested {
+		t.Fatal("new peer does not start choked and uninterested")
+	}
+	for i, step := range steps {
+		err := p.handle(step.m)
+		if err != nil {
+			t.Fatalf("step %d (%s): %v", i, step.m.ID, err)
+		}
+		got := state{p.peerChoking, p.peerInterested, string(p.bitfield)}
+		if got != step.want {
+			t.Fatalf("step %d (%s): choking %v, interested %v, bitfield %08b; want %v, %v, %08b", i, step.m.ID,
+				got.choking, got.interested, []byte(got.bitfield), step.want.choking, step.want.interested, []byte(step.want.bitfield))
+		}
+	}
+}
+
+func TestPeerConnHandleRejects(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		m    *message
+	}{
+		{"truncated have", &message{ID: msgHave, Payload: []byte{0, 0, 1}}},
+		{"have out of range", formatHave(11)},
+		{"short bitfield", &message{ID: msgBitfield, Payload: []byte{0xff}}},
+		{"long bitfield", &message{ID: msgBitfield, Payload: []byte{0xff, 0xe0, 0}}},
+		{"bitfield with spare bits", &message{ID: msgBitfield, Payload: []byte{0xff, 0xe1}}},
+		{"bitfield with the last spare bit", &message{ID: msgBitfield, Payload: []byte{0x00, 0x01}}},
+		{"truncated request", &message{ID: msgRequest, Payload: make([]byte, 11)}},
+		{"oversized cancel", &message{ID: msgCancel, Payload: make([]byte, 13)}},
+		{"truncated piece", &message{ID: msgPiece, Payload: make([]byte, 7)}},
+	} {
+		p := newPeerConn(nil, "test", 11)
+		p.bitfield.SetPiece(2)
+		before := append(Bitfield(nil), p.bitfield...)
+		if err := p.handle(test.m); err == nil {
+			t.Errorf("%s accepted", test.name)
+		}
+		if !bytes.Equal(p.bitfield, before) {
+			t.Errorf("%s changed the bitfield to %08b", test.name, p.bitfield)
+		}
+	}
+
+	// A torrent of whole bytes has no spare bits to check
+	p := newPeerConn(nil, "test", 16)
+	if err := p.handle(&message{ID: msgBitfield, Payload: []byte{0xff, 0xff}}); err != nil {
+		t.Errorf("full bitfield of 16 pieces: %v", err)
+	}
+}
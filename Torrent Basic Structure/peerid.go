@@ -0,0 +1,23 @@
+package main
+
+import "crypto/rand"
+
+// Azureus-style peer ID prefix: "-", the client code PC, the version from
+// clientVersion as four digits (major, minor, patch, build) and "-"
+const peerIDPrefix = "-PC0100-"
+
+// Characters of the random part of a peer ID; printable, since some trackers
+// and clients show peer IDs as text
+const peerIDAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Generate a peer ID for this session: the client prefix followed by 12
+// random characters, so two instances behind the same NAT don't collide
+func newPeerID() string {
+	random := make([]byte, 20-len(peerIDPrefix))
+	rand.Read(random)
+	id := []byte(peerIDPrefix)
+	for _, b := range random {
+		id = append(id, peerIDAlphabet[int(b)%len(peerIDAlphabet)])
+	}
+	return string(id)
+}
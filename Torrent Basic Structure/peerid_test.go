@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestNewPeerID(t *testing.T) {
+	a, b := newPeerID(), newPeerID()
+	if len(a) != 20 || !strings.HasPrefix(a, "-PC0100-") {
+		t.Fatalf("peer ID %q", a)
+	}
+	for _, c := range a[len(peerIDPrefix):] {
+		if !strings.ContainsRune(peerIDAlphabet, c) {
+			t.Fatalf("peer ID %q has unprintable characters", a)
+		}
+	}
+	if a == b {
+		t.Fatal("two sessions got the same peer ID")
+	}
+}
+
+func TestCheckHandshake(t *testing.T) {
+	infoHash, _ := hex.DecodeString(testInfoHash)
+	ours, theirs := newPeerID(), newPeerID()
+
+	id, err := checkHandshake(createHandshake(testInfoHash, theirs), infoHash, ours)
+	if err != nil || string(id) != theirs {
+		t.Fatalf("got peer ID %q: %v", id, err)
+	}
+	_, err = checkHandshake(createHandshake(testInfoHash, ours), infoHash, ours)
+	if err == nil {
+		t.Fatal("handshake from ourselves was accepted")
+	}
+	other := hex.EncodeToString(bytes.Repeat([]byte{0xee}, 20))
+	_, err = checkHandshake(createHandshake(other, theirs), infoHash, ours)
+	if err == nil {
+		t.Fatal("handshake for another torrent was accepted")
+	}
+	_, err = checkHandshake(createHandshake(testInfoHash, theirs)[:60], infoHash, ours)
+	if err == nil {
+		t.Fatal("short handshake was accepted")
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"bittorrent-client/bencode"
+)
+
+// Peer exchange (BEP 11): peers may send at most one message a minute, each
+// listing at most 50 added and 50 dropped peers
+const (
+	pexInterval = time.Minute
+	pexMaxPeers = 50
+)
+
+// Flags sent with each added peer
+const (
+	pexEncryption = 0x01 // Prefers encrypted connections
+	pexSeed       = 0x02 // Upload only
+	pexUTP        = 0x04 // Supports uTP
+	pexHolepunch  = 0x08 // Supports ut_holepunch
+	pexReachable  = 0x10 // Accepts incoming connections
+)
+
+// A ut_pex message. IPv4 peers are 6-byte compact entries and IPv6 peers
+// 18-byte ones; the .f strings carry one flags byte per added peer.
+type pexMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// A peer learned through PEX
+type pexPeer struct {
+	address string
+	flags   byte
+}
+
+// utPex is the ut_pex extension. It keeps the set of peers we are connected
+// to, tells every peer what changed in that set once a minute and passes the
+// peers others tell us about to onPeers.
+type utPex struct {
+	onPeers   func(added []pexPeer, dropped []string)
+	mu        sync.Mutex
+	connected map[string]byte // Listen address to flags
+}
+
+func newUTPex(onPeers func(added []pexPeer, dropped []string)) *utPex {
+	return &utPex{onPeers: onPeers, connected: make(map[string]byte)}
+}
+
+func (e *utPex) Name() string {
+	return "ut_pex"
+}
+
+func (e *utPex) ExtendHandshake(h *extendedHandshake) {}
+
+func (e *utPex) NewSession(peer *extensionPeer) (ExtensionSession, error) {
+	s := &utPexSession{ext: e, peer: peer, sent: make(map[string]byte)}
+	s.listenAddress = peer.listenAddress()
+
+	// Outgoing connections are added by the downloader whether or not the
+	// peer speaks PEX; incoming ones only once the peer tells us its port
+	if peer.incoming && s.listenAddress != "" {
+		e.peerConnected(s.listenAddress, 0)
+		s.registered = true
+	}
+	return s, nil
+}
+
+// Add a peer to the connected set announced to others
+func (e *utPex) peerConnected(address string, flags byte) {
+	e.mu.Lock()
+	e.connected[address] = flags
+	e.mu.Unlock()
+}
+
+// Remove a peer from the connected set; the next messages list it as dropped
+func (e *utPex) peerDisconnected(address string) {
+	e.mu.Lock()
+	delete(e.connected, address)
+	e.mu.Unlock()
+}
+
+// Current connected set, as seen by the peer at exclude
+func (e *utPex) snapshot(exclude string) map[string]byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	peers := make(map[string]byte, len(e.connected))
+	for address, flags := range e.connected {
+		if address != exclude {
+			peers[address] = flags
+		}
+	}
+	return peers
+}
+
+type utPexSession struct {
+	ext           *utPex
+	peer          *extensionPeer
+	listenAddress string          // Where the peer accepts connections, if known
+	registered    bool            // The session added the peer to the connected set
+	sent          map[string]byte // Connected set as we last described it to the peer
+	lastSent      time.Time
+	lastReceived  time.Time
+}
+
+func (s *utPexSession) Handle(payload []byte) error {
+	now := time.Now()
+	if !s.lastReceived.IsZero() && now.Sub(s.lastReceived) < pexInterval/2 {
+		return nil // Flooding; ignore rather than disconnect
+	}
+	s.lastReceived = now
+
+	var msg pexMessage
+	_, err := unmarshalPrefix(payload, &msg)
+	if err != nil {
+		return fmt.Errorf("invalid message: %v", err)
+	}
+	added4, err := parseCompactPeers([]byte(msg.Added), net.IPv4len)
+	if err != nil {
+		return err
+	}
+	added6, err := parseCompactPeers([]byte(msg.Added6), net.IPv6len)
+	if err != nil {
+		return err
+	}
+	dropped4, err := parseCompactPeers([]byte(msg.Dropped), net.IPv4len)
+	if err != nil {
+		return err
+	}
+	dropped6, err := parseCompactPeers([]byte(msg.Dropped6), net.IPv6len)
+	if err != nil {
+		return err
+	}
+
+	var added []pexPeer
+	for i, address := range added4 {
+		added = append(added, pexPeer{address: address, flags: flagAt(msg.AddedF, i)})
+	}
+	for i, address := range added6 {
+		added = append(added, pexPeer{address: address, flags: flagAt(msg.Added6F, i)})
+	}
+	dropped := append(dropped4, dropped6...)
+
+	// Only the first 50 of each are honoured
+	if len(added) > pexMaxPeers {
+		added = added[:pexMaxPeers]
+	}
+	if len(dropped) > pexMaxPeers {
+		dropped = dropped[:pexMaxPeers]
+	}
+	if len(added) > 0 || len(dropped) > 0 {
+		s.ext.onPeers(added, dropped)
+	}
+	return nil
+}
+
+func flagAt(flags string, i int) byte {
+	if i < len(flags) {
+		return flags[i]
+	}
+	return 0
+}
+
+// Send the changes to the connected set since our last message, at most
+// once a minute. The first message goes out right after the handshake.
+func (s *utPexSession) Tick(now time.Time) error {
+	if !s.lastSent.IsZero() && now.Sub(s.lastSent) < pexInterval {
+		return nil
+	}
+	current := s.ext.snapshot(s.listenAddress)
+
+	var added, dropped []string
+	for address := range current {
+		if _, ok := s.sent[address]; !ok {
+			added = append(added, address)
+		}
+	}
+	for address := range s.sent {
+		if _, ok := current[address]; !ok {
+			dropped = append(dropped, address)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+	// The rest go out with the next message
+	sort.Strings(added)
+	sort.Strings(dropped)
+	if len(added) > pexMaxPeers {
+		added = added[:pexMaxPeers]
+	}
+	if len(dropped) > pexMaxPeers {
+		dropped = dropped[:pexMaxPeers]
+	}
+
+	var msg pexMessage
+	for _, address := range added {
+		flags := current[address]
+		compact, ipv6 := compactPeer(address)
+		if compact == nil {
+			continue
+		}
+		if ipv6 {
+			msg.Added6 += string(compact)
+			msg.Added6F += string(flags)
+		} else {
+			msg.Added += string(compact)
+			msg.AddedF += string(flags)
+		}
+		s.sent[address] = flags
+	}
+	for _, address := range dropped {
+		compact, ipv6 := compactPeer(address)
+		if compact != nil {
+			if ipv6 {
+				msg.Dropped6 += string(compact)
+			} else {
+				msg.Dropped += string(compact)
+			}
+		}
+		delete(s.sent, address)
+	}
+
+	payload, err := bencode.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.lastSent = now
+	return s.peer.sendExtended(payload)
+}
+
+func (s *utPexSession) Close() {
+	if s.registered {
+		s.ext.peerDisconnected(s.listenAddress)
+	}
+}
+
+// Peers a connected peer told us about
+type pexUpdate struct {
+	added   []pexPeer
+	dropped []string
+}
+
+// Pass peers learned through PEX to the connection manager. Once we are
+// seeding there is nothing to gain from other seeds.
+func (d *downloader) handleDiscovered(update pexUpdate) {
+	var addresses []string
+	for _, peer := range update.added {
+		if peer.flags&pexSeed != 0 && d.completed == d.numPieces {
+			continue
+		}
+		addresses = append(addresses, peer.address)
+	}
+	d.addPeers(addresses)
+	for _, address := range update.dropped {
+		d.dropCandidate(address)
+	}
+}
+
+// Encode host:port as a compact peer entry: 4 or 16 address bytes followed
+// by the port. Returns nil for addresses that aren't IP:port.
+func compactPeer(address string) ([]byte, bool) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return append(ip4, byte(port>>8), byte(port)), false
+	}
+	return append(ip.To16(), byte(port>>8), byte(port)), true
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bittorrent-client/bencode"
+)
+
+func TestCompactPeers(t *testing.T) {
+	for _, address := range []string{"10.0.0.1:6881", "[2001:db8::1]:51413"} {
+		compact, ipv6 := compactPeer(address)
+		ipLen := net.IPv4len
+		if ipv6 {
+			ipLen = net.IPv6len
+		}
+		if len(compact) != ipLen+2 {
+			t.Fatalf("%s encoded as %x", address, compact)
+		}
+		peers, err := parseCompactPeers(compact, ipLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(peers) != 1 || peers[0] != address {
+			t.Errorf("%s decoded as %q", address, peers)
+		}
+	}
+
+	for _, bad := range []string{"nohost", "example.com:80", "10.0.0.1:0"} {
+		compact, _ := compactPeer(bad)
+		if compact != nil {
+			t.Errorf("compactPeer(%q) = %x", bad, compact)
+		}
+	}
+	_, err := parseCompactPeers(make([]byte, 7), net.IPv4len)
+	if err == nil {
+		t.Error("truncated peer list was accepted")
+	}
+}
+
+// Start a ut_pex session that records what it sends
+func newTestPexSession(e *utPex, address string, incoming bool, remote *extendedHandshake) (ExtensionSession, *[]pexMessage) {
+	var sent []pexMessage
+	session, _ := e.NewSession(&extensionPeer{
+		address:  address,
+		incoming: incoming,
+		remote:   remote,
+		id:       7,
+		send: func(m *message) error {
+			var msg pexMessage
+			_, err := unmarshalPrefix(m.Payload[1:], &msg)
+			sent = append(sent, msg)
+			return err
+		},
+	})
+	return session, &sent
+}
+
+func TestPexSendsChanges(t *testing.T) {
+	e := newUTPex(nil)
+	e.peerConnected("10.0.0.1:6881", pexReachable)
+	e.peerConnected("[2001:db8::1]:6881", pexReachable)
+	for i := 0; i < 60; i++ {
+		e.peerConnected(fmt.Sprintf("10.1.0.%d:6881", i), 0)
+	}
+	// Our own entry is never sent back to us
+	e.peerConnected("10.0.0.9:6881", pexReachable)
+	session, sent := newTestPexSession(e, "10.0.0.9:6881", false, &extendedHandshake{})
+
+	now := time.Now()
+	session.Tick(now)
+	if len(*sent) != 1 {
+		t.Fatalf("%d messages sent on the first tick", len(*sent))
+	}
+	first := (*sent)[0]
+	added, _ := parseCompactPeers([]byte(first.Added), net.IPv4len)
+	added6, _ := parseCompactPeers([]byte(first.Added6), net.IPv6len)
+	if len(added)+len(added6) != pexMaxPeers || len(first.AddedF) != len(added) || len(first.Added6F) != len(added6) {
+		t.Fatalf("first message added %d IPv4 and %d IPv6 peers with %d and %d flags", len(added), len(added6), len(first.AddedF), len(first.Added6F))
+	}
+	if added[0] != "10.0.0.1:6881" || first.AddedF[0] != pexReachable || first.AddedF[1] != 0 {
+		t.Fatalf("first message added %q with flags %x", added, first.AddedF)
+	}
+	for _, address := range added {
+		if address == "10.0.0.9:6881" {
+			t.Fatal("peer was told about itself")
+		}
+	}
+
+	// Nothing more until a minute has passed
+	e.peerDisconnected("10.0.0.1:6881")
+	session.Tick(now.Add(30 * time.Second))
+	if len(*sent) != 1 {
+		t.Fatal("second message sent within a minute")
+	}
+	session.Tick(now.Add(pexInterval))
+	if len(*sent) != 2 {
+		t.Fatal("no message after a minute")
+	}
+	second := (*sent)[1]
+	added, _ = parseCompactPeers([]byte(second.Added), net.IPv4len)
+	added6, _ = parseCompactPeers([]byte(second.Added6), net.IPv6len)
+	dropped, _ := parseCompactPeers([]byte(second.Dropped), net.IPv4len)
+	if len(added) != 61-pexMaxPeers || len(added6) != 1 || added6[0] != "[2001:db8::1]:6881" || second.Added6F != string([]byte{pexReachable}) {
+		t.Fatalf("second message added %q and %q", added, added6)
+	}
+	if len(dropped) != 1 || dropped[0] != "10.0.0.1:6881" {
+		t.Fatalf("second message dropped %q", dropped)
+	}
+
+	// Incoming peers are announced once we know their listen port
+	e.peerDisconnected("10.0.0.9:6881")
+	incoming, _ := newTestPexSession(e, "10.0.0.5:40000", true, &extendedHandshake{P: 6882})
+	if _, ok := e.snapshot("")["10.0.0.5:6882"]; !ok {
+		t.Fatal("incoming peer is not in the connected set")
+	}
+	incoming.Close()
+	if _, ok := e.snapshot("")["10.0.0.5:6882"]; ok {
+		t.Fatal("closed peer is still in the connected set")
+	}
+}
+
+func TestPexReceivesPeers(t *testing.T) {
+	var added []pexPeer
+	var dropped []string
+	e := newUTPex(func(a []pexPeer, d []string) {
+		added = append(added, a...)
+		dropped = append(dropped, d...)
+	})
+	session, _ := newTestPexSession(e, "10.0.0.9:6881", false, &extendedHandshake{})
+
+	compact4, _ := compactPeer("10.0.0.1:6881")
+	compact6, _ := compactPeer("[2001:db8::1]:6881")
+	gone, _ := compactPeer("10.0.0.2:6881")
+	var buf bytes.Buffer
+	bencode.NewEncoder(&buf).Encode(pexMessage{
+		Added:   string(compact4),
+		AddedF:  string([]byte{pexSeed | pexReachable}),
+		Added6:  string(compact6),
+		Dropped: string(gone),
+	})
+	err := session.Handle(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(added) != fmt.Sprint([]pexPeer{{"10.0.0.1:6881", pexSeed | pexReachable}, {"[2001:db8::1]:6881", 0}}) {
+		t.Errorf("added %v", added)
+	}
+	if len(dropped) != 1 || dropped[0] != "10.0.0.2:6881" {
+		t.Errorf("dropped %q", dropped)
+	}
+
+	// A peer sending more often than every half minute is ignored
+	added = nil
+	session.Handle(buf.Bytes())
+	if added != nil {
+		t.Error("flooded message was used")
+	}
+
+	other, _ := newTestPexSession(e, "10.0.0.8:6881", false, &extendedHandshake{})
+	err = other.Handle([]byte("d5:added5:abcdee"))
+	if err == nil {
+		t.Error("truncated added list was accepted")
+	}
+}
+
+// The only peer we are given has no pieces but tells us about one that has
+// them all; the download has to come from that one
+func TestDownloadFromPexPeer(t *testing.T) {
+	data := randomData(8*32768 + 100)
+	torrent := makeTestTorrent("pex.bin", data, 32768)
+	source := startFakePeer(t, data, 32768)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handshake := make([]byte, 68)
+		_, err = io.ReadFull(conn, handshake)
+		if err != nil {
+			return
+		}
+		copy(handshake[48:], newPeerID()) // Answer with a peer ID of our own
+		conn.Write(handshake)
+
+		var ext bytes.Buffer
+		bencode.NewEncoder(&ext).Encode(extendedHandshake{M: map[string]int{"ut_pex": 1}})
+		conn.Write(formatExtended(0, ext.Bytes()).serialize())
+		for {
+			m, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			if m == nil || m.ID != msgExtended || m.Payload[0] != 0 {
+				continue
+			}
+			var client extendedHandshake
+			unmarshalPrefix(m.Payload[1:], &client)
+			compact, _ := compactPeer(source.address())
+			var msg bytes.Buffer
+			bencode.NewEncoder(&msg).Encode(pexMessage{Added: string(compact), AddedF: string([]byte{pexSeed | pexReachable})})
+			conn.Write(formatExtended(byte(client.M["ut_pex"]), msg.Bytes()).serialize())
+		}
+	}()
+
+	config := testDownloadConfig(t.TempDir())
+	done := make(chan error, 1)
+	go func() {
+		done <- downloadTorrent(torrent, testInfoHash, newPeerID(), []string{listener.Addr().String()}, config, nil)
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(config.outputDir, "pex.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data does not match")
+	}
+}
+
+// Accept one connection, answer its handshake offering extensions and return
+// the extended handshake the client sends
+func captureExtendedHandshake(t *testing.T) (string, <-chan extendedHandshake) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	got := make(chan extendedHandshake, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		handshake := make([]byte, 68)
+		if _, err = io.ReadFull(conn, handshake); err != nil {
+			return
+		}
+		copy(handshake[48:], newPeerID())
+		conn.Write(handshake)
+		for {
+			m, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			if m != nil && m.ID == msgExtended && len(m.Payload) > 0 && m.Payload[0] == 0 {
+				var h extendedHandshake
+				unmarshalPrefix(m.Payload[1:], &h)
+				got <- h
+				return
+			}
+		}
+	}()
+	return listener.Addr().String(), got
+}
+
+// Private torrents don't exchange peers (BEP 27)
+func TestPrivateTorrentHasNoPex(t *testing.T) {
+	for _, private := range []int{0, 1} {
+		torrent := makeTestTorrent("private.bin", randomData(32768), 32768)
+		torrent.Info.Private = private
+		address, got := captureExtendedHandshake(t)
+		downloadTorrent(torrent, testInfoHash, newPeerID(), []string{address}, testDownloadConfig(t.TempDir()), nil)
+
+		var h extendedHandshake
+		select {
+		case h = <-got:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no extended handshake sent")
+		}
+		if _, ok := h.M["ut_pex"]; ok != (private == 0) {
+			t.Errorf("private=%d: m = %v", private, h.M)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// PiecePicker decides which piece a peer downloads next. candidates holds the
+// pending pieces the peer has, in increasing index order, and is never empty.
+// availability[i] is the number of connected peers that have piece i, and
+// completed is the number of pieces we already have.
+type PiecePicker interface {
+	Pick(candidates []int, availability []int, completed int) int
+}
+
+// Names accepted by the --picker flag
+const (
+	pickerRarest      = "rarest"
+	pickerSequential  = "sequential"
+	pickerRandomFirst = "random-first"
+)
+
+func newPiecePicker(name string) (PiecePicker, error) {
+	switch name {
+	case pickerRarest:
+		return newRarestFirstPicker(), nil
+	case pickerSequential:
+		return sequentialPicker{}, nil
+	case pickerRandomFirst:
+		return newRandomFirstPicker(4), nil
+	}
+	return nil, fmt.Errorf("unknown piece picker %q (want %s, %s or %s)", name, pickerRarest, pickerSequential, pickerRandomFirst)
+}
+
+// sequentialPicker downloads pieces in index order, which suits streaming
+type sequentialPicker struct{}
+
+func (sequentialPicker) Pick(candidates []int, availability []int, completed int) int {
+	return candidates[0]
+}
+
+// rarestFirstPicker prefers the pieces fewest peers have, so they spread
+// through the swarm before their owners leave. Ties are broken randomly to
+// keep peers from all fetching the same piece.
+type rarestFirstPicker struct {
+	rand *rand.Rand
+}
+
+func newRarestFirstPicker() *rarestFirstPicker {
+	return &rarestFirstPicker{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (p *rarestFirstPicker) Pick(candidates []int, availability []int, completed int) int {
+	best := candidates[0]
+	ties := 1
+	for _, index := range candidates[1:] {
+		switch {
+		case availability[index] < availability[best]:
+			best = index
+			ties = 1
+		case availability[index] == availability[best]:
+			// Reservoir sampling keeps every tied piece equally likely
+			ties++
+			if p.rand.Intn(ties) == 0 {
+				best = index
+			}
+		}
+	}
+	return best
+}
+
+// randomFirstPicker picks random pieces until the first few are complete, so
+// we quickly have something to trade, then switches to rarest first
+type randomFirstPicker struct {
+	threshold int
+	rand      *rand.Rand
+	rarest    *rarestFirstPicker
+}
+
+func newRandomFirstPicker(threshold int) *randomFirstPicker {
+	return &randomFirstPicker{
+		threshold: threshold,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		rarest:    newRarestFirstPicker(),
+	}
+}
+
+func (p *randomFirstPicker) Pick(candidates []int, availability []int, completed int) int {
+	if completed < p.threshold {
+		return candidates[p.rand.Intn(len(candidates))]
+	}
+	return p.rarest.Pick(candidates, availability, completed)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestNewPiecePicker(t *testing.T) {
+	for _, name := range []string{pickerRarest, pickerSequential, pickerRandomFirst} {
+		if _, err := newPiecePicker(name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := newPiecePicker("fastest"); err == nil {
+		t.Error("unknown picker accepted")
+	}
+	if p, _ := newPiecePicker(pickerRandomFirst); p.(*randomFirstPicker).threshold != 4 {
+		t.Error("random first threshold is not 4")
+	}
+}
+
+func TestSequentialPicker(t *testing.T) {
+	availability := []int{1, 1, 9, 1, 0}
+	if got := (sequentialPicker{}).Pick([]int{2, 3, 4}, availability, 0); got != 2 {
+		t.Errorf("picked %d, want 2", got)
+	}
+}
+
+func TestRarestFirstPicker(t *testing.T) {
+	p := &rarestFirstPicker{rand: rand.New(rand.NewSource(1))}
+	availability := []int{3, 1, 2, 1, 5, 2}
+
+	// Only the rarest pieces are picked, each of them some of the time
+	picked := make(map[int]int)
+	for i := 0; i < 100; i++ {
+		picked[p.Pick([]int{0, 1, 2, 3, 4, 5}, availability, 0)]++
+	}
+	if len(picked) != 2 || picked[1] < 20 || picked[3] < 20 {
+		t.Errorf("picked %v, want pieces 1 and 3 evenly", picked)
+	}
+
+	// The rarest among the candidates, whatever their order in availability
+	for _, test := range []struct {
+		candidates []int
+		want       int
+	}{
+		{[]int{0, 4}, 0},
+		{[]int{4, 5}, 5},
+		{[]int{0, 2, 4}, 2},
+		{[]int{4}, 4},
+	} {
+		if got := p.Pick(test.candidates, availability, 0); got != test.want {
+			t.Errorf("candidates %v: picked %d, want %d", test.candidates, got, test.want)
+		}
+	}
+
+	// The same seed picks the same pieces
+	a := &rarestFirstPicker{rand: rand.New(rand.NewSource(7))}
+	b := &rarestFirstPicker{rand: rand.New(rand.NewSource(7))}
+	flat := make([]int, 50)
+	candidates := make([]int, 50)
+	for i := range candidates {
+		candidates[i] = i
+	}
+	for i := 0; i < 20; i++ {
+		if x, y := a.Pick(candidates, flat, 0), b.Pick(candidates, flat, 0); x != y {
+			t.Fatalf("pick %d: %d and %d with the same seed", i, x, y)
+		}
+	}
+}
+
+func TestRandomFirstPicker(t *testing.T) {
+	p := &randomFirstPicker{
+		threshold: 4,
+		rand:      rand.New(rand.NewSource(1)),
+		rarest:    &rarestFirstPicker{rand: rand.New(rand.NewSource(2))},
+	}
+	availability := []int{5, 5, 1, 5, 5, 5, 5, 5}
+	candidates := []int{0, 1, 2, 3, 4, 5, 6, 7}
+
+	// Below the threshold any piece goes, however common
+	for completed := 0; completed < 4; completed++ {
+		picked := make(map[int]bool)
+		for i := 0; i < 50; i++ {
+			picked[p.Pick(candidates, availability, completed)] = true
+		}
+		if len(picked) < 4 {
+			t.Errorf("%d completed: only picked %v", completed, picked)
+		}
+	}
+
+	// From the threshold on, the rarest piece
+	for _, completed := range []int{4, 5, 100} {
+		for i := 0; i < 20; i++ {
+			if got := p.Pick(candidates, availability, completed); got != 2 {
+				t.Fatalf("%d completed: picked %d, want the rarest piece 2", completed, got)
+			}
+		}
+	}
+}
+
+// A piece that failed its hash on a peer goes to another peer that has it,
+// and back to the same peer only when no other can serve it
+func TestPickPieceSkipsFailedPeer(t *testing.T) {
+	newSlot := func(address string, pieces ...int) *peerSlot {
+		slot := &peerSlot{address: address, bitfield: newBitfield(4), ready: true, assigned: make(map[int]bool)}
+		for _, index := range pieces {
+			slot.bitfield.SetPiece(index)
+		}
+		return slot
+	}
+	bad := newSlot("bad", 0, 1, 2, 3)
+	good := newSlot("good", 1)
+	d := &downloader{
+		numPieces:    4,
+		config:       downloadConfig{picker: sequentialPicker{}},
+		peers:        []*peerSlot{bad, good},
+		availability: []int{1, 2, 1, 1},
+		pending:      make(map[int]bool),
+		inProgress:   make(map[int]map[*peerSlot]bool),
+		failedOn:     map[int]map[*peerSlot]bool{1: {bad: true}},
+		blocks:       newPieceRegistry(),
+	}
+	d.addPending(1)
+
+	if index, ok := d.pickPiece(bad); ok {
+		t.Fatalf("failed piece %d given back to the peer it failed on", index)
+	}
+	if index, ok := d.pickPiece(good); !ok || index != 1 {
+		t.Fatalf("other peer picked %d, %v", index, ok)
+	}
+
+	// Other pending pieces still go to the peer
+	d.addPending(3)
+	if index, ok := d.pickPiece(bad); !ok || index != 3 {
+		t.Fatalf("picked %d, %v, want piece 3", index, ok)
+	}
+	d.removePending(3)
+
+	// Once the other source is gone the piece is retried where it failed
+	good.gone = true
+	if index, ok := d.pickPiece(bad); !ok || index != 1 {
+		t.Fatalf("only source picked %d, %v", index, ok)
+	}
+
+	// Nor does endgame hand it to the peer it failed on
+	good.gone = false
+	d.inProgress[1] = map[*peerSlot]bool{good: true}
+	if index, ok := d.pickEndgamePiece(bad); ok {
+		t.Fatalf("endgame gave piece %d to the peer it failed on", index)
+	}
+}
+
+// Each peer's wanted set follows its bitfield and haves and the pieces taken
+// out of and put back in the pending set, without being rebuilt
+func TestWantedPiecesFollowEvents(t *testing.T) {
+	d := &downloader{
+		numPieces:    12,
+		availability: make([]int, 12),
+		pending:      make(map[int]bool),
+		inProgress:   make(map[int]map[*peerSlot]bool),
+		failedOn:     make(map[int]map[*peerSlot]bool),
+	}
+	for index := 0; index < 12; index++ {
+		if index != 4 {
+			d.pending[index] = true
+		}
+	}
+	a := d.newPeerSlot("a")
+	b := d.newPeerSlot("b")
+	check := func(step string, slot *peerSlot, want ...int) {
+		t.Helper()
+		if fmt.Sprint(slot.wanted) != fmt.Sprint(want) {
+			t.Fatalf("%s: %s wants %v, want %v", step, slot.address, slot.wanted, want)
+		}
+	}
+
+	bitfield := newBitfield(12)
+	for _, index := range []int{1, 4, 9, 11} {
+		bitfield.SetPiece(index)
+	}
+	d.handleEvent(peerEvent{peer: a, kind: peerBitfield, bitfield: bitfield})
+	check("bitfield", a, 1, 9, 11)
+	d.handleEvent(peerEvent{peer: a, kind: peerHave, index: 5})
+	d.handleEvent(peerEvent{peer: a, kind: peerHave, index: 4})
+	d.handleEvent(peerEvent{peer: b, kind: peerHave, index: 9})
+	check("have", a, 1, 5, 9, 11)
+	check("have", b, 9)
+	if d.availability[9] != 2 || d.availability[4] != 1 {
+		t.Fatalf("availability %v", d.availability)
+	}
+
+	d.removePending(9)
+	d.assign(9, a)
+	check("assign", a, 1, 5, 11)
+	check("assign", b)
+	d.unassign(9, a)
+	check("unassign", a, 1, 5, 9, 11)
+	check("unassign", b, 9)
+
+	d.handleEvent(peerEvent{peer: a, kind: peerGone})
+	check("gone", a)
+	if d.availability[1] != 0 || d.availability[9] != 1 {
+		t.Fatalf("availability after a left %v", d.availability)
+	}
+	d.removePending(9)
+	d.addPending(9)
+	check("gone peer", a)
+	check("gone peer", b, 9)
+}
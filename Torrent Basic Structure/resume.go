@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bittorrent-client/bencode"
+)
+
+// Contents of the .resume file kept next to a download
+type resumeData struct {
+	InfoHash  string `bencode:"info hash"`
+	NumPieces int    `bencode:"pieces"`
+	Bitfield  string `bencode:"bitfield"`
+}
+
+func resumeFilePath(torrent TorrentFile, baseDir string) string {
+	return filepath.Join(baseDir, torrent.Info.Name+".resume")
+}
+
+// Load the verified pieces recorded by an earlier run. A missing file, one
+// written for a different torrent or one with spare bits set yields nil.
+func loadResume(path string, infoHashHex string, numPieces int) Bitfield {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var data resumeData
+	err = bencode.NewDecoder(file).Decode(&data)
+	if err != nil {
+		fmt.Printf("Ignoring unreadable resume file %s: %v\n", path, err)
+		return nil
+	}
+	if data.InfoHash != infoHashHex || data.NumPieces != numPieces || len(data.Bitfield) != (numPieces+7)/8 {
+		fmt.Printf("Ignoring resume file %s written for a different torrent\n", path)
+		return nil
+	}
+	have := Bitfield(data.Bitfield)
+	if have.spareBitsSet(numPieces) {
+		fmt.Printf("Ignoring resume file %s with pieces past the end of the torrent\n", path)
+		return nil
+	}
+	return have
+}
+
+// Persist the verified pieces, replacing the old file atomically so a crash
+// never leaves a truncated resume file behind
+func saveResume(path string, infoHashHex string, numPieces int, have Bitfield) error {
+	data, err := bencode.Marshal(resumeData{InfoHash: infoHashHex, NumPieces: numPieces, Bitfield: string(have)})
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Hash every piece found on disk against Info.Pieces
+func recheckPieces(torrent TorrentFile, storage PieceStorage) Bitfield {
+	numPieces := torrent.numPieces()
+	have := newBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		data, err := storage.ReadPiece(i, torrent.pieceSize(i))
+		if err == nil && validatePiece(torrent, i, data) {
+			have.SetPiece(i)
+		}
+	}
+	return have
+}
+
+// Work out which pieces an earlier run already left on disk. The resume file
+// is trusted only if every file is still there with its full size; otherwise
+// whatever data exists is hashed again.
+func verifiedPieces(torrent TorrentFile, infoHashHex string, baseDir string) (Bitfield, error) {
+	numPieces := torrent.numPieces()
+	files, err := torrent.fileLayout(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	anyExist, allComplete := false, true
+	for _, f := range files {
+		if f.padding {
+			continue
+		}
+		info, err := os.Stat(f.path)
+		if err != nil {
+			allComplete = false
+			continue
+		}
+		anyExist = true
+		if info.Size() != f.length {
+			allComplete = false
+		}
+	}
+	if !anyExist {
+		return newBitfield(numPieces), nil
+	}
+
+	if allComplete {
+		have := loadResume(resumeFilePath(torrent, baseDir), infoHashHex, numPieces)
+		if have != nil {
+			return have, nil
+		}
+	}
+
+	fmt.Println("Checking existing data...")
+	storage, err := openFileStorage(torrent, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+	return recheckPieces(torrent, storage), nil
+}
+
+// Format piece indices as compact ranges, e.g. "0-3, 7, 9-10"
+func formatPieceRanges(indices []int) string {
+	var parts []string
+	for i := 0; i < len(indices); {
+		j := i
+		for j+1 < len(indices) && indices[j+1] == indices[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprintf("%d", indices[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", indices[i], indices[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Rehash the existing output of a torrent and report good and bad pieces
+func runRecheck(filePath string) {
+	torrent, infoHashSum, err := openTorrent(filePath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	infoHashHex := fmt.Sprintf("%x", infoHashSum)
+
+	storage, err := openFileStorage(torrent, ".")
+	if err != nil {
+		fmt.Printf("Error opening downloaded data: %v\n", err)
+		return
+	}
+	have := recheckPieces(torrent, storage)
+	storage.Close()
+
+	numPieces := torrent.numPieces()
+	var good, bad []int
+	for i := 0; i < numPieces; i++ {
+		if have.HasPiece(i) {
+			good = append(good, i)
+		} else {
+			bad = append(bad, i)
+		}
+	}
+	fmt.Printf("Good pieces (%d): %s\n", len(good), formatPieceRanges(good))
+	fmt.Printf("Bad pieces (%d): %s\n", len(bad), formatPieceRanges(bad))
+	fmt.Printf("%d/%d pieces verified\n", len(good), numPieces)
+
+	// Keep the resume file in line with what is actually on disk
+	if len(good) > 0 {
+		err = saveResume(resumeFilePath(torrent, "."), infoHashHex, numPieces, have)
+		if err != nil {
+			fmt.Printf("Error writing resume file: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bittorrent-client/bencode"
+)
+
+func TestResumeRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.resume")
+	have := newBitfield(11)
+	for _, i := range []int{0, 3, 10} {
+		have.SetPiece(i)
+	}
+	err := saveResume(path, testInfoHash, 11, have)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path + ".tmp"); err == nil {
+		t.Error("temporary file left behind")
+	}
+	got := loadResume(path, testInfoHash, 11)
+	if !bytes.Equal(got, have) {
+		t.Fatalf("loaded %08b, saved %08b", got, have)
+	}
+	if loadResume(filepath.Join(t.TempDir(), "missing.resume"), testInfoHash, 11) != nil {
+		t.Error("missing resume file loaded")
+	}
+}
+
+func TestResumeRejected(t *testing.T) {
+	dir := t.TempDir()
+	write := func(data resumeData) string {
+		encoded, err := bencode.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "file.resume")
+		os.WriteFile(path, encoded, 0644)
+		return path
+	}
+
+	for name, data := range map[string]resumeData{
+		"wrong info hash":   {InfoHash: "ff" + testInfoHash[2:], NumPieces: 11, Bitfield: "\xff\xe0"},
+		"wrong piece count": {InfoHash: testInfoHash, NumPieces: 12, Bitfield: "\xff\xe0"},
+		"short bitfield":    {InfoHash: testInfoHash, NumPieces: 11, Bitfield: "\xff"},
+		"long bitfield":     {InfoHash: testInfoHash, NumPieces: 11, Bitfield: "\xff\xe0\x00"},
+		"spare bits set":    {InfoHash: testInfoHash, NumPieces: 11, Bitfield: "\xff\xe1"},
+	} {
+		if got := loadResume(write(data), testInfoHash, 11); got != nil {
+			t.Errorf("%s: loaded %08b", name, got)
+		}
+	}
+	if got := loadResume(write(resumeData{InfoHash: testInfoHash, NumPieces: 11, Bitfield: "\xff\xe0"}), testInfoHash, 11); got == nil {
+		t.Error("full bitfield rejected")
+	}
+
+	path := filepath.Join(dir, "garbage.resume")
+	os.WriteFile(path, []byte("d4:pieces"), 0644)
+	if loadResume(path, testInfoHash, 11) != nil {
+		t.Error("truncated resume file loaded")
+	}
+}
+
+// The resume file is trusted only while every file is complete; otherwise
+// the data on disk is hashed again
+func TestVerifiedPieces(t *testing.T) {
+	dir := t.TempDir()
+	data := randomData(5*16 + 3)
+	torrent := makeTestTorrent("resume.bin", data, 16)
+	numPieces := torrent.numPieces()
+
+	have, err := verifiedPieces(torrent, testInfoHash, dir)
+	if err != nil || have.Count(numPieces) != 0 || len(have) != 1 {
+		t.Fatalf("no data: %08b, %v", have, err)
+	}
+
+	// A resume file claiming only some pieces is believed for complete files
+	path := filepath.Join(dir, "resume.bin")
+	os.WriteFile(path, data, 0644)
+	claimed := newBitfield(numPieces)
+	claimed.SetPiece(1)
+	saveResume(resumeFilePath(torrent, dir), testInfoHash, numPieces, claimed)
+	have, err = verifiedPieces(torrent, testInfoHash, dir)
+	if err != nil || !bytes.Equal(have, claimed) {
+		t.Fatalf("resume file ignored: %08b, %v", have, err)
+	}
+
+	// A torrent with another info hash rechecks, as does a short file
+	have, _ = verifiedPieces(torrent, "ff"+testInfoHash[2:], dir)
+	if have.Count(numPieces) != numPieces {
+		t.Errorf("recheck found %d pieces", have.Count(numPieces))
+	}
+	corrupt := append([]byte(nil), data[:4*16]...)
+	corrupt[20] ^= 0xff
+	os.WriteFile(path, corrupt, 0644)
+	have, _ = verifiedPieces(torrent, testInfoHash, dir)
+	if !have.HasPiece(0) || have.HasPiece(1) || !have.HasPiece(3) || have.HasPiece(4) || have.Count(numPieces) != 3 {
+		t.Errorf("recheck of a short file found %08b", have)
+	}
+}
+
+func TestRunRecheck(t *testing.T) {
+	dir := t.TempDir()
+	data := randomData(4*16 + 5)
+	torrent := makeTestTorrent("recheck.bin", data, 16)
+	torrentPath := filepath.Join(dir, "recheck.torrent")
+	saveTorrent(torrent, torrentPath)
+	_, infoHash, err := openTorrent(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// runRecheck works on the current directory
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	data[40] ^= 0xff
+	os.WriteFile("recheck.bin", data, 0644)
+	runRecheck(torrentPath)
+
+	numPieces := torrent.numPieces()
+	have := loadResume(resumeFilePath(torrent, dir), fmt.Sprintf("%x", infoHash), numPieces)
+	if have == nil || have.HasPiece(2) || have.Count(numPieces) != numPieces-1 {
+		t.Fatalf("resume file after recheck holds %08b", have)
+	}
+}
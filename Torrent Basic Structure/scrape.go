@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"bittorrent-client/bencode"
+)
+
+// Scrapes are only informational, so UDP trackers get fewer retries than for
+// announces: 15, 30 and 60 seconds
+const udpScrapeRetries = 2
+
+// What one tracker said about a torrent when scraped
+type trackerScrape struct {
+	tracker string
+	stats   scrapeStats
+	err     error
+}
+
+// Derive an HTTP tracker's scrape URL from its announce URL. By convention
+// the last path segment starts with "announce", which becomes "scrape"; a
+// tracker whose announce URL doesn't follow it can't be scraped.
+func scrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announce)
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	return u.String(), nil
+}
+
+// Scrape an HTTP tracker for one torrent
+func scrapeHTTP(announce string, infoHash []byte) (scrapeStats, error) {
+	var stats scrapeStats
+	scrape, err := scrapeURL(announce)
+	if err != nil {
+		return stats, err
+	}
+	separator := "?"
+	if strings.Contains(scrape, "?") {
+		separator = "&"
+	}
+	resp, err := trackerClient.Get(scrape + separator + url.Values{"info_hash": {string(infoHash)}}.Encode())
+	if err != nil {
+		return stats, fmt.Errorf("error sending GET request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The files dictionary is keyed by raw info hashes, so the response is
+	// decoded generically
+	var decoded interface{}
+	err = bencode.NewDecoder(resp.Body).Decode(&decoded)
+	if err != nil {
+		return stats, fmt.Errorf("error unmarshalling scrape response: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return stats, fmt.Errorf("scrape response is not a dictionary")
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return stats, fmt.Errorf("tracker error: %s", reason)
+	}
+	files, _ := dict["files"].(map[string]interface{})
+	file, ok := files[string(infoHash)].(map[string]interface{})
+	if !ok {
+		return stats, fmt.Errorf("tracker %s does not know the torrent", announce)
+	}
+	integer := func(key string) int {
+		n, _ := file[key].(int64)
+		return int(n)
+	}
+	stats.seeders = integer("complete")
+	stats.completed = integer("downloaded")
+	stats.leechers = integer("incomplete")
+	return stats, nil
+}
+
+// Scrape the tracker at announce, over HTTP or UDP depending on its scheme
+func scrapeTracker(announce string, infoHash []byte) (scrapeStats, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return scrapeStats{}, fmt.Errorf("invalid tracker URL %s: %v", announce, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(announce, infoHash)
+	case "udp":
+		tracker, err := udpTrackerFor(announce)
+		if err != nil {
+			return scrapeStats{}, err
+		}
+		stats, err := tracker.scrape([][]byte{infoHash})
+		if err != nil {
+			return scrapeStats{}, err
+		}
+		return stats[0], nil
+	}
+	return scrapeStats{}, fmt.Errorf("unsupported tracker %s", announce)
+}
+
+// Scrape every tracker of every tier at once and return the results in tier
+// order
+func (tiers trackerTiers) scrape(infoHash []byte) []trackerScrape {
+	var results []trackerScrape
+	for _, tier := range tiers {
+		for _, tracker := range tier {
+			results = append(results, trackerScrape{tracker: tracker})
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(result *trackerScrape) {
+			defer wg.Done()
+			result.stats, result.err = scrapeTracker(result.tracker, infoHash)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// The numbers of the tracker that knows of the most peers, as the best
+// estimate of the swarm's size; false if no tracker answered
+func bestScrape(results []trackerScrape) (scrapeStats, bool) {
+	var best scrapeStats
+	found := false
+	for _, result := range results {
+		if result.err != nil {
+			continue
+		}
+		if !found || result.stats.seeders+result.stats.leechers > best.seeders+best.leechers {
+			best = result.stats
+		}
+		found = true
+	}
+	return best, found
+}
+
+func (s scrapeStats) summary() string {
+	return fmt.Sprintf("%d seeders, %d leechers, %d completed", s.seeders, s.leechers, s.completed)
+}
+
+// Print what each of a torrent's trackers knows about its swarm
+func runScrape(filePath string) {
+	torrent, infoHashSum, err := openTorrent(filePath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	tiers := newTrackerTiers(torrent)
+	if len(tiers) == 0 {
+		fmt.Println("Torrent has no trackers")
+		return
+	}
+	fmt.Printf("Info Hash: %x\n", infoHashSum)
+	for _, result := range tiers.scrape(infoHashSum) {
+		if result.err != nil {
+			fmt.Printf("%s: %v\n", result.tracker, result.err)
+			continue
+		}
+		fmt.Printf("%s: %s\n", result.tracker, result.stats.summary())
+	}
+}
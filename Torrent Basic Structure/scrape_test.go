@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bittorrent-client/bencode"
+)
+
+func TestScrapeURL(t *testing.T) {
+	for announce, want := range map[string]string{
+		"http://tracker.example/announce":           "http://tracker.example/scrape",
+		"http://tracker.example/x/announce.php?k=1": "http://tracker.example/x/scrape.php?k=1",
+		"https://tracker.example:8443/announce?a=b": "https://tracker.example:8443/scrape?a=b",
+		"http://tracker.example/a":                  "",
+		"http://tracker.example/announce/x":         "",
+	} {
+		got, err := scrapeURL(announce)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s gave scrape URL %s", announce, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("%s gave %s, %v", announce, got, err)
+		}
+	}
+}
+
+func TestScrapeTrackers(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{7}, 20)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || r.URL.Query().Get("info_hash") != string(infoHash) {
+			bencode.NewEncoder(w).Encode(map[string]interface{}{"failure reason": "bad scrape"})
+			return
+		}
+		bencode.NewEncoder(w).Encode(map[string]interface{}{
+			"files": map[string]interface{}{
+				string(infoHash): map[string]interface{}{"complete": 4, "downloaded": 10, "incomplete": 2},
+			},
+		})
+	}))
+	defer server.Close()
+	udp := startFakeUDPTracker(t)
+
+	tiers := trackerTiers{
+		{server.URL + "/announce", server.URL + "/other"},
+		{"udp://" + udp.address()},
+	}
+	results := tiers.scrape(infoHash)
+	if len(results) != 3 {
+		t.Fatalf("%d results", len(results))
+	}
+	if results[0].err != nil || results[0].stats != (scrapeStats{seeders: 4, completed: 10, leechers: 2}) {
+		t.Fatalf("HTTP scrape gave %+v, %v", results[0].stats, results[0].err)
+	}
+	if results[1].err == nil {
+		t.Fatal("tracker without a scrape URL was scraped")
+	}
+	// The fake UDP tracker derives the numbers from the info hash
+	if results[2].err != nil || results[2].stats != (scrapeStats{seeders: 7, completed: 14, leechers: 8}) {
+		t.Fatalf("UDP scrape gave %+v, %v", results[2].stats, results[2].err)
+	}
+
+	best, ok := bestScrape(results)
+	if !ok || best.seeders != 7 {
+		t.Fatalf("best scrape %+v", best)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Most connections we keep at once; incoming peers beyond this are refused
+const maxPeers = 50
+
+// Largest block a peer may request. BEP 3 blocks are 16 KiB, but some older
+// clients ask for up to 128 KiB.
+const maxRequestLength = 128 << 10
+
+// Accept incoming peers on port in the background until the listener is closed
+func (d *downloader) listen(port int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	d.listening = true
+	fmt.Printf("Listening for peers on %s\n", listener.Addr())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.acceptPeer(conn)
+		}
+	}()
+	return listener, nil
+}
+
+// Answer the handshake of an incoming peer and hand the connection to the
+// scheduler. Peers asking for a different torrent are dropped.
+func (d *downloader) acceptPeer(conn net.Conn) {
+	address := conn.RemoteAddr().String()
+
+	conn.SetDeadline(time.Now().Add(peerReadTimeout))
+	handshake := make([]byte, 68)
+	_, err := io.ReadFull(conn, handshake)
+	if err != nil {
+		fmt.Printf("Error reading handshake from peer %s: %v\n", address, err)
+		conn.Close()
+		return
+	}
+	// Hybrid torrents are joined with either info hash; answer with the one
+	// the peer asked for
+	ourHashes := [][]byte{nil}
+	ourHashes[0], _ = hex.DecodeString(d.infoHashHex)
+	if d.torrent.v2 != nil && d.torrent.v2.hybrid {
+		ourHashes = append(ourHashes, d.torrent.v2.infoHash[:20])
+	}
+	var ourHash []byte
+	for _, ourHash = range ourHashes {
+		_, err = checkHandshake(handshake, ourHash, d.peerID)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		fmt.Printf("Rejected peer %s: %v\n", address, err)
+		conn.Close()
+		return
+	}
+
+	_, err = conn.Write(d.handshake(hex.EncodeToString(ourHash)))
+	if err != nil {
+		fmt.Printf("Error sending handshake to peer %s: %v\n", address, err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	fmt.Printf("Accepted connection from peer %s\n", address)
+
+	select {
+	case d.newConns <- incomingConn{conn: conn, extensions: supportsExtensions(handshake)}:
+	case <-d.quit:
+		conn.Close()
+	}
+}
+
+// Our handshake for the torrent, offering v2 hash requests when the torrent
+// has merkle trees to serve them from
+func (d *downloader) handshake(infoHashHex string) []byte {
+	handshake := createHandshake(infoHashHex, d.peerID)
+	if d.torrent.v2 != nil {
+		offerV2(handshake)
+	}
+	return handshake
+}
+
+// A connection accepted by the listener, after the handshake
+type incomingConn struct {
+	conn       net.Conn
+	extensions bool // The peer supports BEP 10
+}
+
+// Start a session with an accepted peer. Called by the scheduler goroutine.
+func (d *downloader) addIncomingPeer(incoming incomingConn) {
+	conn := incoming.conn
+	if d.livePeers() >= maxPeers {
+		conn.Close()
+		return
+	}
+	slot := d.newPeerSlot(conn.RemoteAddr().String())
+	slot.incoming = true
+	go func() {
+		defer d.notify(peerEvent{peer: slot, kind: peerGone})
+		defer conn.Close()
+		d.runPeer(slot, conn, incoming.extensions)
+	}()
+}
+
+func (d *downloader) haveSnapshot() Bitfield {
+	d.haveMu.RLock()
+	defer d.haveMu.RUnlock()
+	return append(Bitfield(nil), d.have...)
+}
+
+// What a peer has been told about our pieces: the pieces in the bitfield and
+// haves sent so far, how far through haveLog that goes, and how many pieces
+// the peer has that are not among them, which is what keeps us interested
+type announcement struct {
+	pieces  Bitfield
+	logged  int
+	missing int
+}
+
+func (d *downloader) newAnnouncement() *announcement {
+	d.haveMu.RLock()
+	defer d.haveMu.RUnlock()
+	return &announcement{pieces: append(Bitfield(nil), d.have...), logged: len(d.haveLog)}
+}
+
+// Send have messages for the pieces we finished since we last told the peer,
+// skipping the ones it already has. Only the pieces verified since the last
+// call are looked at.
+func (d *downloader) syncPeer(peer *peerConn, announced *announcement) error {
+	d.haveMu.RLock()
+	verified := append([]int(nil), d.haveLog[announced.logged:]...)
+	announced.logged = len(d.haveLog)
+	d.haveMu.RUnlock()
+
+	for _, index := range verified {
+		if announced.pieces.HasPiece(index) {
+			continue
+		}
+		announced.pieces.SetPiece(index)
+		if peer.bitfield.HasPiece(index) {
+			announced.missing--
+			continue
+		}
+		err := peer.sendHave(index)
+		if err != nil {
+			return fmt.Errorf("error sending have for piece %d: %w", index, err)
+		}
+	}
+	return peer.setInterested(announced.missing > 0)
+}
+
+// We are interested in a peer as long as it has a piece we are missing.
+// Counts them all again, for when the peer sends its bitfield.
+func (d *downloader) updateInterest(peer *peerConn, announced *announcement) error {
+	announced.missing = 0
+	for i, b := range peer.bitfield {
+		if b&^announced.pieces[i] == 0 {
+			continue
+		}
+		for index := i * 8; index < (i+1)*8; index++ {
+			if peer.bitfield.HasPiece(index) && !announced.pieces.HasPiece(index) {
+				announced.missing++
+			}
+		}
+	}
+	return peer.setInterested(announced.missing > 0)
+}
+
+func (d *downloader) isSeed(peer *peerConn) bool {
+	return peer.pieces == d.numPieces
+}
+
+// Answer a request with the block read back from disk. Requests while the
+// peer is choked are dropped, as the peer discards them itself on choke.
+func (d *downloader) serveRequest(slot *peerSlot, peer *peerConn, m *message) error {
+	if peer.amChoking {
+		return nil
+	}
+	index, begin, length, _ := parseRequest(m)
+	if index >= d.numPieces || length == 0 || length > maxRequestLength || begin+length > d.torrent.pieceSize(index) {
+		return fmt.Errorf("invalid request for %d bytes at offset %d of piece %d", length, begin, index)
+	}
+	d.haveMu.RLock()
+	have := d.have.HasPiece(index)
+	d.haveMu.RUnlock()
+	if !have {
+		return fmt.Errorf("request for piece %d, which we don't have", index)
+	}
+
+	block, err := d.storage.ReadBlock(index, begin, length)
+	if err != nil {
+		return fmt.Errorf("error reading piece %d: %w", index, err)
+	}
+	err = peer.send(formatPiece(index, begin, block))
+	if err != nil {
+		return fmt.Errorf("error sending block of piece %d: %w", index, err)
+	}
+	atomic.AddInt64(&d.uploaded, int64(length))
+	slot.uploadRate.add(length)
+	return nil
+}
+
+// Bytes uploaded per byte of torrent data; 0 for a torrent of empty files,
+// which has nothing to upload
+func (d *downloader) shareRatio() float64 {
+	length := d.torrent.dataLength()
+	if length == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&d.uploaded)) / float64(length)
+}
+
+// Keep uploading after the download until the share ratio or seeding time
+// limit is reached, or until nobody is left who could download from us
+func (d *downloader) seed() {
+	if d.torrent.dataLength() == 0 {
+		fmt.Println("Nothing to seed: the torrent holds no data")
+		return
+	}
+	fmt.Printf("Seeding %s\n", d.torrent.Info.Name)
+
+	var deadline <-chan time.Time
+	if d.config.seedTime > 0 {
+		timer := time.NewTimer(d.config.seedTime)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+loop:
+	for {
+		if d.config.seedRatio > 0 && d.shareRatio() >= d.config.seedRatio {
+			fmt.Printf("Reached share ratio %.2f\n", d.config.seedRatio)
+			break
+		}
+		d.connectCandidates()
+		if !d.listening && d.livePeers() == 0 {
+			fmt.Println("No peers left to seed to")
+			break
+		}
+
+		select {
+		case ev := <-d.events:
+			d.handleEvent(ev)
+		case incoming := <-d.newConns:
+			d.addIncomingPeer(incoming)
+		case update := <-d.discovered:
+			d.handleDiscovered(update)
+		case found := <-d.found:
+			d.addPeers(found)
+		case <-d.chokeTick:
+			d.sampleRates()
+			d.rechoke()
+		case result := <-d.results:
+			d.handleResult(result) // Late endgame duplicates, ignored
+		case <-ticker.C:
+		case <-deadline:
+			fmt.Printf("Seeding time limit of %v reached\n", d.config.seedTime)
+			break loop
+		case <-d.config.interrupt:
+			break loop
+		}
+	}
+	fmt.Printf("Stopped seeding: uploaded %d bytes, share ratio %.2f\n", atomic.LoadInt64(&d.uploaded), d.shareRatio())
+}
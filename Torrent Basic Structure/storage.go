@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A single file of the torrent, placed in the global byte space of all pieces
+type fileEntry struct {
+	path    string // Location on disk; empty for padding
+	length  int64
+	offset  int64 // Offset of the file's first byte in the torrent data
+	padding bool  // Zeros that align the next file, not stored (BEP 47)
+}
+
+// Map the torrent's files onto paths below baseDir. Single-file torrents are
+// stored as baseDir/Name, multi-file torrents as baseDir/Name/Path...
+func (t TorrentFile) fileLayout(baseDir string) ([]fileEntry, error) {
+	name, err := sanitizePathComponent(t.Info.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(t.Info.Files) == 0 {
+		return []fileEntry{{path: filepath.Join(baseDir, name), length: int64(t.Info.Length)}}, nil
+	}
+
+	var files []fileEntry
+	var offset int64
+	for _, f := range t.Info.Files {
+		if f.isPadding() {
+			files = append(files, fileEntry{length: int64(f.Length), offset: offset, padding: true})
+			offset += int64(f.Length)
+			continue
+		}
+		if len(f.Path) == 0 {
+			return nil, fmt.Errorf("file entry with empty path")
+		}
+		parts := []string{baseDir, name}
+		for _, part := range f.Path {
+			part, err = sanitizePathComponent(part)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		}
+		files = append(files, fileEntry{path: filepath.Join(parts...), length: int64(f.Length), offset: offset})
+		offset += int64(f.Length)
+	}
+	return files, nil
+}
+
+// Reject path components that would escape the download directory
+func sanitizePathComponent(part string) (string, error) {
+	if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\") {
+		return "", fmt.Errorf("invalid path component %q in torrent", part)
+	}
+	return part, nil
+}
+
+// PieceStorage persists verified pieces as soon as they are downloaded and
+// reads them back for peers we upload to
+type PieceStorage interface {
+	WritePiece(index int, data []byte) error
+	ReadPiece(index int, length int) ([]byte, error)
+	ReadBlock(index int, begin int, length int) ([]byte, error)
+	Close() error
+}
+
+// fileStorage writes pieces into the files of a torrent, splitting writes
+// that span file boundaries
+type fileStorage struct {
+	files       []fileEntry
+	handles     []*os.File
+	pieceLength int64
+}
+
+// Create the directory tree and open (or create) every file of the torrent.
+// Files are sized up front so pieces can be written at their offset in any
+// order; on most filesystems this leaves them sparse until data arrives.
+func newFileStorage(torrent TorrentFile, baseDir string) (*fileStorage, error) {
+	files, err := torrent.fileLayout(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileStorage{files: files, pieceLength: int64(torrent.Info.PieceLength)}
+	for _, f := range files {
+		if f.padding {
+			s.handles = append(s.handles, nil)
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(f.path), 0755)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("error creating directory for %s: %w", f.path, err)
+		}
+		handle, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("error opening %s: %w", f.path, err)
+		}
+		s.handles = append(s.handles, handle)
+
+		err = handle.Truncate(f.length)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("error allocating %s: %w", f.path, err)
+		}
+	}
+	return s, nil
+}
+
+// Open the files of an earlier download for reading only. Missing files are
+// tolerated; reading pieces that fall into them fails.
+func openFileStorage(torrent TorrentFile, baseDir string) (*fileStorage, error) {
+	files, err := torrent.fileLayout(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileStorage{files: files, pieceLength: int64(torrent.Info.PieceLength)}
+	for _, f := range files {
+		if f.padding {
+			s.handles = append(s.handles, nil)
+			continue
+		}
+		handle, err := os.Open(f.path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.Close()
+				return nil, fmt.Errorf("error opening %s: %w", f.path, err)
+			}
+			handle = nil
+		}
+		s.handles = append(s.handles, handle)
+	}
+	return s, nil
+}
+
+// Write a verified piece at its position in the torrent data
+func (s *fileStorage) WritePiece(index int, data []byte) error {
+	return s.writeAt(data, int64(index)*s.pieceLength)
+}
+
+// Write data starting at offset in the global byte space, across as many
+// files as it covers
+func (s *fileStorage) writeAt(data []byte, offset int64) error {
+	for i, f := range s.files {
+		if len(data) == 0 {
+			break
+		}
+		if offset >= f.offset+f.length {
+			continue
+		}
+		fileOffset := offset - f.offset
+		n := f.length - fileOffset
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+		if !f.padding {
+			_, err := s.handles[i].WriteAt(data[:n], fileOffset)
+			if err != nil {
+				return fmt.Errorf("error writing %s: %w", f.path, err)
+			}
+		}
+		data = data[n:]
+		offset += n
+	}
+	if len(data) > 0 {
+		return fmt.Errorf("write of %d bytes past the end of the torrent data", len(data))
+	}
+	return nil
+}
+
+func (s *fileStorage) ReadPiece(index int, length int) ([]byte, error) {
+	data := make([]byte, length)
+	err := s.readAt(data, int64(index)*s.pieceLength)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Read part of a piece, as asked for by a request message
+func (s *fileStorage) ReadBlock(index int, begin int, length int) ([]byte, error) {
+	data := make([]byte, length)
+	err := s.readAt(data, int64(index)*s.pieceLength+int64(begin))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Fill data from offset in the global byte space
+func (s *fileStorage) readAt(data []byte, offset int64) error {
+	for i, f := range s.files {
+		if len(data) == 0 {
+			break
+		}
+		if offset >= f.offset+f.length {
+			continue
+		}
+		if s.handles[i] == nil && !f.padding {
+			return fmt.Errorf("%s is missing", f.path)
+		}
+		fileOffset := offset - f.offset
+		n := f.length - fileOffset
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+		if f.padding {
+			for j := range data[:n] {
+				data[j] = 0
+			}
+		} else {
+			_, err := s.handles[i].ReadAt(data[:n], fileOffset)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %w", f.path, err)
+			}
+		}
+		data = data[n:]
+		offset += n
+	}
+	if len(data) > 0 {
+		return fmt.Errorf("read of %d bytes past the end of the torrent data", len(data))
+	}
+	return nil
+}
+
+func (s *fileStorage) Close() error {
+	var firstErr error
+	for _, handle := range s.handles {
+		if handle == nil {
+			continue
+		}
+		err := handle.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A multi-file torrent of 16-byte pieces: a (10 bytes), an empty file, b (5
+// bytes), 17 bytes of padding, then c (20 bytes)
+func makeStorageTorrent() TorrentFile {
+	var torrent TorrentFile
+	torrent.Info.Name = "multi"
+	torrent.Info.PieceLength = 16
+	torrent.Info.Files = []torrentFileEntry{
+		{Length: 10, Path: []string{"a"}},
+		{Length: 0, Path: []string{"empty"}},
+		{Length: 5, Path: []string{"sub", "b"}},
+		{Length: 17, Path: []string{".pad", "17"}, Attr: "p"},
+		{Length: 20, Path: []string{"sub", "c"}},
+	}
+	return torrent
+}
+
+func TestFileLayout(t *testing.T) {
+	dir := t.TempDir()
+	files, err := makeStorageTorrent().fileLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fileEntry{
+		{path: filepath.Join(dir, "multi", "a"), length: 10, offset: 0},
+		{path: filepath.Join(dir, "multi", "empty"), length: 0, offset: 10},
+		{path: filepath.Join(dir, "multi", "sub", "b"), length: 5, offset: 10},
+		{length: 17, offset: 15, padding: true},
+		{path: filepath.Join(dir, "multi", "sub", "c"), length: 20, offset: 32},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("%d files", len(files))
+	}
+	for i := range want {
+		if files[i] != want[i] {
+			t.Errorf("file %d: got %+v, want %+v", i, files[i], want[i])
+		}
+	}
+
+	single := makeTestTorrent("one.bin", make([]byte, 100), 16)
+	files, err = single.fileLayout(dir)
+	if err != nil || len(files) != 1 || files[0].path != filepath.Join(dir, "one.bin") || files[0].length != 100 {
+		t.Fatalf("single file layout %+v: %v", files, err)
+	}
+}
+
+func TestFileLayoutRejectsEscapes(t *testing.T) {
+	for _, part := range []string{"", ".", "..", "/etc", "a/b", `a\b`, `C:\Windows`} {
+		if _, err := sanitizePathComponent(part); err == nil {
+			t.Errorf("path component %q accepted", part)
+		}
+		torrent := makeStorageTorrent()
+		torrent.Info.Files[2].Path = []string{"sub", part}
+		if _, err := torrent.fileLayout(t.TempDir()); err == nil {
+			t.Errorf("file path %q accepted", part)
+		}
+		torrent = makeStorageTorrent()
+		torrent.Info.Name = part
+		if _, err := torrent.fileLayout(t.TempDir()); err == nil {
+			t.Errorf("name %q accepted", part)
+		}
+	}
+	torrent := makeStorageTorrent()
+	torrent.Info.Files[0].Path = nil
+	if _, err := torrent.fileLayout(t.TempDir()); err == nil {
+		t.Error("file without a path accepted")
+	}
+	if _, err := sanitizePathComponent("..."); err != nil {
+		t.Errorf("plain name rejected: %v", err)
+	}
+}
+
+func TestFileStorageAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	torrent := makeStorageTorrent()
+	storage, err := newFileStorage(torrent, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	data := make([]byte, 52)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+
+	// A block from the middle of a across the empty file and b into the
+	// padding, then whole pieces. What lands in the padding is dropped.
+	err = storage.writeAt(data[5:20], 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := 0; index < 4; index++ {
+		end := (index + 1) * 16
+		if end > len(data) {
+			end = len(data)
+		}
+		err = storage.WritePiece(index, data[index*16:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = storage.writeAt([]byte{1}, 52); err == nil {
+		t.Error("write past the end succeeded")
+	}
+
+	for name, want := range map[string][]byte{"a": data[0:10], "empty": {}, "sub/b": data[10:15], "sub/c": data[32:52]} {
+		got, err := os.ReadFile(filepath.Join(dir, "multi", filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s holds %v: %v", name, got, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "multi", ".pad")); err == nil {
+		t.Error("padding was written to disk")
+	}
+
+	// Reads span the same boundaries, with zeros for the padding
+	for i := 15; i < 32; i++ {
+		data[i] = 0
+	}
+	got := make([]byte, 30)
+	err = storage.readAt(got, 8)
+	if err != nil || !bytes.Equal(got, data[8:38]) {
+		t.Fatalf("read %v: %v", got, err)
+	}
+	block, err := storage.ReadBlock(2, 4, 12)
+	if err != nil || !bytes.Equal(block, data[36:48]) {
+		t.Fatalf("block %v: %v", block, err)
+	}
+	if _, err = storage.ReadPiece(3, 5); err == nil {
+		t.Error("read past the end succeeded")
+	}
+
+	// A missing file fails only the reads that need it
+	storage.Close()
+	os.Remove(filepath.Join(dir, "multi", "sub", "c"))
+	storage, err = openFileStorage(torrent, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if piece, err := storage.ReadPiece(0, 16); err != nil || !bytes.Equal(piece, data[:16]) {
+		t.Errorf("piece 0 read as %v: %v", piece, err)
+	}
+	if _, err = storage.ReadPiece(2, 16); err == nil {
+		t.Error("piece of a missing file read")
+	}
+}
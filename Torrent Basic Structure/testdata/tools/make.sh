@@ -0,0 +1,29 @@
+#!/bin/sh
+# Build torrents with real torrent tools for the info hash corpus and record
+# the info hashes those tools report, which the tests check our hashing
+# against. Needs mktorrent and transmission-cli; run from this directory.
+set -e
+
+work=$(mktemp -d)
+trap 'rm -rf "$work"' EXIT
+
+# A single private file with a source tag
+printf 'private data\n' > "$work/private.iso"
+rm -f mktorrent-private.torrent
+mktorrent -p -s TESTSRC -a http://tracker.example/announce -l 15 \
+	-o mktorrent-private.torrent "$work/private.iso"
+
+# A multi-file directory
+mkdir -p "$work/Multi/sub"
+printf 'first file\n' > "$work/Multi/a.txt"
+head -c 40000 /dev/zero > "$work/Multi/sub/b.bin"
+rm -f transmission-multi.torrent
+transmission-create -t http://tracker.example/announce -s 16 \
+	-o transmission-multi.torrent "$work/Multi"
+
+: > hashes.txt
+for torrent in *.torrent; do
+	hash=$(transmission-show "$torrent" | awk '$1 == "Hash:" { print $2; exit }')
+	echo "$hash  $torrent" >> hashes.txt
+done
+cat hashes.txt
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bittorrent-client/bencode"
+)
+
+// Announce events
+const (
+	eventNone      = ""
+	eventStarted   = "started"
+	eventCompleted = "completed"
+	eventStopped   = "stopped"
+)
+
+// What we tell a tracker when announcing
+type announceParams struct {
+	infoHash   []byte
+	peerID     string
+	port       int
+	uploaded   int64  // Bytes of piece data sent to peers
+	downloaded int64  // Bytes of piece data received from peers
+	left       int64  // Bytes we still need
+	event      string // One of the event constants
+
+	// Someone is waiting for the answer before going on, so UDP trackers
+	// get only a few retries; closing cancel gives up on them at once
+	foreground bool
+	cancel     <-chan struct{}
+
+	// Tracker IDs handed out by HTTP trackers, by announce URL; nil if
+	// they aren't kept
+	trackerIDs map[string]string
+}
+
+// HTTP requests to trackers give up after this long
+var trackerClient = &http.Client{Timeout: 30 * time.Second}
+
+// Announce to an HTTP tracker and return its response along with the peers
+// it listed
+func announceHTTP(announce string, p announceParams) (TrackerResponse, []string, error) {
+	var trackerResp TrackerResponse
+
+	// Construct the tracker URL
+	params := url.Values{
+		"info_hash":  {string(p.infoHash)},
+		"peer_id":    {p.peerID},
+		"port":       {fmt.Sprintf("%d", p.port)},
+		"uploaded":   {fmt.Sprintf("%d", p.uploaded)},
+		"downloaded": {fmt.Sprintf("%d", p.downloaded)},
+		"left":       {fmt.Sprintf("%d", p.left)},
+		"compact":    {"1"},
+	}
+	if p.event != eventNone {
+		params.Set("event", p.event)
+	}
+	if id := p.trackerIDs[announce]; id != "" {
+		params.Set("trackerid", id)
+	}
+	trackerURL := fmt.Sprintf("%s?%s", announce, params.Encode())
+
+	// Send GET request to the tracker
+	resp, err := trackerClient.Get(trackerURL)
+	if err != nil {
+		return trackerResp, nil, fmt.Errorf("error sending GET request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	trackerResp, peers, err := parseTrackerResponse(resp.Body)
+	if err != nil {
+		return trackerResp, nil, fmt.Errorf("error unmarshalling tracker response: %v", err)
+	}
+
+	if trackerResp.FailureReason != "" {
+		return trackerResp, nil, fmt.Errorf("tracker error: %s", trackerResp.FailureReason)
+	}
+
+	var peerAddresses []string
+	for _, peer := range peers {
+		peerAddresses = append(peerAddresses, peer.address())
+	}
+	return trackerResp, peerAddresses, nil
+}
+
+// A peer listed by a tracker. Only dictionary-model responses tell its ID.
+type trackerPeer struct {
+	host string // IP address, or a DNS name in dictionary-model responses
+	port int
+	id   string
+}
+
+func (p trackerPeer) address() string {
+	return net.JoinHostPort(p.host, strconv.Itoa(p.port))
+}
+
+// Decode an HTTP tracker's response. peers is either a compact string or,
+// from trackers that ignore compact=1, a list of dictionaries with ip, port
+// and peer id; IPv6 peers come as a compact peers6 string. The list can't be
+// unmarshalled into a struct field, so the response is decoded generically.
+// Malformed peer entries are skipped rather than failing the announce.
+func parseTrackerResponse(r io.Reader) (TrackerResponse, []trackerPeer, error) {
+	var resp TrackerResponse
+	var decoded interface{}
+	err := bencode.NewDecoder(r).Decode(&decoded)
+	if err != nil {
+		return resp, nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return resp, nil, fmt.Errorf("response is not a dictionary")
+	}
+	resp.FailureReason, _ = dict["failure reason"].(string)
+	resp.WarningReason, _ = dict["warning reason"].(string)
+	resp.TrackerID, _ = dict["tracker id"].(string)
+	resp.Peers6, _ = dict["peers6"].(string)
+	integer := func(key string) int {
+		n, _ := dict[key].(int64)
+		return int(n)
+	}
+	resp.Interval = integer("interval")
+	resp.MinInterval = integer("min interval")
+	resp.Complete = integer("complete")
+	resp.Incomplete = integer("incomplete")
+
+	var peers []trackerPeer
+	switch list := dict["peers"].(type) {
+	case string:
+		resp.Peers = list
+		peers = compactTrackerPeers([]byte(list), net.IPv4len)
+	case []interface{}:
+		for _, entry := range list {
+			entry, ok := entry.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			host, _ := entry["ip"].(string)
+			port, _ := entry["port"].(int64)
+			id, _ := entry["peer id"].(string)
+			if host == "" || port <= 0 || port > 65535 {
+				continue
+			}
+			peers = append(peers, trackerPeer{host: host, port: int(port), id: id})
+		}
+	}
+	peers = append(peers, compactTrackerPeers([]byte(resp.Peers6), net.IPv6len)...)
+	return resp, peers, nil
+}
+
+// Decode a tracker's compact peer list, ignoring a trailing partial entry
+func compactTrackerPeers(compact []byte, ipLen int) []trackerPeer {
+	var peers []trackerPeer
+	for i := 0; i+ipLen+2 <= len(compact); i += ipLen + 2 {
+		ip := net.IP(compact[i : i+ipLen])
+		port := int(compact[i+ipLen])<<8 + int(compact[i+ipLen+1])
+		peers = append(peers, trackerPeer{host: ip.String(), port: port})
+	}
+	return peers
+}
+
+// Decode a compact peer list: each entry is an ipLen-byte address followed
+// by a 2-byte port, as used by trackers and PEX
+func parseCompactPeers(peers []byte, ipLen int) ([]string, error) {
+	entry := ipLen + 2
+	if len(peers)%entry != 0 {
+		return nil, fmt.Errorf("compact peer list of length %d", len(peers))
+	}
+	var addresses []string
+	for i := 0; i < len(peers); i += entry {
+		ip := net.IP(peers[i : i+ipLen])
+		port := int(peers[i+ipLen])<<8 + int(peers[i+ipLen+1])
+		addresses = append(addresses, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	return addresses, nil
+}
+
+// Append the peers in more that aren't in peers yet
+func mergePeers(peers []string, more []string) []string {
+	seen := make(map[string]bool)
+	for _, address := range peers {
+		seen[address] = true
+	}
+	for _, address := range more {
+		if !seen[address] {
+			seen[address] = true
+			peers = append(peers, address)
+		}
+	}
+	return peers
+}
+
+// A torrent's trackers in BEP 12 tiers. Tiers are tried in order and the
+// first in which a tracker answers is used. Within that tier every tracker is
+// asked, so the peers of backup trackers are merged in, and the trackers that
+// answered move to the front so they are asked first next time.
+type trackerTiers [][]string
+
+// Tiers from the announce-list, each shuffled as BEP 12 asks, or the single
+// announce URL when there is no announce-list
+func newTrackerTiers(torrent TorrentFile) trackerTiers {
+	var tiers trackerTiers
+	for _, tier := range torrent.AnnounceList {
+		if len(tier) == 0 {
+			continue
+		}
+		shuffled := append([]string(nil), tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		tiers = append(tiers, shuffled)
+	}
+	if len(tiers) == 0 && torrent.Announce != "" {
+		tiers = trackerTiers{{torrent.Announce}}
+	}
+	return tiers
+}
+
+// Announce to the tiers in order until a tracker in one answers and return
+// the peers of that tier, without duplicates, and how long to wait before the
+// next regular announce: the shortest interval its trackers asked for, but no
+// shorter than any of their min intervals. Fails only if no tracker answers.
+func (tiers trackerTiers) announce(params announceParams) ([]string, time.Duration, error) {
+	var lastErr error
+	for _, tier := range tiers {
+		answers, err := announceTier(tier, params)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var peers []string
+		interval, minInterval := 0, 0
+		for _, a := range answers {
+			if a.resp.TrackerID != "" && params.trackerIDs != nil {
+				params.trackerIDs[a.tracker] = a.resp.TrackerID
+			}
+			peers = mergePeers(peers, a.peers)
+			if a.resp.Interval > 0 && (interval == 0 || a.resp.Interval < interval) {
+				interval = a.resp.Interval
+			}
+			if a.resp.MinInterval > minInterval {
+				minInterval = a.resp.MinInterval
+			}
+		}
+		if interval < minInterval {
+			interval = minInterval
+		}
+		return peers, time.Duration(interval) * time.Second, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no trackers")
+	}
+	return nil, 0, lastErr
+}
+
+// A tracker's answer to an announce
+type trackerAnswer struct {
+	tracker string
+	resp    TrackerResponse
+	peers   []string
+}
+
+// Announce to every tracker of one tier at the same time, so a dead one
+// doesn't hold up the others, and move the ones that answer to the front in
+// their order. Fails if none answers.
+func announceTier(tier []string, params announceParams) ([]trackerAnswer, error) {
+	type result struct {
+		trackerAnswer
+		err error
+	}
+	results := make([]result, len(tier))
+	var wg sync.WaitGroup
+	for i, tracker := range tier {
+		// Each tracker reads its own copy of the tracker IDs; new ones are
+		// stored once all are done
+		trackerParams := params
+		if params.trackerIDs != nil {
+			trackerParams.trackerIDs = make(map[string]string, len(params.trackerIDs))
+			for other, id := range params.trackerIDs {
+				trackerParams.trackerIDs[other] = id
+			}
+		}
+		wg.Add(1)
+		go func(r *result, tracker string) {
+			defer wg.Done()
+			r.tracker = tracker
+			r.resp, r.peers, r.err = announceTracker(tracker, trackerParams)
+		}(&results[i], tracker)
+	}
+	wg.Wait()
+
+	var answers []trackerAnswer
+	var failed []string
+	var lastErr error
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Printf("Error announcing to %s: %v\n", r.tracker, r.err)
+			failed = append(failed, r.tracker)
+			lastErr = r.err
+			continue
+		}
+		if r.resp.WarningReason != "" {
+			fmt.Printf("Warning from tracker %s: %s\n", r.tracker, r.resp.WarningReason)
+		}
+		fmt.Printf("Tracker %s returned %d peers (%d seeders, %d leechers)\n", r.tracker, len(r.peers), r.resp.Complete, r.resp.Incomplete)
+		answers = append(answers, r.trackerAnswer)
+	}
+	if len(answers) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("empty tracker tier")
+		}
+		return nil, lastErr
+	}
+	for i, a := range answers {
+		tier[i] = a.tracker
+	}
+	copy(tier[len(answers):], failed)
+	return answers, nil
+}
+
+// Regular announces happen this often if the trackers don't say
+const defaultAnnounceInterval = 30 * time.Minute
+
+// After every tracker failed, try again this much later
+const trackerRetryInterval = 5 * time.Minute
+
+// trackerSession announces one download to its trackers: started when it
+// begins, then regularly at the interval the trackers ask for, completed when
+// the last piece is verified and stopped when it ends
+type trackerSession struct {
+	tiers    trackerTiers
+	infoHash []byte
+	peerID   string
+	port     int
+	interval time.Duration // Until the next regular announce
+
+	trackerIDs map[string]string // Passed on to announceHTTP
+}
+
+// A session for the torrent's trackers, or nil if it has none
+func newTrackerSession(torrent TorrentFile, infoHash []byte, peerID string, port int) *trackerSession {
+	tiers := newTrackerTiers(torrent)
+	if len(tiers) == 0 {
+		return nil
+	}
+	return &trackerSession{tiers: tiers, infoHash: infoHash, peerID: peerID, port: port, interval: defaultAnnounceInterval, trackerIDs: make(map[string]string)}
+}
+
+// Announce with the session's torrent, peer ID and tracker IDs filled in
+func (s *trackerSession) announce(params announceParams) ([]string, error) {
+	params.infoHash = s.infoHash
+	params.peerID = s.peerID
+	params.port = s.port
+	params.trackerIDs = s.trackerIDs
+	peers, interval, err := s.tiers.announce(params)
+	switch {
+	case err != nil:
+		s.interval = trackerRetryInterval
+	case interval > 0:
+		s.interval = interval
+	default:
+		s.interval = defaultAnnounceInterval
+	}
+	return peers, err
+}
+
+// Announce to the trackers with the download's current byte counts. The
+// download waits for started, and once it is over for the final announces,
+// so UDP trackers get only a few retries then; the others give up when the
+// download ends.
+func (d *downloader) announce(event string) ([]string, error) {
+	have := d.haveSnapshot()
+	params := announceParams{
+		uploaded:   atomic.LoadInt64(&d.uploaded),
+		downloaded: atomic.LoadInt64(&d.downloaded),
+		event:      event,
+		foreground: event == eventStarted,
+		cancel:     d.quit,
+	}
+	for index := 0; index < d.numPieces; index++ {
+		if !have.HasPiece(index) {
+			params.left += int64(d.torrent.pieceDataSize(index))
+		}
+	}
+	select {
+	case <-d.quit:
+		params.foreground, params.cancel = true, nil
+	default:
+	}
+	return d.config.trackers.announce(params)
+}
+
+// Announce to the trackers for as long as the download runs and pass the
+// peers they return to the scheduler. started is sent first, in the
+// background so the download begins with the peers it already knows, and
+// again with later announces until a tracker takes it. completed is sent
+// once the last piece is verified, unless the download was complete to begin
+// with, and likewise repeated until a tracker takes it. stopped is sent when
+// quit is closed.
+func (d *downloader) announceTrackers(completeAtStart bool) {
+	defer d.background.Done()
+	done := d.done
+	if completeAtStart {
+		done = nil
+	}
+	started := true    // started is due
+	completed := false // completed is due
+	peers, err := d.announce(eventStarted)
+	if err == nil {
+		started = false
+	}
+	for {
+		if err == nil {
+			select {
+			case d.found <- peers:
+			case <-d.quit:
+			}
+		}
+
+		timer := time.NewTimer(d.config.trackers.interval)
+		stopped := false
+		select {
+		case <-timer.C:
+		case <-done:
+			completed, done = true, nil
+		case <-d.quit:
+			stopped = true
+		}
+		timer.Stop()
+
+		if stopped {
+			// A download that finished as it ended still reports completed
+			select {
+			case <-done:
+				completed = true
+			default:
+			}
+			if completed {
+				d.announce(eventCompleted)
+			}
+			d.announce(eventStopped)
+			return
+		}
+		// The tracker hears of the download starting before it completing
+		event := eventNone
+		switch {
+		case started:
+			event = eventStarted
+		case completed:
+			event = eventCompleted
+		}
+		peers, err = d.announce(event)
+		if err == nil {
+			switch event {
+			case eventStarted:
+				started = false
+			case eventCompleted:
+				completed = false
+			}
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bittorrent-client/bencode"
+)
+
+// Serve an HTTP tracker that lists peers in compact form
+func startFakeHTTPTracker(t *testing.T, peers ...string) string {
+	var compact []byte
+	for _, address := range peers {
+		entry, _ := compactPeer(address)
+		compact = append(compact, entry...)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bencode.NewEncoder(w).Encode(TrackerResponse{Interval: 900, Peers: string(compact)})
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce"
+}
+
+func TestParseTrackerResponse(t *testing.T) {
+	compact4, _ := compactPeer("10.0.0.1:6881")
+	compact6, _ := compactPeer("[2001:db8::1]:51413")
+	var data bytes.Buffer
+	bencode.NewEncoder(&data).Encode(map[string]interface{}{
+		"interval":       1800,
+		"min interval":   60,
+		"complete":       5,
+		"incomplete":     3,
+		"tracker id":     "abc",
+		"warning reason": "slow down",
+		"peers":          string(compact4) + "\x0a\x00", // Trailing partial entry
+		"peers6":         string(compact6),
+	})
+	resp, peers, err := parseTrackerResponse(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 1800 || resp.MinInterval != 60 || resp.Complete != 5 || resp.Incomplete != 3 || resp.TrackerID != "abc" || resp.WarningReason != "slow down" {
+		t.Fatalf("response %+v", resp)
+	}
+	if len(peers) != 2 || peers[0].address() != "10.0.0.1:6881" || peers[1].address() != "[2001:db8::1]:51413" {
+		t.Fatalf("peers %v", peers)
+	}
+
+	// Trackers that ignore compact=1 list dictionaries; bad entries are skipped
+	data.Reset()
+	bencode.NewEncoder(&data).Encode(map[string]interface{}{
+		"interval": 900,
+		"peers": []interface{}{
+			map[string]interface{}{"peer id": "-XX0001-000000000001", "ip": "10.0.0.2", "port": 51413},
+			map[string]interface{}{"ip": "2001:db8::2", "port": 6881},
+			map[string]interface{}{"ip": "peer.example", "port": 6882},
+			map[string]interface{}{"ip": "10.0.0.3", "port": 70000},
+			map[string]interface{}{"port": 6881},
+			"junk",
+		},
+	})
+	_, peers, err = parseTrackerResponse(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addresses []string
+	for _, peer := range peers {
+		addresses = append(addresses, peer.address())
+	}
+	if fmt.Sprint(addresses) != "[10.0.0.2:51413 [2001:db8::2]:6881 peer.example:6882]" || peers[0].id != "-XX0001-000000000001" {
+		t.Fatalf("peers %v", peers)
+	}
+
+	_, _, err = parseTrackerResponse(bytes.NewBufferString("li1ee"))
+	if err == nil {
+		t.Fatal("list accepted as a response")
+	}
+}
+
+// Tracker IDs are sent back to the tracker that handed them out
+func TestTrackerID(t *testing.T) {
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, r.URL.Query().Get("trackerid"))
+		bencode.NewEncoder(w).Encode(TrackerResponse{Interval: 900, TrackerID: "id-1"})
+	}))
+	defer server.Close()
+	torrent := TorrentFile{Announce: server.URL + "/announce"}
+	session := newTrackerSession(torrent, bytes.Repeat([]byte{1}, 20), "-PC0001-123456789012", 6881)
+	for i := 0; i < 2; i++ {
+		_, err := session.announce(announceParams{left: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(sent) != "[ id-1]" {
+		t.Fatalf("tracker IDs sent %q", sent)
+	}
+}
+
+func TestParseAnnounceList(t *testing.T) {
+	var data bytes.Buffer
+	bencode.NewEncoder(&data).Encode(map[string]interface{}{
+		"announce": "http://a.example/an",
+		"announce-list": [][]string{
+			{"http://a.example/an", "http://b.example/an"},
+			{},
+			{"udp://c.example:1"},
+		},
+		"info": map[string]interface{}{"name": "x", "length": 1, "piece length": 1, "pieces": "aaaaaaaaaaaaaaaaaaaa"},
+	})
+	var torrent TorrentFile
+	err := bencode.Unmarshal(data.Bytes(), &torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers := newTrackerTiers(torrent)
+	if len(tiers) != 2 || len(tiers[0]) != 2 || tiers[1][0] != "udp://c.example:1" {
+		t.Fatalf("tiers %q", tiers)
+	}
+	sorted := append([]string(nil), tiers[0]...)
+	sort.Strings(sorted)
+	if sorted[0] != "http://a.example/an" || sorted[1] != "http://b.example/an" {
+		t.Fatalf("first tier %q", tiers[0])
+	}
+
+	// Without an announce-list the announce URL is the only tier
+	torrent.AnnounceList = nil
+	if tiers := newTrackerTiers(torrent); fmt.Sprint(tiers) != "[[http://a.example/an]]" {
+		t.Fatalf("tiers %q", tiers)
+	}
+}
+
+func TestTrackerTiersFailover(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	deadURL := dead.URL + "/announce"
+	first := startFakeHTTPTracker(t, "10.0.0.1:6881", "10.0.0.2:6881")
+	backup := startFakeHTTPTracker(t, "10.0.0.2:6881", "10.0.0.9:6881")
+	second := startFakeUDPTracker(t, "10.0.0.2:6881", "10.0.0.3:6881")
+	var unused int32
+	last := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&unused, 1)
+		bencode.NewEncoder(w).Encode(TrackerResponse{Interval: 900})
+	}))
+	defer last.Close()
+
+	// The first tier that answers is used; every tracker in it is asked and
+	// their peers are merged without duplicates
+	tiers := trackerTiers{
+		{deadURL, first, backup},
+		{last.URL + "/announce"},
+	}
+	params := announceParams{infoHash: bytes.Repeat([]byte{1}, 20), peerID: "-PC0001-123456789012", port: 6881, left: 100}
+	peers, interval, err := tiers.announce(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(peers) != "[10.0.0.1:6881 10.0.0.2:6881 10.0.0.9:6881]" {
+		t.Fatalf("peers %q", peers)
+	}
+	if interval != 900*time.Second {
+		t.Fatalf("interval %v", interval)
+	}
+	if fmt.Sprint(tiers[0]) != fmt.Sprint([]string{first, backup, deadURL}) {
+		t.Fatalf("first tier after announce %q", tiers[0])
+	}
+
+	// A tier where nothing answers falls through to the next, and the tiers
+	// after the one that answers are not asked
+	tiers = trackerTiers{
+		{deadURL},
+		{"udp://" + second.address()},
+		{last.URL + "/announce"},
+	}
+	peers, interval, err = tiers.announce(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(peers) != "[10.0.0.2:6881 10.0.0.3:6881]" {
+		t.Fatalf("peers from the second tier %q", peers)
+	}
+	// The UDP tracker asks for 1800 seconds
+	if interval != 1800*time.Second {
+		t.Fatalf("interval %v", interval)
+	}
+	if n := atomic.LoadInt32(&unused); n != 0 {
+		t.Fatalf("tier after the one that answered got %d announces", n)
+	}
+
+	_, _, err = trackerTiers{{deadURL}}.announce(params)
+	if err == nil {
+		t.Fatal("announce succeeded with no tracker answering")
+	}
+}
+
+// The download re-announces at the interval the tracker asks for, with the
+// right event and byte counts, and dials the peers the later announces return
+func TestDownloadReannounces(t *testing.T) {
+	data := randomData(8*32768 + 100)
+	torrent := makeTestTorrent("announce.bin", data, 32768)
+	empty := startFakePeer(t, data, 32768)
+	empty.has = func(index int) bool { return false }
+	source := startFakePeer(t, data, 32768)
+
+	var mu sync.Mutex
+	var announces []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		announces = append(announces, r.URL.Query())
+		first := len(announces) == 1
+		mu.Unlock()
+		// The peer with the data is only listed from the second announce on
+		peer := source.address()
+		if first {
+			peer = empty.address()
+		}
+		compact, _ := compactPeer(peer)
+		bencode.NewEncoder(w).Encode(TrackerResponse{Interval: 1, Peers: string(compact)})
+	}))
+	defer server.Close()
+	torrent.Announce = server.URL + "/announce"
+
+	config := testDownloadConfig(t.TempDir())
+	config.trackers = newTrackerSession(torrent, bytes.Repeat([]byte{1}, 20), "-PC0001-123456789012", 6881)
+	done := make(chan error, 1)
+	go func() {
+		done <- downloadTorrent(torrent, testInfoHash, "-PC0001-123456789012", nil, config, nil)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(config.outputDir, "announce.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data does not match")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var events []string
+	for _, announce := range announces {
+		events = append(events, announce.Get("event"))
+	}
+	n := len(announces)
+	if n < 4 || events[0] != eventStarted || events[1] != eventNone || events[n-2] != eventCompleted || events[n-1] != eventStopped {
+		t.Fatalf("events %q", events)
+	}
+	if announces[0].Get("left") != strconv.Itoa(len(data)) || announces[0].Get("downloaded") != "0" {
+		t.Fatalf("started with left=%s downloaded=%s", announces[0].Get("left"), announces[0].Get("downloaded"))
+	}
+	completed := announces[n-2]
+	if completed.Get("left") != "0" || completed.Get("downloaded") != strconv.Itoa(len(data)) || completed.Get("port") != "6881" {
+		t.Fatalf("completed with left=%s downloaded=%s", completed.Get("left"), completed.Get("downloaded"))
+	}
+}
+
+// A started announce the tracker rejected is sent again with the next
+// announce, ahead of completed
+func TestStartedRepeatedUntilAccepted(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		first := len(events) == 1
+		mu.Unlock()
+		if first {
+			bencode.NewEncoder(w).Encode(TrackerResponse{FailureReason: "try again"})
+			return
+		}
+		bencode.NewEncoder(w).Encode(TrackerResponse{Interval: 1})
+	}))
+	defer server.Close()
+	torrent := makeTestTorrent("started.bin", randomData(100), 32768)
+	torrent.Announce = server.URL + "/announce"
+
+	d := &downloader{
+		torrent:   torrent,
+		numPieces: torrent.numPieces(),
+		have:      newBitfield(torrent.numPieces()),
+		config:    downloadConfig{trackers: newTrackerSession(torrent, bytes.Repeat([]byte{1}, 20), "-PC0001-123456789012", 6881)},
+		found:     make(chan []string),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	d.background.Add(1)
+	go d.announceTrackers(false)
+
+	// The first announce failed, so it is retried at the long interval; the
+	// download finishing announces again at once
+	time.Sleep(100 * time.Millisecond)
+	close(d.done)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-d.found:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("announce %d did not happen", i+2)
+		}
+	}
+	close(d.quit)
+	d.background.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(events) != "[started started completed stopped]" {
+		t.Fatalf("events %q", events)
+	}
+}
+
+// A download that starts, or ends up, with no peers waits for the trackers to
+// list some instead of failing
+func TestDownloadWaitsForPeers(t *testing.T) {
+	data := randomData(4*32768 + 100)
+	torrent := makeTestTorrent("wait.bin", data, 32768)
+	source := startFakePeer(t, data, 32768)
+
+	var mu sync.Mutex
+	announces := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		announces++
+		first := announces == 1
+		mu.Unlock()
+		var compact []byte
+		if !first {
+			compact, _ = compactPeer(source.address())
+		}
+		bencode.NewEncoder(w).Encode(TrackerResponse{Interval: 1, Peers: string(compact)})
+	}))
+	defer server.Close()
+	torrent.Announce = server.URL + "/announce"
+
+	config := testDownloadConfig(t.TempDir())
+	config.trackers = newTrackerSession(torrent, bytes.Repeat([]byte{1}, 20), "-PC0001-123456789012", 6881)
+	done := make(chan error, 1)
+	go func() {
+		done <- downloadTorrent(torrent, testInfoHash, "-PC0001-123456789012", nil, config, nil)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+
+	// Without trackers, the DHT or a listener nobody can turn up
+	config = testDownloadConfig(t.TempDir())
+	err := downloadTorrent(torrent, testInfoHash, "-PC0001-123456789012", nil, config, nil)
+	if err == nil || err.Error() != "no peers found" {
+		t.Fatalf("download without peers: %v", err)
+	}
+}
+
+// The started announce runs beside the download: a tracker that doesn't
+// answer holds up neither the peers we already know nor the other trackers of
+// its tier
+func TestStartedAnnounceInBackground(t *testing.T) {
+	data := randomData(4*32768 + 100)
+	torrent := makeTestTorrent("background.bin", data, 32768)
+	source := startFakePeer(t, data, 32768)
+	other := startFakePeer(t, data, 32768)
+
+	silent := startFakeUDPTracker(t)
+	silent.mu.Lock()
+	silent.drop = 100
+	silent.mu.Unlock()
+	tracker := newUDPTracker(silent.address())
+	tracker.baseTimeout = 500 * time.Millisecond
+	udpTrackersMu.Lock()
+	udpTrackers[silent.address()] = tracker
+	udpTrackersMu.Unlock()
+	t.Cleanup(func() {
+		udpTrackersMu.Lock()
+		delete(udpTrackers, silent.address())
+		udpTrackersMu.Unlock()
+	})
+	torrent.AnnounceList = [][]string{{"udp://" + silent.address(), startFakeHTTPTracker(t, other.address())}}
+
+	config := testDownloadConfig(t.TempDir())
+	config.trackers = newTrackerSession(torrent, bytes.Repeat([]byte{1}, 20), "-PC0001-123456789012", 6881)
+	start := time.Now()
+	var finished time.Duration
+	err := downloadTorrent(torrent, testInfoHash, "-PC0001-123456789012", []string{source.address()}, config, func(completed, total int) {
+		if completed == total {
+			finished = time.Since(start)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finished == 0 || finished > 400*time.Millisecond {
+		t.Fatalf("download finished after %v, held up by the silent tracker", finished)
+	}
+
+	// Waiting on the silent tracker stops when the download ends, and the
+	// final announces give up after a few tries, not the full BEP 15 schedule
+	if elapsed := time.Since(start); elapsed > 6*time.Second {
+		t.Fatalf("download returned after %v", elapsed)
+	}
+}
+
+// Interrupting the download, as Ctrl-C does, still announces stopped
+func TestInterruptAnnouncesStopped(t *testing.T) {
+	data := randomData(4*32768 + 100)
+	torrent := makeTestTorrent("interrupt.bin", data, 32768)
+	stalled := startFakePeer(t, data, 32768)
+	stalled.latency = time.Hour
+
+	var mu sync.Mutex
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		bencode.NewEncoder(w).Encode(TrackerResponse{Interval: 900})
+	}))
+	defer server.Close()
+	torrent.Announce = server.URL + "/announce"
+
+	config := testDownloadConfig(t.TempDir())
+	config.trackers = newTrackerSession(torrent, bytes.Repeat([]byte{1}, 20), "-PC0001-123456789012", 6881)
+	interrupt := make(chan struct{})
+	config.interrupt = interrupt
+	time.AfterFunc(200*time.Millisecond, func() { close(interrupt) })
+	done := make(chan error, 1)
+	go func() {
+		done <- downloadTorrent(torrent, testInfoHash, "-PC0001-123456789012", []string{stalled.address()}, config, nil)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("interrupted download reported success")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("download ignored the interrupt")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(events) != "[started stopped]" {
+		t.Fatalf("events %q", events)
+	}
+}
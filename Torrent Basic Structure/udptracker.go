@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID = 0x41727101980 // Magic connection ID of connect requests
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpConnectionLifetime = time.Minute // Clients may reuse a connection ID this long
+	udpBaseTimeout        = 15 * time.Second
+	udpMaxRetries         = 8  // The timeout doubles with every retry: 15 * 2^n seconds
+	udpForegroundRetries  = 2  // For announces someone waits on: 15, 30 and 60 seconds
+	udpMaxScrape          = 74 // Info hashes per scrape request
+)
+
+// Announce events as sent to UDP trackers
+var udpEvents = map[string]uint32{
+	eventNone:      0,
+	eventCompleted: 1,
+	eventStarted:   2,
+	eventStopped:   3,
+}
+
+// Seeders, leechers and completed downloads of one torrent, as scraped
+type scrapeStats struct {
+	seeders   int
+	completed int
+	leechers  int
+}
+
+// udpTracker talks to one UDP tracker and caches the connection ID it hands
+// out, so repeated announces skip the connect exchange
+type udpTracker struct {
+	address     string // host:port
+	baseTimeout time.Duration
+	maxRetries  int
+
+	mu          sync.Mutex
+	connID      uint64
+	connectedAt time.Time
+}
+
+func newUDPTracker(address string) *udpTracker {
+	return &udpTracker{address: address, baseTimeout: udpBaseTimeout, maxRetries: udpMaxRetries}
+}
+
+// UDP trackers by address, shared so connection IDs survive between announces
+var (
+	udpTrackersMu sync.Mutex
+	udpTrackers   = make(map[string]*udpTracker)
+)
+
+// Random key sent with every announce, so trackers can tell us apart from
+// other clients behind the same address
+var udpKey = randomUint32()
+
+func randomUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func udpTrackerFor(announce string) (*udpTracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("tracker %s has no port", announce)
+	}
+	udpTrackersMu.Lock()
+	defer udpTrackersMu.Unlock()
+	tracker := udpTrackers[u.Host]
+	if tracker == nil {
+		tracker = newUDPTracker(u.Host)
+		udpTrackers[u.Host] = tracker
+	}
+	return tracker, nil
+}
+
+// Announce to a UDP tracker and return its response along with the peers it
+// listed, like announceHTTP
+func announceUDP(announce string, params announceParams) (TrackerResponse, []string, error) {
+	tracker, err := udpTrackerFor(announce)
+	if err != nil {
+		return TrackerResponse{}, nil, err
+	}
+	return tracker.announce(params)
+}
+
+// Announce to the tracker at announce, over HTTP or UDP depending on its scheme
+func announceTracker(announce string, params announceParams) (TrackerResponse, []string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return TrackerResponse{}, nil, fmt.Errorf("invalid tracker URL %s: %v", announce, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(announce, params)
+	case "udp":
+		return announceUDP(announce, params)
+	}
+	return TrackerResponse{}, nil, fmt.Errorf("unsupported tracker %s", announce)
+}
+
+func (t *udpTracker) announce(params announceParams) (TrackerResponse, []string, error) {
+	var resp TrackerResponse
+	body := make([]byte, 82)
+	copy(body[0:20], params.infoHash)
+	copy(body[20:40], params.peerID)
+	binary.BigEndian.PutUint64(body[40:], uint64(params.downloaded))
+	binary.BigEndian.PutUint64(body[48:], uint64(params.left))
+	binary.BigEndian.PutUint64(body[56:], uint64(params.uploaded))
+	binary.BigEndian.PutUint32(body[64:], udpEvents[params.event])
+	binary.BigEndian.PutUint32(body[68:], 0) // IP: the sender's
+	binary.BigEndian.PutUint32(body[72:], udpKey)
+	binary.BigEndian.PutUint32(body[76:], 0xffffffff) // num_want: tracker's default
+	binary.BigEndian.PutUint16(body[80:], uint16(params.port))
+
+	// Nobody waits for the answer to stopped, so it isn't retried for long
+	retries := t.maxRetries
+	if params.foreground && retries > udpForegroundRetries {
+		retries = udpForegroundRetries
+	}
+	if params.event == eventStopped {
+		retries = 0
+	}
+	payload, ipLen, err := t.exchange(udpActionAnnounce, body, retries, params.cancel)
+	if err != nil {
+		return resp, nil, err
+	}
+	if len(payload) < 12 {
+		return resp, nil, fmt.Errorf("short announce response from %s", t.address)
+	}
+	resp.Interval = int(binary.BigEndian.Uint32(payload[0:]))
+	resp.Incomplete = int(binary.BigEndian.Uint32(payload[4:]))
+	resp.Complete = int(binary.BigEndian.Uint32(payload[8:]))
+	// A trailing partial entry is ignored
+	peers := payload[12:]
+	peers = peers[:len(peers)-len(peers)%(ipLen+2)]
+	if ipLen == net.IPv6len {
+		resp.Peers6 = string(peers)
+	} else {
+		resp.Peers = string(peers)
+	}
+	addresses, err := parseCompactPeers(peers, ipLen)
+	return resp, addresses, err
+}
+
+// Scrape the tracker for the given info hashes, at most udpMaxScrape at once
+func (t *udpTracker) scrape(infoHashes [][]byte) ([]scrapeStats, error) {
+	if len(infoHashes) > udpMaxScrape {
+		return nil, fmt.Errorf("cannot scrape %d torrents at once", len(infoHashes))
+	}
+	var body []byte
+	for _, infoHash := range infoHashes {
+		body = append(body, infoHash...)
+	}
+	retries := t.maxRetries
+	if retries > udpScrapeRetries {
+		retries = udpScrapeRetries
+	}
+	payload, _, err := t.exchange(udpActionScrape, body, retries, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 12*len(infoHashes) {
+		return nil, fmt.Errorf("short scrape response from %s", t.address)
+	}
+	stats := make([]scrapeStats, len(infoHashes))
+	for i := range stats {
+		entry := payload[i*12:]
+		stats[i] = scrapeStats{
+			seeders:   int(binary.BigEndian.Uint32(entry[0:])),
+			completed: int(binary.BigEndian.Uint32(entry[4:])),
+			leechers:  int(binary.BigEndian.Uint32(entry[8:])),
+		}
+	}
+	return stats, nil
+}
+
+// A request that got no answer in time
+var errUDPTimeout = errors.New("timed out")
+
+// A request given up on because the download ended
+var errUDPCancelled = errors.New("cancelled")
+
+// Send a request with the given action and body, connecting first unless a
+// connection ID is cached, and return the body of the response and the
+// address length of the tracker's peers. Requests that time out are retried
+// with the BEP 15 backoff, up to maxRetries times; the retry count carries
+// over a reconnect. Closing cancel gives up at once.
+func (t *udpTracker) exchange(action uint32, body []byte, maxRetries int, cancel <-chan struct{}) ([]byte, int, error) {
+	raddr, err := net.ResolveUDPAddr("udp", t.address)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	ipLen := net.IPv6len
+
+	// Closing the connection cuts short the wait for a response
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-cancel:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+	cancelled := func() bool {
+		select {
+		case <-cancel:
+			return true
+		default:
+			return false
+		}
+	}
+	if raddr.IP.To4() != nil {
+		ipLen = net.IPv4len
+	}
+
+	for n := 0; n <= maxRetries; {
+		timeout := t.baseTimeout << n
+
+		t.mu.Lock()
+		connID, connected := t.connID, time.Since(t.connectedAt) < udpConnectionLifetime
+		t.mu.Unlock()
+		if !connected {
+			payload, err := t.transact(conn, udpProtocolID, udpActionConnect, nil, timeout)
+			if cancelled() {
+				return nil, 0, fmt.Errorf("tracker %s: %w", t.address, errUDPCancelled)
+			}
+			if err == errUDPTimeout {
+				n++
+				continue
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			if len(payload) < 8 {
+				return nil, 0, fmt.Errorf("short connect response from %s", t.address)
+			}
+			connID = binary.BigEndian.Uint64(payload)
+			t.mu.Lock()
+			t.connID, t.connectedAt = connID, time.Now()
+			t.mu.Unlock()
+		}
+
+		payload, err := t.transact(conn, connID, action, body, timeout)
+		if cancelled() {
+			return nil, 0, fmt.Errorf("tracker %s: %w", t.address, errUDPCancelled)
+		}
+		if err == errUDPTimeout {
+			n++
+			continue
+		}
+		return payload, ipLen, err
+	}
+
+	// The connection ID may be what the tracker is ignoring us for
+	t.mu.Lock()
+	t.connectedAt = time.Time{}
+	t.mu.Unlock()
+	return nil, 0, fmt.Errorf("tracker %s: %w", t.address, errUDPTimeout)
+}
+
+// Send one request and wait up to timeout for the response with the same
+// transaction ID, returning what follows the response header
+func (t *udpTracker) transact(conn *net.UDPConn, connID uint64, action uint32, body []byte, timeout time.Duration) ([]byte, error) {
+	transactionID := randomUint32()
+	request := make([]byte, 16, 16+len(body))
+	binary.BigEndian.PutUint64(request[0:], connID)
+	binary.BigEndian.PutUint32(request[8:], action)
+	binary.BigEndian.PutUint32(request[12:], transactionID)
+	request = append(request, body...)
+	_, err := conn.Write(request)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, errUDPTimeout
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:]) != transactionID {
+			continue // Stray or late response to an earlier request
+		}
+		got := binary.BigEndian.Uint32(buf[0:])
+		payload := append([]byte(nil), buf[8:n]...)
+		if got == udpActionError {
+			// The tracker may have dropped our connection ID; get a new one
+			// next time
+			t.mu.Lock()
+			t.connectedAt = time.Time{}
+			t.mu.Unlock()
+			return nil, fmt.Errorf("tracker error: %s", payload)
+		}
+		if got != action {
+			return nil, fmt.Errorf("tracker %s answered action %d with action %d", t.address, action, got)
+		}
+		return payload, nil
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker answers BEP 15 requests on loopback
+type fakeUDPTracker struct {
+	conn  *net.UDPConn
+	peers []byte // Compact peers returned by every announce
+
+	mu        sync.Mutex
+	drop      int  // Requests to ignore before answering again
+	stray     bool // Precede every response with one for another transaction
+	connIDs   map[uint64]bool
+	connects  int
+	announces [][]byte // Bodies of the announce requests
+}
+
+func startFakeUDPTracker(t *testing.T, peers ...string) *fakeUDPTracker {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeUDPTracker(t, conn, peers)
+}
+
+// A fake tracker on the IPv6 loopback, which answers with IPv6 peers; the
+// test is skipped where there is no IPv6
+func startFakeUDPTracker6(t *testing.T, peers ...string) *fakeUDPTracker {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	return serveFakeUDPTracker(t, conn, peers)
+}
+
+func serveFakeUDPTracker(t *testing.T, conn *net.UDPConn, peers []string) *fakeUDPTracker {
+	t.Cleanup(func() { conn.Close() })
+	f := &fakeUDPTracker{conn: conn, connIDs: make(map[uint64]bool)}
+	for _, address := range peers {
+		compact, _ := compactPeer(address)
+		f.peers = append(f.peers, compact...)
+	}
+	go f.serve()
+	return f
+}
+
+func (f *fakeUDPTracker) address() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		connID := binary.BigEndian.Uint64(buf[0:])
+		action := binary.BigEndian.Uint32(buf[8:])
+		transactionID := binary.BigEndian.Uint32(buf[12:])
+		body := append([]byte(nil), buf[16:n]...)
+
+		f.mu.Lock()
+		if f.drop > 0 {
+			f.drop--
+			f.mu.Unlock()
+			continue
+		}
+		reply := func(action uint32, payload []byte) {
+			header := make([]byte, 8)
+			binary.BigEndian.PutUint32(header[0:], action)
+			if f.stray {
+				binary.BigEndian.PutUint32(header[4:], transactionID+1)
+				f.conn.WriteToUDP(append(header, []byte("stray")...), addr)
+			}
+			binary.BigEndian.PutUint32(header[4:], transactionID)
+			f.conn.WriteToUDP(append(header, payload...), addr)
+		}
+		switch {
+		case action == udpActionConnect && connID == udpProtocolID:
+			f.connects++
+			newID := uint64(0x1000 + f.connects)
+			f.connIDs[newID] = true
+			payload := make([]byte, 8)
+			binary.BigEndian.PutUint64(payload, newID)
+			reply(udpActionConnect, payload)
+		case !f.connIDs[connID]:
+			reply(udpActionError, []byte("unknown connection ID"))
+		case action == udpActionAnnounce && bytes.Equal(body[:20], make([]byte, 20)):
+			reply(udpActionError, []byte("unregistered torrent"))
+		case action == udpActionAnnounce:
+			f.announces = append(f.announces, body)
+			payload := make([]byte, 12)
+			binary.BigEndian.PutUint32(payload[0:], 1800)
+			binary.BigEndian.PutUint32(payload[4:], 3) // Leechers
+			binary.BigEndian.PutUint32(payload[8:], 5) // Seeders
+			reply(udpActionAnnounce, append(payload, f.peers...))
+		case action == udpActionScrape:
+			var payload []byte
+			for i := 0; i+20 <= len(body); i += 20 {
+				entry := make([]byte, 12)
+				binary.BigEndian.PutUint32(entry[0:], uint32(body[i]))   // Seeders
+				binary.BigEndian.PutUint32(entry[4:], uint32(body[i])*2) // Completed
+				binary.BigEndian.PutUint32(entry[8:], uint32(body[i])+1) // Leechers
+				payload = append(payload, entry...)
+			}
+			reply(udpActionScrape, payload)
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakeUDPTracker) stats() (int, [][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects, f.announces
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	fake := startFakeUDPTracker(t, "10.0.0.1:6881", "10.0.0.2:51413")
+	tracker := newUDPTracker(fake.address())
+	infoHash := bytes.Repeat([]byte{0x11}, 20)
+
+	resp, peers, err := tracker.announce(announceParams{infoHash: infoHash, peerID: "-PC0001-123456789012", port: 6881, uploaded: 100, downloaded: 200, left: 300, event: eventStarted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 1800 || fmt.Sprint(peers) != "[10.0.0.1:6881 10.0.0.2:51413]" {
+		t.Fatalf("interval %d, peers %q", resp.Interval, peers)
+	}
+	if resp.Complete != 5 || resp.Incomplete != 3 {
+		t.Fatalf("%d seeders, %d leechers", resp.Complete, resp.Incomplete)
+	}
+	_, announces := fake.stats()
+	body := announces[0]
+	if !bytes.Equal(body[:20], infoHash) || string(body[20:40]) != "-PC0001-123456789012" {
+		t.Fatal("announce has the wrong info hash or peer ID")
+	}
+	if binary.BigEndian.Uint64(body[40:]) != 200 || binary.BigEndian.Uint64(body[48:]) != 300 || binary.BigEndian.Uint64(body[56:]) != 100 {
+		t.Fatal("announce has the wrong byte counts")
+	}
+	if binary.BigEndian.Uint32(body[64:]) != udpEvents[eventStarted] || binary.BigEndian.Uint16(body[80:]) != 6881 {
+		t.Fatal("announce has the wrong event or port")
+	}
+
+	// The connection ID is reused until it expires
+	_, _, err = tracker.announce(announceParams{infoHash: infoHash, peerID: "-PC0001-123456789012", port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connects, _ := fake.stats(); connects != 1 {
+		t.Fatalf("%d connects for two announces", connects)
+	}
+	tracker.connectedAt = time.Now().Add(-udpConnectionLifetime)
+	_, _, err = tracker.announce(announceParams{infoHash: infoHash, peerID: "-PC0001-123456789012", port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connects, _ := fake.stats(); connects != 2 {
+		t.Fatal("expired connection ID was used")
+	}
+
+	// After an error reply the next announce connects again, as the tracker
+	// may have forgotten the connection ID
+	fake.mu.Lock()
+	fake.connIDs = make(map[uint64]bool)
+	fake.mu.Unlock()
+	_, _, err = tracker.announce(announceParams{infoHash: infoHash, peerID: "-PC0001-123456789012", port: 6881})
+	if err == nil || !strings.Contains(err.Error(), "unknown connection ID") {
+		t.Fatalf("forgotten connection ID gave %v", err)
+	}
+	_, _, err = tracker.announce(announceParams{infoHash: infoHash, peerID: "-PC0001-123456789012", port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connects, _ := fake.stats(); connects != 3 {
+		t.Fatalf("%d connects, want a new connection after the error", connects)
+	}
+
+	_, _, err = tracker.announce(announceParams{infoHash: make([]byte, 20), peerID: "-PC0001-123456789012", port: 6881})
+	if err == nil || !strings.Contains(err.Error(), "unregistered torrent") {
+		t.Fatalf("error response gave %v", err)
+	}
+
+	// Trackers are picked by URL scheme
+	_, peers, err = announceTracker("udp://"+fake.address()+"/announce", announceParams{infoHash: infoHash, peerID: "-PC0001-123456789012", port: 6881, left: 1})
+	if err != nil || len(peers) != 2 {
+		t.Fatalf("announce by URL found %q: %v", peers, err)
+	}
+	_, _, err = announceTracker("wss://tracker.example/announce", announceParams{infoHash: infoHash, peerID: "-PC0001-123456789012", port: 6881, left: 1})
+	if err == nil {
+		t.Fatal("unsupported tracker scheme was accepted")
+	}
+}
+
+// Trackers reached over IPv6 answer with IPv6 peers (BEP 15), which belong in
+// Peers6
+func TestUDPTrackerAnnounceIPv6(t *testing.T) {
+	fake := startFakeUDPTracker6(t, "[2001:db8::1]:6881", "[2001:db8::2]:51413")
+	tracker := newUDPTracker(fake.address())
+	resp, peers, err := tracker.announce(announceParams{infoHash: bytes.Repeat([]byte{0x11}, 20), peerID: "-PC0001-123456789012", port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(peers) != "[[2001:db8::1]:6881 [2001:db8::2]:51413]" {
+		t.Fatalf("peers %q", peers)
+	}
+	if resp.Peers != "" || len(resp.Peers6) != 2*18 {
+		t.Fatalf("%d bytes of IPv4 peers and %d of IPv6", len(resp.Peers), len(resp.Peers6))
+	}
+}
+
+func TestUDPTrackerRetries(t *testing.T) {
+	fake := startFakeUDPTracker(t, "10.0.0.1:6881")
+	fake.mu.Lock()
+	fake.drop = 2
+	fake.stray = true
+	fake.mu.Unlock()
+	tracker := newUDPTracker(fake.address())
+	tracker.baseTimeout = 20 * time.Millisecond
+	tracker.maxRetries = 3
+
+	// The first connect and its retry are lost; responses to other
+	// transactions are skipped
+	_, peers, err := tracker.announce(announceParams{infoHash: bytes.Repeat([]byte{0x11}, 20), peerID: "-PC0001-123456789012", port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 {
+		t.Fatalf("peers %q", peers)
+	}
+
+	fake.mu.Lock()
+	fake.drop = 100
+	fake.mu.Unlock()
+	tracker.maxRetries = 1
+	start := time.Now()
+	_, _, err = tracker.announce(announceParams{infoHash: bytes.Repeat([]byte{0x11}, 20), peerID: "-PC0001-123456789012", port: 6881})
+	if !errors.Is(err, errUDPTimeout) {
+		t.Fatalf("unanswered announce gave %v", err)
+	}
+	// 20 ms, then 40 ms
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+
+	// Announces someone waits on give up after a few retries
+	tracker.maxRetries = udpMaxRetries
+	start = time.Now()
+	_, _, err = tracker.announce(announceParams{infoHash: bytes.Repeat([]byte{0x11}, 20), peerID: "-PC0001-123456789012", port: 6881, foreground: true})
+	if !errors.Is(err, errUDPTimeout) {
+		t.Fatalf("unanswered announce gave %v", err)
+	}
+	// 20, 40 and 80 ms rather than the full schedule
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	fake := startFakeUDPTracker(t)
+	tracker := newUDPTracker(fake.address())
+	stats, err := tracker.scrape([][]byte{bytes.Repeat([]byte{4}, 20), bytes.Repeat([]byte{9}, 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(stats) != "[{4 8 5} {9 18 10}]" {
+		t.Fatalf("scraped %v", stats)
+	}
+}
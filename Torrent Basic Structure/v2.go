@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bittorrent-client/bencode"
+)
+
+// BitTorrent v2 (BEP 52) hashes every file on its own: the leaves of a file's
+// merkle tree are the SHA-256 hashes of its 16 KiB blocks, padded with zero
+// hashes to a power of two. The root is the file's pieces root; the layer at
+// piece granularity is kept in the torrent's piece layers. Files start at
+// piece boundaries, so each piece belongs to exactly one file.
+
+// Size of the blocks at the bottom of v2 merkle trees
+const merkleBlockSize = 16 * 1024
+
+// Hashes of one layer of a merkle tree, left to right
+type merkleLayer [][sha256.Size]byte
+
+// A file of a v2 torrent, in file tree order
+type v2File struct {
+	path       []string
+	length     int64
+	piecesRoot []byte      // nil for empty files
+	firstPiece int         // Index of the file's first piece in the torrent
+	layer      merkleLayer // Piece layer; nil until known, and for files of one piece
+}
+
+// Number of pieces the file covers
+func (f *v2File) numPieces(pieceLength int) int {
+	return int((f.length + int64(pieceLength) - 1) / int64(pieceLength))
+}
+
+// Whether the piece layer is still needed to verify the file's pieces
+func (f *v2File) needsLayer(pieceLength int) bool {
+	return f.numPieces(pieceLength) > 1 && f.layer == nil
+}
+
+// The v2 side of a v2 or hybrid torrent
+type v2Info struct {
+	infoHash    [sha256.Size]byte // SHA-256 of the info dictionary
+	pieceLength int
+	files       []*v2File
+	hybrid      bool // The torrent has v1 piece hashes too
+}
+
+// Find the file a piece belongs to
+func (v *v2Info) fileForPiece(index int) *v2File {
+	for _, f := range v.files {
+		if index >= f.firstPiece && index < f.firstPiece+f.numPieces(v.pieceLength) {
+			return f
+		}
+	}
+	return nil
+}
+
+// Find the file with the given pieces root
+func (v *v2Info) fileByRoot(root []byte) *v2File {
+	for _, f := range v.files {
+		if f.piecesRoot != nil && bytes.Equal(f.piecesRoot, root) {
+			return f
+		}
+	}
+	return nil
+}
+
+// Files whose piece layer is still missing
+func (v *v2Info) missingLayers() []*v2File {
+	var missing []*v2File
+	for _, f := range v.files {
+		if f.needsLayer(v.pieceLength) {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+// Check a piece against its file's merkle tree. The piece may carry padding
+// after the end of the file, which isn't hashed. If the piece layer isn't
+// known, only a hybrid torrent's v1 hash can vouch for the piece.
+func (v *v2Info) validatePiece(index int, piece []byte) bool {
+	f := v.fileForPiece(index)
+	if f == nil {
+		return false
+	}
+	begin := int64(index-f.firstPiece) * int64(v.pieceLength)
+	end := begin + int64(v.pieceLength)
+	if end > f.length {
+		end = f.length
+	}
+	if int64(len(piece)) < end-begin {
+		return false
+	}
+	leaves := blockHashes(piece[:end-begin])
+
+	if f.numPieces(v.pieceLength) == 1 {
+		root := merkleRoot(leaves, nextPowerOfTwo(len(leaves)), [sha256.Size]byte{})
+		return bytes.Equal(root[:], f.piecesRoot)
+	}
+	if f.layer == nil {
+		return v.hybrid
+	}
+	root := merkleRoot(leaves, v.pieceLength/merkleBlockSize, [sha256.Size]byte{})
+	return root == f.layer[index-f.firstPiece]
+}
+
+// SHA-256 of every 16 KiB block of data; the last block may be shorter
+func blockHashes(data []byte) merkleLayer {
+	var leaves merkleLayer
+	for begin := 0; begin < len(data); begin += merkleBlockSize {
+		end := begin + merkleBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaves = append(leaves, sha256.Sum256(data[begin:end]))
+	}
+	return leaves
+}
+
+// Root of the tree over a layer of width hashes, where the hashes past the
+// end of the layer are pad
+func merkleRoot(layer merkleLayer, width int, pad [sha256.Size]byte) [sha256.Size]byte {
+	return merkleTree(layer, width, pad)[0][0]
+}
+
+// Every layer of the tree over a layer of width hashes, the root first and
+// the given layer, padded with pad, last
+func merkleTree(layer merkleLayer, width int, pad [sha256.Size]byte) []merkleLayer {
+	level := make(merkleLayer, width)
+	copy(level, layer)
+	for i := len(layer); i < width; i++ {
+		level[i] = pad
+	}
+	tree := []merkleLayer{level}
+	for len(level) > 1 {
+		next := make(merkleLayer, len(level)/2)
+		for i := range next {
+			next[i] = hashPair(level[2*i], level[2*i+1])
+		}
+		level = next
+		tree = append([]merkleLayer{level}, tree...)
+	}
+	return tree
+}
+
+func hashPair(left, right [sha256.Size]byte) [sha256.Size]byte {
+	var buf [2 * sha256.Size]byte
+	copy(buf[:], left[:])
+	copy(buf[sha256.Size:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// Root of a subtree of 2^layers zero leaves, which pads layers above the
+// leaves
+func padHash(layers int) [sha256.Size]byte {
+	var pad [sha256.Size]byte
+	for i := 0; i < layers; i++ {
+		pad = hashPair(pad, pad)
+	}
+	return pad
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// Number of times n, a power of two, can be halved
+func log2(n int) int {
+	layers := 0
+	for n > 1 {
+		n /= 2
+		layers++
+	}
+	return layers
+}
+
+// Root of the file's tree computed from its piece layer
+func (v *v2Info) layerRoot(f *v2File, layer merkleLayer) [sha256.Size]byte {
+	return merkleRoot(layer, nextPowerOfTwo(f.numPieces(v.pieceLength)), padHash(log2(v.pieceLength/merkleBlockSize)))
+}
+
+// Check a piece layer against the file's pieces root and keep it
+func (v *v2Info) setLayer(f *v2File, hashes string) error {
+	if len(hashes) != f.numPieces(v.pieceLength)*sha256.Size {
+		return fmt.Errorf("piece layer of %s has %d bytes, want %d", strings.Join(f.path, "/"), len(hashes), f.numPieces(v.pieceLength)*sha256.Size)
+	}
+	layer := make(merkleLayer, len(hashes)/sha256.Size)
+	for i := range layer {
+		copy(layer[i][:], hashes[i*sha256.Size:])
+	}
+	root := v.layerRoot(f, layer)
+	if !bytes.Equal(root[:], f.piecesRoot) {
+		return fmt.Errorf("piece layer of %s does not match its pieces root", strings.Join(f.path, "/"))
+	}
+	f.layer = layer
+	return nil
+}
+
+// Walk a file tree into its files, in key order. Every file is a
+// dictionary holding its length and pieces root under an empty key.
+func parseFileTree(tree map[string]interface{}, dir []string, depth int) ([]*v2File, error) {
+	if depth > 64 {
+		return nil, fmt.Errorf("file tree nested too deeply")
+	}
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []*v2File
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid file tree entry %q", name)
+		}
+		path := append(append([]string(nil), dir...), name)
+		leaf, isFile := node[""]
+		if !isFile {
+			sub, err := parseFileTree(node, path, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+			continue
+		}
+		attrs, ok := leaf.(map[string]interface{})
+		if !ok || len(node) != 1 {
+			return nil, fmt.Errorf("invalid file entry %s", strings.Join(path, "/"))
+		}
+		length, ok := attrs["length"].(int64)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("file %s has no valid length", strings.Join(path, "/"))
+		}
+		f := &v2File{path: path, length: length}
+		if length > 0 {
+			root, ok := attrs["pieces root"].(string)
+			if !ok || len(root) != sha256.Size {
+				return nil, fmt.Errorf("file %s has no valid pieces root", strings.Join(path, "/"))
+			}
+			f.piecesRoot = []byte(root)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Fill in the v2 side of a torrent from its file tree and piece layers.
+// Pure v2 torrents get a v1 view of their layout as well: Length or Files,
+// with padding files aligning each file to a piece, so storage and the
+// download can treat all torrents alike. A hybrid torrent's v1 file list
+// must already describe that same layout.
+func setupV2(torrent *TorrentFile) error {
+	info := &torrent.Info
+	if info.MetaVersion != 2 {
+		return fmt.Errorf("unsupported meta version %d", info.MetaVersion)
+	}
+	pieceLength := info.PieceLength
+	if pieceLength < merkleBlockSize || pieceLength&(pieceLength-1) != 0 {
+		return fmt.Errorf("v2 piece length %d is not a power of two of at least 16 KiB", pieceLength)
+	}
+	var tree map[string]interface{}
+	err := bencode.Unmarshal(info.FileTree, &tree)
+	if err != nil || len(tree) == 0 {
+		return fmt.Errorf("torrent has no valid file tree")
+	}
+	files, err := parseFileTree(tree, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	// A single file at the top named like the torrent is a single-file
+	// torrent; otherwise the paths are below the torrent's directory
+	single := len(files) == 1 && len(files[0].path) == 1 && files[0].path[0] == info.Name
+	var layout []torrentFileEntry
+	var offset int64
+	for _, f := range files {
+		if rem := offset % int64(pieceLength); rem != 0 && f.length > 0 {
+			pad := int64(pieceLength) - rem
+			layout = append(layout, torrentFileEntry{Length: int(pad), Path: []string{".pad", strconv.FormatInt(pad, 10)}, Attr: "p"})
+			offset += pad
+		}
+		f.firstPiece = int(offset / int64(pieceLength))
+		path := f.path
+		if single {
+			path = nil
+		}
+		layout = append(layout, torrentFileEntry{Length: int(f.length), Path: path})
+		offset += f.length
+	}
+	if offset == 0 {
+		return fmt.Errorf("torrent has no data")
+	}
+
+	v2 := &v2Info{pieceLength: pieceLength, files: files, hybrid: info.Pieces != ""}
+	if v2.hybrid {
+		err = checkHybridLayout(*torrent, v2, single)
+		if err != nil {
+			return err
+		}
+	} else if single {
+		info.Length = int(files[0].length)
+		info.Files = nil
+	} else {
+		info.Length = 0
+		info.Files = layout
+	}
+
+	for _, f := range files {
+		if hashes, ok := torrent.PieceLayers[string(f.piecesRoot)]; ok && f.numPieces(pieceLength) > 1 {
+			err = v2.setLayer(f, hashes)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if torrent.RawInfo != nil {
+		v2.infoHash = sha256.Sum256(torrent.RawInfo)
+	}
+	torrent.v2 = v2
+	return nil
+}
+
+// Check that a hybrid torrent's v1 files are its v2 files in the same order,
+// each starting at the same piece. Padding files only have to get the
+// offsets right.
+func checkHybridLayout(torrent TorrentFile, v2 *v2Info, single bool) error {
+	mismatch := fmt.Errorf("v1 and v2 file lists of the hybrid torrent differ")
+	if single {
+		if len(torrent.Info.Files) != 0 || int64(torrent.Info.Length) != v2.files[0].length {
+			return mismatch
+		}
+		return nil
+	}
+	var i int
+	var offset int64
+	for _, f := range torrent.Info.Files {
+		if f.isPadding() {
+			offset += int64(f.Length)
+			continue
+		}
+		if i == len(v2.files) {
+			return mismatch
+		}
+		want := v2.files[i]
+		if int64(f.Length) != want.length || strings.Join(f.Path, "/") != strings.Join(want.path, "/") {
+			return mismatch
+		}
+		if want.length > 0 && offset != int64(want.firstPiece)*int64(v2.pieceLength) {
+			return fmt.Errorf("file %s of the hybrid torrent is not aligned to a piece", strings.Join(want.path, "/"))
+		}
+		offset += int64(f.Length)
+		i++
+	}
+	if i != len(v2.files) {
+		return mismatch
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The v2 and hybrid torrents in testdata were made by a separate script from
+// files whose bytes are testFileData(seed, length), with these seeds
+var v2TestSeeds = map[string]int{"a.bin": 1, "sub/b.bin": 2, "sub/c.bin": 3, "one.bin": 4}
+
+func testFileData(seed, length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte((i*31 + seed) % 251)
+	}
+	return data
+}
+
+// Write the files of a testdata torrent under dir, as a download would lay
+// them out
+func writeV2TestData(t *testing.T, torrent TorrentFile, dir string) {
+	files, err := torrent.fileLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.padding {
+			continue
+		}
+		rel, _ := filepath.Rel(filepath.Join(dir, torrent.Info.Name), f.path)
+		if rel == "." {
+			rel = torrent.Info.Name
+		}
+		os.MkdirAll(filepath.Dir(f.path), 0755)
+		err = os.WriteFile(f.path, testFileData(v2TestSeeds[filepath.ToSlash(rel)], int(f.length)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenV2Torrents(t *testing.T) {
+	for _, test := range []struct {
+		file, v1, v2 string
+		pieces       int
+		hybrid       bool
+	}{
+		{"v2.torrent", "", "7c8ae35d1a52eb345849ba8cbe0c68d303af1ba8acda471b7e9144eadbd46e07", 6, false},
+		{"v2single.torrent", "", "1b1cfaee25605e2bdaee3bf2d2305dc07f66ba4b70c4a4a8328630e5a3e989a5", 5, false},
+		{"hybrid.torrent", "a264eb45d4943a7a966cdcc3ed2f9f59ba8cd2bd", "6fdcce9f4a1dfee02d0ae1dfc7ac0fc0e0439314ec0ea5a73440a4ba4ec3286a", 6, true},
+	} {
+		torrent, infoHash, err := openTorrent(filepath.Join("testdata", test.file))
+		if err != nil {
+			t.Fatalf("%s: %v", test.file, err)
+		}
+		if got := hex.EncodeToString(torrent.v2.infoHash[:]); got != test.v2 {
+			t.Errorf("%s: v2 info hash %s", test.file, got)
+		}
+		// Pure v2 swarms go by the truncated SHA-256, hybrids by the SHA-1
+		want := test.v1
+		if want == "" {
+			want = test.v2[:40]
+		}
+		if got := hex.EncodeToString(infoHash); got != want {
+			t.Errorf("%s: swarm info hash %s, want %s", test.file, got, want)
+		}
+		if torrent.v2.hybrid != test.hybrid || torrent.numPieces() != test.pieces {
+			t.Errorf("%s: hybrid %v with %d pieces", test.file, torrent.v2.hybrid, torrent.numPieces())
+		}
+
+		// The files verify against the merkle trees, and the v1 hashes of
+		// the hybrid
+		dir := t.TempDir()
+		writeV2TestData(t, torrent, dir)
+		dataPath := filepath.Join(dir, torrent.Info.Name)
+		if !runVerify(filepath.Join("testdata", test.file), dataPath) {
+			t.Fatalf("%s: data failed to verify", test.file)
+		}
+		files, _ := torrent.fileLayout(dir)
+		last := files[len(files)-1].path
+		file, _ := os.OpenFile(last, os.O_WRONLY, 0)
+		file.WriteAt([]byte{0}, 10)
+		file.Close()
+		if runVerify(filepath.Join("testdata", test.file), dataPath) {
+			t.Fatalf("%s: corrupt data verified", test.file)
+		}
+	}
+}
+
+// Pure v2 torrents are laid out with each file starting on a piece, the gaps
+// filled by padding that never reaches the disk
+func TestV2Layout(t *testing.T) {
+	torrent, _, err := openTorrent(filepath.Join("testdata", "v2.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range torrent.Info.Files {
+		got = append(got, fmt.Sprintf("%s:%d:%v", strings.Join(f.Path, "/"), f.Length, f.isPadding()))
+	}
+	want := []string{"a.bin:100000:false", "empty:0:false", ".pad/31072:31072:true", "sub/b.bin:20000:false", ".pad/12768:12768:true", "sub/c.bin:5000:false"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("layout %q", got)
+	}
+	for index, want := range map[int]int{0: 32768, 3: 1696, 4: 20000, 5: 5000} {
+		if got := torrent.pieceDataSize(index); got != want {
+			t.Errorf("piece %d holds %d bytes of data, want %d", index, got, want)
+		}
+	}
+	for name, want := range map[string]int{"a.bin": 0, "sub/b.bin": 4, "sub/c.bin": 5} {
+		for _, f := range torrent.v2.files {
+			if strings.Join(f.path, "/") == name && f.firstPiece != want {
+				t.Errorf("%s starts at piece %d, want %d", name, f.firstPiece, want)
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	writeV2TestData(t, torrent, dir)
+	entries, _ := os.ReadDir(filepath.Join(dir, "v2dir"))
+	if len(entries) != 3 {
+		t.Fatalf("%d entries on disk, padding was written", len(entries))
+	}
+
+	// Padding reads as zeros, and pieces ending in it verify
+	storage, err := openFileStorage(torrent, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	piece := make([]byte, torrent.pieceSize(3))
+	for i := range piece {
+		piece[i] = 0xff
+	}
+	err = storage.readAt(piece, int64(3*torrent.Info.PieceLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(piece[1696:], make([]byte, len(piece)-1696)) || !validatePiece(torrent, 3, piece) {
+		t.Fatal("piece ending in padding does not verify")
+	}
+	if validatePiece(torrent, 4, piece) {
+		t.Fatal("piece verified against another file")
+	}
+}
+
+func TestHybridLayoutMismatch(t *testing.T) {
+	torrent, _, err := openTorrent(filepath.Join("testdata", "hybrid.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkHybridLayout(torrent, torrent.v2, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A renamed file, and a file pushed off its piece boundary
+	renamed := torrent
+	renamed.Info.Files = append([]torrentFileEntry(nil), torrent.Info.Files...)
+	renamed.Info.Files[0].Path = []string{"other.bin"}
+	if checkHybridLayout(renamed, torrent.v2, false) == nil {
+		t.Error("renamed file accepted")
+	}
+	shifted := torrent
+	shifted.Info.Files = nil
+	for _, f := range torrent.Info.Files {
+		if f.isPadding() {
+			f.Length--
+		}
+		shifted.Info.Files = append(shifted.Info.Files, f)
+	}
+	if checkHybridLayout(shifted, torrent.v2, false) == nil {
+		t.Error("unaligned file accepted")
+	}
+	if checkHybridLayout(torrent, torrent.v2, true) == nil {
+		t.Error("multi-file torrent accepted as a single file")
+	}
+}
+
+// A hybrid downloads from v1 peers, which only need to serve the file data:
+// padding at the end of a piece is never requested. The fake peer serves
+// garbage for it, which would fail the piece hashes.
+func TestDownloadHybrid(t *testing.T) {
+	torrent, infoHash, err := openTorrent(filepath.Join("testdata", "hybrid.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, f := range torrent.Info.Files {
+		if f.isPadding() {
+			data = append(data, bytes.Repeat([]byte{0xee}, f.Length)...)
+		} else {
+			data = append(data, testFileData(v2TestSeeds[strings.Join(f.Path, "/")], f.Length)...)
+		}
+	}
+	peer := startFakePeer(t, data, torrent.Info.PieceLength)
+	peer.jitter = time.Millisecond
+
+	config := testDownloadConfig(t.TempDir())
+	err = downloadTorrent(torrent, hex.EncodeToString(infoHash), newPeerID(), []string{peer.address()}, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(config.outputDir, "hybrid", "a.bin"))
+	if err != nil || !bytes.Equal(got, testFileData(1, 100000)) {
+		t.Fatalf("downloaded a.bin does not match: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(config.outputDir, "hybrid", ".pad")); err == nil {
+		t.Fatal("padding written to disk")
+	}
+}
+
+// A leecher that only has the info dictionary, as from a magnet link, gets
+// the piece layers from a seeder and then downloads the pure v2 torrent
+func TestV2PieceLayersFromSeeder(t *testing.T) {
+	torrent, infoHash, err := openTorrent(filepath.Join("testdata", "v2.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	seedConfig := testDownloadConfig(t.TempDir())
+	seedConfig.listenPort = port
+	seedConfig.seedRatio = 1.0
+	seedConfig.seedTime = 10 * time.Second
+	writeV2TestData(t, torrent, seedConfig.outputDir)
+	seeded := make(chan error, 1)
+	go func() {
+		seeded <- downloadTorrent(torrent, hex.EncodeToString(infoHash), "-PC0001-SEEDER000000", nil, seedConfig, nil)
+	}()
+
+	fetched, err := torrentFromMetadata(torrent.RawInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched.v2.missingLayers()) != 1 {
+		t.Fatalf("%d piece layers missing, want 1", len(fetched.v2.missingLayers()))
+	}
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	start := time.Now()
+	for {
+		err = fetchPieceLayersFrom(address, fetched.v2, infoHash, "-PC0001-LEECHER00000")
+		if err == nil || time.Since(start) > 5*time.Second {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fetched.v2.files[0].layer, torrent.v2.files[0].layer) {
+		t.Fatal("fetched piece layer differs from the torrent's")
+	}
+
+	leechConfig := testDownloadConfig(t.TempDir())
+	err = downloadTorrent(fetched, hex.EncodeToString(infoHash), "-PC0001-LEECHER00000", []string{address}, leechConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, seed := range map[string]int{"a.bin": 1, "sub/c.bin": 3} {
+		got, _ := os.ReadFile(filepath.Join(leechConfig.outputDir, "v2dir", filepath.FromSlash(name)))
+		if !bytes.Equal(got, testFileData(seed, len(got))) || len(got) == 0 {
+			t.Fatalf("downloaded %s does not match", name)
+		}
+	}
+	select {
+	case err := <-seeded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("seeder did not stop")
+	}
+}
@@ -0,0 +1,78 @@
+// Package bencode encodes and decodes the BitTorrent serialization format
+// (BEP 3).
+//
+// Values map to Go types much like encoding/json does: integers to any
+// integer kind (or bool, as 0 and 1), strings to string or []byte, lists to
+// slices and arrays, and dictionaries to structs or maps with string keys.
+// Decoding into an empty interface produces int64, string, []interface{} and
+// map[string]interface{}. Struct fields are named by `bencode:"key"` tags,
+// which accept the omitempty option and "-" to skip a field; untagged fields
+// use their Go name. Keys are matched exactly first, then case-insensitively.
+//
+// Decoding is lenient by default: it accepts dictionaries with unsorted keys,
+// integers and string lengths with leading zeros, and data after the value,
+// all of which appear in real-world torrents. A strict decoder rejects
+// anything that isn't canonical bencode. Either way, malformed input is
+// reported with the byte offset where it went wrong.
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// RawMessage is a bencoded value kept as its exact bytes. Decoding into a
+// RawMessage captures the value without interpreting it; encoding one writes
+// it out unchanged.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// A SyntaxError describes malformed or, in strict mode, non-canonical input
+type SyntaxError struct {
+	Offset int64 // Bytes read before the error
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+// An UnmarshalTypeError describes a value that doesn't fit the Go value it
+// was decoded into. Decoding skips such values and carries on, then returns
+// the first of these errors.
+type UnmarshalTypeError struct {
+	Value  string       // "integer", "string", "list" or "dictionary"
+	Type   reflect.Type // Go type it could not be stored in
+	Offset int64        // Where the value starts
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot decode %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// An InvalidUnmarshalError describes an invalid argument to Decode or
+// Unmarshal, which need a non-nil pointer
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "bencode: Unmarshal(nil)"
+	}
+	return fmt.Sprintf("bencode: Unmarshal(non-pointer %s)", e.Type)
+}
+
+// An UnsupportedTypeError is returned when encoding a value that bencode has
+// no representation for, such as a float or a nil pointer in a list
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Type == nil {
+		return "bencode: unsupported value nil"
+	}
+	return fmt.Sprintf("bencode: unsupported type %s", e.Type)
+}
@@ -0,0 +1,468 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// Lists and dictionaries nested deeper than this are rejected, so hostile
+// input can't exhaust the stack
+const maxDepth = 256
+
+// Strings are read in chunks of at most this size, so a huge declared length
+// only costs memory as the data actually arrives
+const readChunk = 64 << 10
+
+// A Decoder reads bencoded values from a stream
+type Decoder struct {
+	r      *bufio.Reader
+	offset int64
+	strict bool
+
+	// Bytes of the RawMessage values being decoded; capturing counts the
+	// nested RawMessages in progress
+	raw       []byte
+	capturing int
+
+	typeErr error // First value that didn't fit, returned once decoding is done
+}
+
+// NewDecoder returns a lenient decoder reading from r. It may read ahead of
+// the values it decodes; InputOffset tells how far it got.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Strict makes the decoder reject input that isn't canonical: dictionary keys
+// out of order or repeated, and integers or string lengths with leading zeros
+// or a negative zero
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// InputOffset returns the number of bytes of input consumed by decoded values
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Decode reads the next value and stores it in the value pointed to by v. At
+// the end of the input it returns io.EOF.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+	_, err := d.r.Peek(1)
+	if err == io.EOF {
+		return io.EOF
+	}
+	d.typeErr = nil
+	err = d.value(rv, 0)
+	if err != nil {
+		return err
+	}
+	return d.typeErr
+}
+
+// Unmarshal decodes data leniently into the value pointed to by v. Data after
+// the first value is ignored.
+func Unmarshal(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	err := d.Decode(v)
+	if err == io.EOF {
+		return d.syntaxError("unexpected end of input")
+	}
+	return err
+}
+
+// UnmarshalStrict decodes data into the value pointed to by v, failing unless
+// data is exactly one canonically encoded value
+func UnmarshalStrict(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.Strict()
+	err := d.Decode(v)
+	if err == io.EOF {
+		return d.syntaxError("unexpected end of input")
+	}
+	if err != nil {
+		return err
+	}
+	if d.offset != int64(len(data)) {
+		return d.syntaxError("data after the value")
+	}
+	return nil
+}
+
+func (d *Decoder) syntaxError(msg string) error {
+	return &SyntaxError{Offset: d.offset, msg: msg}
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return 0, d.syntaxError("unexpected end of input")
+		}
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return 0, d.syntaxError("unexpected end of input")
+		}
+		return 0, err
+	}
+	d.consumed([]byte{b})
+	return b, nil
+}
+
+func (d *Decoder) consumed(b []byte) {
+	d.offset += int64(len(b))
+	if d.capturing > 0 {
+		d.raw = append(d.raw, b...)
+	}
+}
+
+// Read the digits of an integer up to the terminator, which is consumed
+func (d *Decoder) readNumber(terminator byte) (int64, error) {
+	start := d.offset
+	var digits []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == terminator {
+			break
+		}
+		if len(digits) > 20 {
+			return 0, &SyntaxError{Offset: start, msg: "integer too long"}
+		}
+		digits = append(digits, c)
+	}
+	n, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil || digits[0] == '+' {
+		return 0, &SyntaxError{Offset: start, msg: "invalid integer " + strconv.Quote(string(digits))}
+	}
+	if d.strict {
+		unsigned := bytes.TrimPrefix(digits, []byte("-"))
+		if len(unsigned) > 1 && unsigned[0] == '0' {
+			return 0, &SyntaxError{Offset: start, msg: "integer with leading zeros"}
+		}
+		if string(digits) == "-0" {
+			return 0, &SyntaxError{Offset: start, msg: "negative zero"}
+		}
+	}
+	return n, nil
+}
+
+func (d *Decoder) readString() ([]byte, error) {
+	start := d.offset
+	n, err := d.readNumber(':')
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, &SyntaxError{Offset: start, msg: "negative string length"}
+	}
+	s := make([]byte, 0, min64(n, readChunk))
+	for int64(len(s)) < n {
+		chunk := int(min64(n-int64(len(s)), readChunk))
+		s = append(s, make([]byte, chunk)...)
+		got, err := io.ReadFull(d.r, s[len(s)-chunk:])
+		d.consumed(s[len(s)-chunk : len(s)-chunk+got])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, d.syntaxError("unexpected end of input in string")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Decode one value into v. An invalid v discards the value.
+func (d *Decoder) value(v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return d.syntaxError("values nested too deeply")
+	}
+	// Allocate pointers and find what they point to
+	for v.IsValid() && v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.IsValid() && v.Type() == rawMessageType {
+		start := len(d.raw)
+		d.capturing++
+		err := d.value(reflect.Value{}, depth)
+		d.capturing--
+		if err != nil {
+			return err
+		}
+		v.SetBytes(append([]byte(nil), d.raw[start:]...))
+		if d.capturing == 0 {
+			d.raw = d.raw[:0]
+		}
+		return nil
+	}
+	if v.IsValid() && v.Kind() == reflect.Interface {
+		if v.NumMethod() > 0 {
+			return d.mismatch(v, depth)
+		}
+		generic, err := d.generic(depth)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(generic))
+		return nil
+	}
+
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		return d.integer(v)
+	case c >= '0' && c <= '9':
+		return d.stringValue(v)
+	case c == 'l':
+		return d.list(v, depth)
+	case c == 'd':
+		return d.dict(v, depth)
+	}
+	return d.syntaxError("invalid value type " + strconv.QuoteRune(rune(c)))
+}
+
+// Skip a value that doesn't fit v, remembering the first such mismatch
+func (d *Decoder) mismatch(v reflect.Value, depth int) error {
+	start := d.offset
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+	err = d.value(reflect.Value{}, depth)
+	if err != nil {
+		return err
+	}
+	if d.typeErr == nil {
+		kind := map[byte]string{'i': "integer", 'l': "list", 'd': "dictionary"}[c]
+		if kind == "" {
+			kind = "string"
+		}
+		d.typeErr = &UnmarshalTypeError{Value: kind, Type: v.Type(), Offset: start}
+	}
+	return nil
+}
+
+func (d *Decoder) integer(v reflect.Value) error {
+	start := d.offset
+	d.readByte() // 'i'
+	n, err := d.readNumber('e')
+	if err != nil {
+		return err
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	fits := true
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fits = !v.OverflowInt(n)
+		if fits {
+			v.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		fits = n >= 0 && !v.OverflowUint(uint64(n))
+		if fits {
+			v.SetUint(uint64(n))
+		}
+	case reflect.Bool:
+		fits = n == 0 || n == 1
+		if fits {
+			v.SetBool(n == 1)
+		}
+	default:
+		fits = false
+	}
+	if !fits && d.typeErr == nil {
+		d.typeErr = &UnmarshalTypeError{Value: "integer " + strconv.FormatInt(n, 10), Type: v.Type(), Offset: start}
+	}
+	return nil
+}
+
+func (d *Decoder) stringValue(v reflect.Value) error {
+	start := d.offset
+	s, err := d.readString()
+	if err != nil {
+		return err
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(s)
+		return nil
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == len(s):
+		reflect.Copy(v, reflect.ValueOf(s))
+		return nil
+	}
+	if d.typeErr == nil {
+		d.typeErr = &UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: start}
+	}
+	return nil
+}
+
+func (d *Decoder) list(v reflect.Value, depth int) error {
+	switch {
+	case !v.IsValid():
+	case v.Kind() == reflect.Slice:
+		v.SetLen(0)
+	case v.Kind() == reflect.Array:
+	default:
+		return d.mismatch(v, depth)
+	}
+	d.readByte() // 'l'
+	for i := 0; ; i++ {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			break
+		}
+		var elem reflect.Value
+		switch {
+		case !v.IsValid():
+		case v.Kind() == reflect.Slice:
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			elem = v.Index(i)
+		case i < v.Len():
+			elem = v.Index(i)
+		}
+		err = d.value(elem, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	if v.IsValid() && v.Kind() == reflect.Slice && v.IsNil() {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	return nil
+}
+
+func (d *Decoder) dict(v reflect.Value, depth int) error {
+	var fields []field
+	switch {
+	case !v.IsValid():
+	case v.Kind() == reflect.Struct:
+		fields = cachedFields(v.Type())
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return d.mismatch(v, depth)
+	}
+	d.readByte() // 'd'
+	var lastKey []byte
+	for first := true; ; first = false {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			return nil
+		}
+		if c < '0' || c > '9' {
+			return d.syntaxError("dictionary key is not a string")
+		}
+		keyOffset := d.offset
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if d.strict && !first {
+			switch bytes.Compare(lastKey, key) {
+			case 0:
+				return &SyntaxError{Offset: keyOffset, msg: "duplicate key " + strconv.Quote(string(key))}
+			case 1:
+				return &SyntaxError{Offset: keyOffset, msg: "unsorted key " + strconv.Quote(string(key))}
+			}
+		}
+		lastKey = key
+
+		switch {
+		case !v.IsValid():
+			err = d.value(reflect.Value{}, depth+1)
+		case v.Kind() == reflect.Struct:
+			var target reflect.Value
+			if f := fieldByKey(fields, string(key)); f != nil {
+				target = v.Field(f.index)
+			}
+			err = d.value(target, depth+1)
+		default:
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err = d.value(elem, depth+1)
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Decode a value into int64, string, []interface{} or map[string]interface{}
+func (d *Decoder) generic(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, d.syntaxError("values nested too deeply")
+	}
+	c, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == 'i':
+		var n int64
+		err := d.integer(reflect.ValueOf(&n).Elem())
+		return n, err
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		return string(s), err
+	case c == 'l':
+		list := []interface{}{}
+		err := d.list(reflect.ValueOf(&list).Elem(), depth)
+		return list, err
+	case c == 'd':
+		dict := map[string]interface{}{}
+		err := d.dict(reflect.ValueOf(&dict).Elem(), depth)
+		return dict, err
+	}
+	return nil, d.syntaxError("invalid value type " + strconv.QuoteRune(rune(c)))
+}
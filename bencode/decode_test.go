@@ -0,0 +1,230 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Shaped like the client's TorrentFile, tags included
+type testTorrent struct {
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Info         struct {
+		Name        string `bencode:"name"`
+		PieceLength int    `bencode:"piece length"`
+		Pieces      string `bencode:"pieces"`
+		Length      int    `bencode:"length,omitempty"`
+		Files       []struct {
+			Length int      `bencode:"length"`
+			Path   []string `bencode:"path"`
+		} `bencode:"files,omitempty"`
+	} `bencode:"info"`
+	Skipped string `bencode:"-"`
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	data := "d1:-4:nope8:announce13:http://t/annc13:announce-listll1:aelee" +
+		"4:infod5:filesld6:lengthi3e4:pathl1:a1:beed6:lengthi4e4:pathl1:ceee" +
+		"4:name1:x12:piece lengthi16384e6:pieces3:abc7:privatei1eee"
+	var torrent testTorrent
+	err := UnmarshalStrict([]byte(data), &torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Announce != "http://t/annc" || !reflect.DeepEqual(torrent.AnnounceList, [][]string{{"a"}, {}}) {
+		t.Fatalf("announce %q %q", torrent.Announce, torrent.AnnounceList)
+	}
+	info := torrent.Info
+	if info.Name != "x" || info.PieceLength != 16384 || info.Pieces != "abc" || len(info.Files) != 2 {
+		t.Fatalf("info %+v", info)
+	}
+	if info.Files[0].Length != 3 || !reflect.DeepEqual(info.Files[1].Path, []string{"c"}) {
+		t.Fatalf("files %+v", info.Files)
+	}
+	if torrent.Skipped != "" {
+		t.Fatal("field tagged - was decoded")
+	}
+}
+
+func TestUnmarshalTypes(t *testing.T) {
+	var v struct {
+		Int     int8
+		Uint    uint16
+		Bool    bool
+		Bytes   []byte
+		Array   [2]byte
+		List    [2]int
+		Map     map[string]int
+		Pointer *string
+		Any     interface{}
+		Named   string `bencode:"Key"`
+	}
+	data := "d5:Array2:xy5:Bytes3:abc4:booli1e3:inti-5e4:listli1ei2ei3ee3:keyi0e" +
+		"3:mapd1:ai1e1:bi2ee7:pointer1:p4:uinti65535e3:anyld1:ki1eeee"
+	err := Unmarshal([]byte(data), &v)
+	if err == nil || !strings.Contains(err.Error(), "type string") {
+		t.Fatalf("integer into a string field gave %v", err)
+	}
+	if v.Int != -5 || v.Uint != 65535 || !v.Bool || string(v.Bytes) != "abc" || string(v.Array[:]) != "xy" {
+		t.Fatalf("decoded %+v", v)
+	}
+	// The list's third element doesn't fit and is dropped
+	if v.List != [2]int{1, 2} || v.Map["b"] != 2 || *v.Pointer != "p" {
+		t.Fatalf("decoded %+v", v)
+	}
+	if !reflect.DeepEqual(v.Any, []interface{}{map[string]interface{}{"k": int64(1)}}) {
+		t.Fatalf("generic value %#v", v.Any)
+	}
+
+	// Values that don't fit are skipped, and the first one is reported
+	var small struct{ N int8 }
+	err = Unmarshal([]byte("d1:Ni300ee"), &small)
+	var typeErr *UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Offset != 4 {
+		t.Fatalf("overflow gave %v", err)
+	}
+	var list []int
+	err = Unmarshal([]byte("li1e1:xi3ee"), &list)
+	if !errors.As(err, &typeErr) || typeErr.Value != "string" || !reflect.DeepEqual(list, []int{1, 0, 3}) {
+		t.Fatalf("got %v: %v", list, err)
+	}
+	err = Unmarshal([]byte("i1e"), list)
+	var invalid *InvalidUnmarshalError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("non-pointer gave %v", err)
+	}
+}
+
+func TestStrictAndLenient(t *testing.T) {
+	for _, data := range []string{
+		"d1:bi1e1:ai2ee", // Unsorted keys
+		"d1:ai1e1:ai2ee", // Duplicate key
+		"i03e",           // Leading zero
+		"i-0e",           // Negative zero
+		"03:abc",         // Leading zero in a length
+		"i1ei2e",         // Data after the value
+	} {
+		var v interface{}
+		err := UnmarshalStrict([]byte(data), &v)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("strict decoding accepted %q: %v", data, err)
+		}
+		err = Unmarshal([]byte(data), &v)
+		if err != nil {
+			t.Errorf("lenient decoding rejected %q: %v", data, err)
+		}
+	}
+}
+
+func TestSyntaxErrorOffsets(t *testing.T) {
+	for data, offset := range map[string]int64{
+		"":                0,
+		"x":               0,
+		"i12":             3,
+		"iae":             1,
+		"i+1e":            1,
+		"5:abc":           5,
+		"-1:a":            0,
+		"l1:ai1e":         7,
+		"d1:ai1ei2ei3ee":  7, // Integer key
+		"d1:a1:b1:cf":     10,
+		"le":              -1,
+		"d3:keyl1:xi2eee": -1,
+	} {
+		var v interface{}
+		err := Unmarshal([]byte(data), &v)
+		if offset < 0 {
+			if err != nil {
+				t.Errorf("%q: %v", data, err)
+			}
+			continue
+		}
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) || syntaxErr.Offset != offset {
+			t.Errorf("%q gave %v, want an error at offset %d", data, err, offset)
+		}
+	}
+
+	deep := strings.Repeat("l", maxDepth+10) + strings.Repeat("e", maxDepth+10)
+	var v interface{}
+	if err := Unmarshal([]byte(deep), &v); err == nil {
+		t.Fatal("deeply nested lists were accepted")
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	var torrent struct {
+		Info RawMessage `bencode:"info"`
+		Name string     `bencode:"name"`
+	}
+	// Unsorted keys and leading zeros survive in the captured bytes
+	data := "d4:infod6:pieces2:ab4:name1:x7:privatei01ee4:name1:ne"
+	err := Unmarshal([]byte(data), &torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(torrent.Info) != "d6:pieces2:ab4:name1:x7:privatei01ee" || torrent.Name != "n" {
+		t.Fatalf("captured %q", torrent.Info)
+	}
+
+	// Nested captures each get their own bytes
+	var nested struct {
+		Outer struct {
+			Inner RawMessage `bencode:"inner"`
+		} `bencode:"outer"`
+		Whole RawMessage `bencode:"whole"`
+	}
+	err = Unmarshal([]byte("d5:outerd5:innerli1eee5:whole3:abce"), &nested)
+	if err != nil || string(nested.Outer.Inner) != "li1ee" || string(nested.Whole) != "3:abc" {
+		t.Fatalf("captured %q and %q: %v", nested.Outer.Inner, nested.Whole, err)
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	// A bencoded dictionary followed by raw data, as in ut_metadata messages
+	input := "d8:msg_typei1e5:piecei0ee" + "RAWDATA"
+	d := NewDecoder(strings.NewReader(input))
+	var msg struct {
+		MsgType int `bencode:"msg_type"`
+		Piece   int `bencode:"piece"`
+	}
+	err := d.Decode(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MsgType != 1 || input[d.InputOffset():] != "RAWDATA" {
+		t.Fatalf("decoded %+v, offset %d", msg, d.InputOffset())
+	}
+
+	// Several values in a row, then EOF
+	d = NewDecoder(strings.NewReader("i1e3:abcle"))
+	var values []interface{}
+	for {
+		var v interface{}
+		err := d.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, v)
+	}
+	if !reflect.DeepEqual(values, []interface{}{int64(1), "abc", []interface{}{}}) {
+		t.Fatalf("values %#v", values)
+	}
+
+	// A huge declared length fails when the data runs out, without
+	// allocating it up front
+	var s string
+	err = NewDecoder(bytes.NewReader([]byte("999999999999:abc"))).Decode(&s)
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("truncated string gave %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	var torrent testTorrent
+	torrent.Announce = "http://t/annc"
+	torrent.Info.Name = "x"
+	torrent.Info.PieceLength = 16384
+	torrent.Info.Pieces = "abc"
+	torrent.Info.Length = 3
+	torrent.Skipped = "not written"
+	data, err := Marshal(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys sorted, empty omitempty fields left out
+	want := "d8:announce13:http://t/annc4:infod6:lengthi3e4:name1:x12:piece lengthi16384e6:pieces3:abcee"
+	if string(data) != want {
+		t.Fatalf("got %s", data)
+	}
+
+	// What was encoded decodes strictly to the same value
+	var decoded testTorrent
+	err = UnmarshalStrict(data, &decoded)
+	if err != nil || !reflect.DeepEqual(decoded.Info, torrent.Info) {
+		t.Fatalf("decoded %+v: %v", decoded, err)
+	}
+
+	for v, want := range map[interface{}]string{
+		int64(-42):        "i-42e",
+		uint8(7):          "i7e",
+		true:              "i1e",
+		"":                "0:",
+		[2]byte{'h', 'i'}: "2:hi",
+	} {
+		data, err := Marshal(v)
+		if err != nil || string(data) != want {
+			t.Errorf("%#v encoded as %s: %v", v, data, err)
+		}
+	}
+	data, err = Marshal(map[string]interface{}{
+		"z":    []interface{}{1, "a", []byte("b")},
+		"a":    map[string]int{"y": 1, "x": 2},
+		"raw":  RawMessage("d1:ai1ee"),
+		"\xff": 0,
+	})
+	if err != nil || string(data) != "d1:ad1:xi2e1:yi1ee3:rawd1:ai1ee1:zli1e1:a1:be1:\xffi0ee" {
+		t.Fatalf("got %s: %v", data, err)
+	}
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	var nilPointer *int
+	for _, v := range []interface{}{
+		1.5,
+		nil,
+		[]interface{}{nilPointer},
+		map[int]string{1: "a"},
+		make(chan int),
+		RawMessage{},
+	} {
+		_, err := Marshal(v)
+		var unsupported *UnsupportedTypeError
+		if !errors.As(err, &unsupported) {
+			t.Errorf("%#v gave %v", v, err)
+		}
+	}
+
+	// nil pointers in structs are left out rather than failing
+	var v struct {
+		A *int `bencode:"a"`
+		B int  `bencode:"b"`
+	}
+	data, err := Marshal(v)
+	if err != nil || string(data) != "d1:bi0ee" {
+		t.Fatalf("got %s: %v", data, err)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.Encode(1)
+	e.Encode("a")
+	if buf.String() != "i1e1:a" {
+		t.Fatalf("got %s", buf.String())
+	}
+}
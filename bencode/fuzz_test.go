@@ -0,0 +1,77 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+)
+
+var fuzzSeeds = []string{
+	"i42e",
+	"i-0e",
+	"4:spam",
+	"l4:spami42ee",
+	"d3:bar4:spam3:fooi42ee",
+	"d1:bi1e1:ai2ee",
+	"d8:announce3:url4:infod6:lengthi1e4:name1:x12:piece lengthi1e6:pieces20:aaaaaaaaaaaaaaaaaaaaee",
+	"d5:filesld6:lengthi3e4:pathl1:aeeee",
+	"lllleeee",
+	"999999999:x",
+}
+
+// Arbitrary input never panics; whatever decodes strictly encodes back to
+// the same bytes, and whatever decodes leniently encodes to something that
+// decodes strictly to the same value
+func FuzzDecode(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var strict interface{}
+		if UnmarshalStrict(data, &strict) == nil {
+			encoded, err := Marshal(strict)
+			if err != nil {
+				t.Fatalf("cannot encode %#v: %v", strict, err)
+			}
+			if !bytes.Equal(encoded, data) {
+				t.Fatalf("%q encoded back as %q", data, encoded)
+			}
+		}
+
+		var lenient interface{}
+		if Unmarshal(data, &lenient) == nil {
+			encoded, err := Marshal(lenient)
+			if err != nil {
+				t.Fatalf("cannot encode %#v: %v", lenient, err)
+			}
+			var again interface{}
+			err = UnmarshalStrict(encoded, &again)
+			if err != nil {
+				t.Fatalf("%q is not canonical: %v", encoded, err)
+			}
+		}
+	})
+}
+
+// Decoding into structs, including raw captures, never panics, and a
+// captured value decodes on its own
+func FuzzDecodeStruct(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var torrent testTorrent
+		Unmarshal(data, &torrent)
+
+		var raw struct {
+			Info RawMessage `bencode:"info"`
+			Foo  *int64     `bencode:"foo"`
+		}
+		if Unmarshal(data, &raw) == nil && raw.Info != nil {
+			var v interface{}
+			err := Unmarshal(raw.Info, &v)
+			if err != nil {
+				t.Fatalf("captured %q does not decode: %v", raw.Info, err)
+			}
+		}
+	})
+}
@@ -2,10 +2,7 @@ module bittorrent-client
 
 go 1.19
 
-require (
-	fyne.io/fyne/v2 v2.3.5
-	github.com/jackpal/bencode-go v1.0.0
-)
+require fyne.io/fyne/v2 v2.3.5
 
 require (
 	fyne.io/systray v1.10.1-0.20230722100817-88df1e0ffa9a // indirect